@@ -0,0 +1,217 @@
+package proxy
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// ACL is the list of the callers allowed to use the parameters of the host.
+// Each non-empty list must match the caller, and any entry in the list can match.
+type ACL struct {
+	// Principals is the list of glob patterns of IAM principal ARNs.
+	// The caller identity must be verified by sts:GetCallerIdentity.
+	Principals []string
+
+	// Accounts is the list of AWS account IDs.
+	// The caller identity must be verified by sts:GetCallerIdentity.
+	Accounts []string
+
+	// Instances is the list of glob patterns of EC2 instance IDs.
+	// Note that instance IDs are self-reported by the proxy.
+	Instances []string
+
+	// Tags is the list of "key=value" pairs, and the value may be a glob pattern.
+	// Note that tags are self-reported by the proxy.
+	Tags []string
+
+	// the patterns compiled by set.
+	// Allow compiles them on each call if the ACL is not built by set.
+	principals []*regexp.Regexp
+	instances  []*regexp.Regexp
+	tags       []tagPattern
+	err        error
+}
+
+// tagPattern is a compiled entry of ACL.Tags.
+type tagPattern struct {
+	key   string
+	value *regexp.Regexp
+}
+
+// assumedRolePattern matches the ARN of assumed roles.
+var assumedRolePattern = regexp.MustCompile(`^arn:([^:]+):sts::(\d+):assumed-role/([^/]+)/.+$`)
+
+// set sets the list from the parameter acl/{name}.
+// Unknown names and empty lists are recorded as an error, and Allow denies all callers.
+func (acl *ACL) set(name, value string) {
+	list := splitList(value)
+	if len(list) == 0 {
+		acl.fail(fmt.Errorf("acl/%s is empty", name))
+		return
+	}
+	switch name {
+	case "principals":
+		acl.Principals = list
+		acl.principals = compileGlobs(list)
+	case "accounts":
+		acl.Accounts = list
+	case "instances":
+		acl.Instances = list
+		acl.instances = compileGlobs(list)
+	case "tags":
+		tags, err := compileTags(list)
+		if err != nil {
+			acl.fail(err)
+			return
+		}
+		acl.Tags = list
+		acl.tags = tags
+	default:
+		acl.fail(fmt.Errorf("unknown parameter acl/%s", name))
+	}
+}
+
+// fail records the first error.
+func (acl *ACL) fail(err error) {
+	if acl.err == nil {
+		acl.err = err
+	}
+}
+
+// requiresIdentity reports whether the ACL needs the identity verified by sts:GetCallerIdentity.
+func (acl *ACL) requiresIdentity() bool {
+	return acl != nil && (len(acl.Principals) > 0 || len(acl.Accounts) > 0)
+}
+
+// Allow returns an error that explains the reason if the caller is not allowed.
+func (acl *ACL) Allow(rc *RequestContext) error {
+	if acl == nil {
+		return nil
+	}
+	if acl.err != nil {
+		// fail closed.
+		return fmt.Errorf("invalid acl: %v", acl.err)
+	}
+
+	identity := rc.Identity
+	if len(acl.Principals) > 0 {
+		if identity.ARN == "" {
+			return fmt.Errorf("the caller identity is required by acl/principals")
+		}
+		principals := acl.principals
+		if principals == nil {
+			principals = compileGlobs(acl.Principals)
+		}
+		if !matchPrincipal(principals, identity.ARN) {
+			return fmt.Errorf("the caller %s is not allowed by acl/principals", identity.ARN)
+		}
+	}
+
+	if len(acl.Accounts) > 0 {
+		if identity.Account == "" {
+			return fmt.Errorf("the caller identity is required by acl/accounts")
+		}
+		if !contains(acl.Accounts, identity.Account) {
+			return fmt.Errorf("the account %s is not allowed by acl/accounts", identity.Account)
+		}
+	}
+
+	instance := rc.Instance
+	if len(acl.Instances) > 0 {
+		instances := acl.instances
+		if instances == nil {
+			instances = compileGlobs(acl.Instances)
+		}
+		if !matchAny(instances, instance.InstanceID) {
+			return fmt.Errorf("the instance %q is not allowed by acl/instances", instance.InstanceID)
+		}
+	}
+
+	if len(acl.Tags) > 0 {
+		tags := acl.tags
+		if tags == nil {
+			var err error
+			tags, err = compileTags(acl.Tags)
+			if err != nil {
+				// fail closed.
+				return fmt.Errorf("invalid acl: %v", err)
+			}
+		}
+		if !matchTags(tags, instance.Tags) {
+			return fmt.Errorf("the tags of the caller are not allowed by acl/tags")
+		}
+	}
+	return nil
+}
+
+// matchPrincipal reports whether the principal matches any of the patterns.
+// The ARN of assumed roles also matches the ARN of the role without its path,
+// e.g. "arn:aws:sts::123456789012:assumed-role/proxy/i-1234567890abcdef0" matches "arn:aws:iam::123456789012:role/proxy".
+func matchPrincipal(patterns []*regexp.Regexp, arn string) bool {
+	if matchAny(patterns, arn) {
+		return true
+	}
+	if m := assumedRolePattern.FindStringSubmatch(arn); m != nil {
+		role := "arn:" + m[1] + ":iam::" + m[2] + ":role/" + m[3]
+		return matchAny(patterns, role)
+	}
+	return false
+}
+
+func matchAny(patterns []*regexp.Regexp, s string) bool {
+	if s == "" {
+		return false
+	}
+	for _, re := range patterns {
+		if re.MatchString(s) {
+			return true
+		}
+	}
+	return false
+}
+
+func matchTags(patterns []tagPattern, tags map[string]string) bool {
+	for _, p := range patterns {
+		v, ok := tags[p.key]
+		if !ok {
+			continue
+		}
+		if p.value.MatchString(v) {
+			return true
+		}
+	}
+	return false
+}
+
+func compileGlobs(patterns []string) []*regexp.Regexp {
+	ret := make([]*regexp.Regexp, 0, len(patterns))
+	for _, p := range patterns {
+		ret = append(ret, compileGlob(p))
+	}
+	return ret
+}
+
+func compileTags(patterns []string) ([]tagPattern, error) {
+	ret := make([]tagPattern, 0, len(patterns))
+	for _, p := range patterns {
+		idx := strings.IndexByte(p, '=')
+		if idx < 0 {
+			return nil, fmt.Errorf("acl/tags: %q is not a key=value pair", p)
+		}
+		ret = append(ret, tagPattern{
+			key:   strings.TrimSpace(p[:idx]),
+			value: compileGlob(strings.TrimSpace(p[idx+1:])),
+		})
+	}
+	return ret, nil
+}
+
+func contains(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
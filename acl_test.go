@@ -0,0 +1,152 @@
+package proxy
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/ssm"
+)
+
+func TestACLAllow(t *testing.T) {
+	role := RequestContext{
+		Identity: IdentityContext{
+			Account: "123456789012",
+			ARN:     "arn:aws:sts::123456789012:assumed-role/proxy/i-1234567890abcdef0",
+		},
+		Instance: InstanceContext{
+			InstanceID: "i-1234567890abcdef0",
+			Tags: map[string]string{
+				"team": "payments",
+			},
+		},
+	}
+	anonymous := RequestContext{
+		Instance: InstanceContext{
+			InstanceID: "i-1234567890abcdef0",
+		},
+	}
+
+	tests := []struct {
+		name  string
+		acl   *ACL
+		rc    RequestContext
+		allow bool
+	}{
+		{"nil", nil, anonymous, true},
+		{"session", &ACL{Principals: []string{"arn:aws:sts::123456789012:assumed-role/proxy/*"}}, role, true},
+		{"role", &ACL{Principals: []string{"arn:aws:iam::123456789012:role/proxy"}}, role, true},
+		{"other role", &ACL{Principals: []string{"arn:aws:iam::123456789012:role/admin"}}, role, false},
+		{"anonymous", &ACL{Principals: []string{"*"}}, anonymous, false},
+		{"account", &ACL{Accounts: []string{"123456789012"}}, role, true},
+		{"other account", &ACL{Accounts: []string{"210987654321"}}, role, false},
+		{"instance", &ACL{Instances: []string{"i-1234567890abcdef0"}}, anonymous, true},
+		{"tags", &ACL{Tags: []string{"team=pay*"}}, role, true},
+		{"other tags", &ACL{Tags: []string{"team=search"}}, role, false},
+		{"all", &ACL{Accounts: []string{"123456789012"}, Tags: []string{"team=search"}}, role, false},
+	}
+	for _, tt := range tests {
+		err := tt.acl.Allow(&tt.rc)
+		if (err == nil) != tt.allow {
+			t.Errorf("%s: want %t, got %v", tt.name, tt.allow, err)
+		}
+	}
+}
+
+func TestACLSet(t *testing.T) {
+	role := RequestContext{
+		Identity: IdentityContext{
+			Account: "123456789012",
+			ARN:     "arn:aws:sts::123456789012:assumed-role/proxy/i-1234567890abcdef0",
+		},
+		Instance: InstanceContext{
+			InstanceID: "i-1234567890abcdef0",
+			Tags: map[string]string{
+				"team": "payments",
+			},
+		},
+	}
+
+	tests := []struct {
+		name  string
+		value string
+		allow bool
+	}{
+		{"principals", "arn:aws:iam::123456789012:role/proxy", true},
+		{"accounts", "123456789012", true},
+		{"instances", "i-1234567890abcdef0", true},
+		{"tags", "team=pay*", true},
+
+		// typo of acl/principals
+		{"principal", "arn:aws:iam::123456789012:role/admin", false},
+		{"principals", "", false},
+		{"accounts", " , ", false},
+		{"tags", "payments", false},
+	}
+	for _, tt := range tests {
+		acl := &ACL{}
+		acl.set(tt.name, tt.value)
+		err := acl.Allow(&role)
+		if (err == nil) != tt.allow {
+			t.Errorf("acl/%s = %q: want %t, got %v", tt.name, tt.value, tt.allow, err)
+		}
+	}
+}
+
+func TestLambdaACL(t *testing.T) {
+	ts := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		fmt.Fprint(w, "ok")
+	}))
+	defer ts.Close()
+
+	u, err := url.Parse(ts.URL)
+	if err != nil {
+		panic(err)
+	}
+	mock := &ssmMock{
+		output: &ssm.GetParametersByPathOutput{
+			Parameters: []ssm.Parameter{
+				{
+					Name:  aws.String("/development/" + u.Host + "/headers/secret-key"),
+					Value: aws.String("very-secret"),
+				},
+				{
+					Name:  aws.String("/development/" + u.Host + "/acl/instances"),
+					Value: aws.String("i-1234567890abcdef0,i-0987654321abcdef0"),
+				},
+			},
+		},
+	}
+	l := &Lambda{
+		Prefix: "development",
+		Client: ts.Client(),
+		svcssm: mock,
+	}
+
+	req := httptest.NewRequest(http.MethodGet, ts.URL, nil)
+	r, err := NewRequest(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r.RequestContext.Instance.InstanceID = "i-0000000000000000"
+	resp, err := l.Handle(context.Background(), r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != http.StatusForbidden {
+		t.Errorf("want %d, got %d", http.StatusForbidden, resp.StatusCode)
+	}
+
+	r.RequestContext.Instance.InstanceID = "i-1234567890abcdef0"
+	resp, err = l.Handle(context.Background(), r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("want %d, got %d", http.StatusOK, resp.StatusCode)
+	}
+}
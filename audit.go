@@ -0,0 +1,133 @@
+package proxy
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"os"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+)
+
+// AuditRecord is the audit log of a request signed by the function.
+// It never contains the values of the parameters.
+type AuditRecord struct {
+	Time      time.Time   `json:"time"`
+	RequestID string      `json:"request_id,omitempty"`
+	Caller    AuditCaller `json:"caller"`
+
+	Host   string `json:"host,omitempty"`
+	Method string `json:"method,omitempty"`
+
+	// Path is the template of the path requested by the caller.
+	// The segments that look like IDs are replaced with "{id}", and the query is removed.
+	Path string `json:"path,omitempty"`
+
+	// Parameters are the names of the applied parameters, e.g. "headers/Authorization".
+	Parameters []string `json:"parameters,omitempty"`
+
+	// Status is the status code returned to the caller.
+	Status int `json:"status,omitempty"`
+
+	// UpstreamStatus is the status code returned from the upstream.
+	// It is zero if the request is not sent to the upstream.
+	UpstreamStatus int `json:"upstream_status,omitempty"`
+
+	// Reason is the reason why the function rejected the request.
+	Reason string `json:"reason,omitempty"`
+
+	// Error is the error occurred while handling the request.
+	Error string `json:"error,omitempty"`
+
+	// IdentityError is the reason why the caller identity is not verified.
+	// The request continues without the identity unless it is required.
+	IdentityError string `json:"identity_error,omitempty"`
+
+	// LatencyMillis is the time for handling the request in milliseconds.
+	LatencyMillis float64 `json:"latency_ms"`
+}
+
+// AuditCaller is the identity of the caller.
+type AuditCaller struct {
+	ARN          string `json:"arn,omitempty"`
+	Account      string `json:"account,omitempty"`
+	InstanceID   string `json:"instance_id,omitempty"`
+	Hostname     string `json:"hostname,omitempty"`
+	TaskARN      string `json:"task_arn,omitempty"`
+	Cluster      string `json:"cluster,omitempty"`
+	PodName      string `json:"pod_name,omitempty"`
+	PodNamespace string `json:"pod_namespace,omitempty"`
+}
+
+func newAuditCaller(rc *RequestContext) AuditCaller {
+	return AuditCaller{
+		ARN:          rc.Identity.ARN,
+		Account:      rc.Identity.Account,
+		InstanceID:   rc.Instance.InstanceID,
+		Hostname:     rc.Instance.Hostname,
+		TaskARN:      rc.Instance.TaskARN,
+		Cluster:      rc.Instance.Cluster,
+		PodName:      rc.Instance.PodName,
+		PodNamespace: rc.Instance.PodNamespace,
+	}
+}
+
+// AuditSink receives the audit records.
+type AuditSink interface {
+	Audit(ctx context.Context, record *AuditRecord) error
+}
+
+// JSONAuditSink writes the audit records as JSON lines.
+type JSONAuditSink struct {
+	// Writer is the destination of the records.
+	// If nil, os.Stdout is used, and the records are sent to CloudWatch Logs.
+	Writer io.Writer
+
+	mu sync.Mutex
+}
+
+// Audit implements AuditSink.
+func (s *JSONAuditSink) Audit(ctx context.Context, record *AuditRecord) error {
+	data, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+	data = append(data, '\n')
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	w := s.Writer
+	if w == nil {
+		w = os.Stdout
+	}
+	_, err = w.Write(data)
+	return err
+}
+
+var defaultAuditSink = &JSONAuditSink{}
+
+func (l *Lambda) audit() AuditSink {
+	if l.Audit != nil {
+		return l.Audit
+	}
+	return defaultAuditSink
+}
+
+var (
+	numericSegment = regexp.MustCompile(`^[0-9]+$`)
+	uuidSegment    = regexp.MustCompile(`^[0-9a-fA-F]{8}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{12}$`)
+	hexSegment     = regexp.MustCompile(`^[0-9a-fA-F]{16,}$`)
+)
+
+// pathTemplate replaces the segments that look like IDs with "{id}".
+func pathTemplate(path string) string {
+	segments := strings.Split(path, "/")
+	for i, s := range segments {
+		if numericSegment.MatchString(s) || uuidSegment.MatchString(s) || hexSegment.MatchString(s) {
+			segments[i] = "{id}"
+		}
+	}
+	return strings.Join(segments, "/")
+}
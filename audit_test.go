@@ -0,0 +1,139 @@
+package proxy
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/aws/aws-lambda-go/lambdacontext"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/ssm"
+	"github.com/google/go-cmp/cmp"
+)
+
+type auditMock struct {
+	records []*AuditRecord
+}
+
+func (m *auditMock) Audit(ctx context.Context, record *AuditRecord) error {
+	m.records = append(m.records, record)
+	return nil
+}
+
+func TestPathTemplate(t *testing.T) {
+	tests := []struct {
+		input string
+		want  string
+	}{
+		{"/repos/foo/bar/issues/1234", "/repos/foo/bar/issues/{id}"},
+		{"/v1/customers/123e4567-e89b-12d3-a456-426614174000", "/v1/customers/{id}"},
+		{"/commits/da39a3ee5e6b4b0d3255bfef95601890afd80709/status", "/commits/{id}/status"},
+		{"/", "/"},
+	}
+	for _, tt := range tests {
+		if got := pathTemplate(tt.input); got != tt.want {
+			t.Errorf("%s: want %s, got %s", tt.input, tt.want, got)
+		}
+	}
+}
+
+func TestJSONAuditSink(t *testing.T) {
+	var buf bytes.Buffer
+	s := &JSONAuditSink{Writer: &buf}
+	if err := s.Audit(context.Background(), &AuditRecord{Host: "example.com", Status: 200}); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasSuffix(buf.String(), "\n") {
+		t.Errorf("want a JSON line, got %q", buf.String())
+	}
+	var record AuditRecord
+	if err := json.Unmarshal(buf.Bytes(), &record); err != nil {
+		t.Fatal(err)
+	}
+	if record.Host != "example.com" {
+		t.Errorf("want %s, got %s", "example.com", record.Host)
+	}
+}
+
+func TestLambdaAudit(t *testing.T) {
+	ts := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.WriteHeader(http.StatusCreated)
+		fmt.Fprint(w, "ok")
+	}))
+	defer ts.Close()
+
+	u, err := url.Parse(ts.URL)
+	if err != nil {
+		panic(err)
+	}
+	mock := &ssmMock{
+		output: &ssm.GetParametersByPathOutput{
+			Parameters: []ssm.Parameter{
+				{
+					Name:  aws.String("/development/" + u.Host + "/headers/Authorization"),
+					Value: aws.String("token very-secret"),
+				},
+				{
+					Name:  aws.String("/development/" + u.Host + "/queries/apikey"),
+					Value: aws.String("very-secret"),
+				},
+			},
+		},
+	}
+	audit := &auditMock{}
+	l := &Lambda{
+		Prefix: "development",
+		Client: ts.Client(),
+		Audit:  audit,
+		svcssm: mock,
+	}
+
+	req := httptest.NewRequest(http.MethodPost, ts.URL+"/repos/foo/bar/issues/1234?q=1", strings.NewReader("{}"))
+	r, err := NewRequest(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r.RequestContext.Instance.Hostname = "test-host"
+	ctx := lambdacontext.NewContext(context.Background(), &lambdacontext.LambdaContext{
+		AwsRequestID: "c6af9ac6-7b61-11e6-9a41-93e8deadbeef",
+	})
+	if _, err := l.Handle(ctx, r); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(audit.records) != 1 {
+		t.Fatalf("want %d, got %d", 1, len(audit.records))
+	}
+	record := audit.records[0]
+	want := &AuditRecord{
+		Time:      record.Time,
+		RequestID: "c6af9ac6-7b61-11e6-9a41-93e8deadbeef",
+		Caller: AuditCaller{
+			Hostname: "test-host",
+		},
+		Host:           u.Host,
+		Method:         http.MethodPost,
+		Path:           "/repos/foo/bar/issues/{id}",
+		Parameters:     []string{"headers/Authorization", "queries/apikey"},
+		Status:         http.StatusCreated,
+		UpstreamStatus: http.StatusCreated,
+		LatencyMillis:  record.LatencyMillis,
+	}
+	if diff := cmp.Diff(record, want); diff != "" {
+		t.Errorf("AuditRecord differs: (-got +want)\n%s", diff)
+	}
+
+	data, err := json.Marshal(record)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(string(data), "very-secret") {
+		t.Errorf("the audit record contains the secret: %s", string(data))
+	}
+}
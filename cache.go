@@ -0,0 +1,383 @@
+package proxy
+
+import (
+	"container/list"
+	"time"
+)
+
+const (
+	// defaultCacheTTL is the default duration for caching parameters.
+	defaultCacheTTL = 5 * time.Minute
+
+	// defaultCacheMaxStale is the default maximum duration for serving expired entries.
+	defaultCacheMaxStale = time.Hour
+
+	// defaultCacheSize is the default maximum number of hosts in the cache.
+	defaultCacheSize = 1024
+
+	// defaultNegativeCacheTTL is the default duration for caching unknown hosts.
+	defaultNegativeCacheTTL = time.Minute
+
+	// defaultNegativeCacheSize is the default maximum number of unknown hosts in the cache.
+	defaultNegativeCacheSize = 1024
+)
+
+// CacheStats is the statistics of the parameter cache.
+type CacheStats struct {
+	// Entries is the number of hosts in the cache.
+	Entries int
+
+	// Expirations is the number of lookups that found the entry expired.
+	Expirations int64
+
+	// Evictions is the number of entries removed because the cache is full.
+	Evictions int64
+
+	// OldestEntryAge is the age of the oldest entry in the cache.
+	OldestEntryAge time.Duration
+
+	// MeanEntryAge is the mean age of the entries in the cache.
+	MeanEntryAge time.Duration
+
+	// StaleHits is the number of lookups served from the expired entries because refreshing failed.
+	StaleHits int64
+
+	// Refreshes is the number of lookups that found the entry approaching the expiry, and refreshed it in background.
+	Refreshes int64
+
+	// Hits is the number of lookups served from the cache.
+	Hits int64
+
+	// Misses is the number of lookups that fetched the parameters from the parameter store.
+	Misses int64
+
+	// NegativeHits is the number of lookups for unknown hosts served from the negative cache.
+	NegativeHits int64
+
+	// NegativeMisses is the number of lookups for unknown hosts that reached the parameter store.
+	NegativeMisses int64
+
+	// NegativeEntries is the number of unknown hosts in the negative cache.
+	NegativeEntries int
+}
+
+// parameterCache is the LRU cache of the parameters.
+// It is not safe for concurrent use.
+type parameterCache struct {
+	ll    *list.List // the front is the most recently used entry.
+	items map[string]*list.Element
+}
+
+type parameterEntry struct {
+	host    string
+	param   *Parameter
+	fetched time.Time
+	refresh time.Time // the entry is refreshed in background after it.
+	expires time.Time // zero means that the entry never expires.
+}
+
+func (e *parameterEntry) expired(now time.Time) bool {
+	return !e.expires.IsZero() && now.After(e.expires)
+}
+
+func (e *parameterEntry) shouldRefresh(now time.Time) bool {
+	return !e.refresh.IsZero() && now.After(e.refresh)
+}
+
+// get returns the entry of the host.
+func (c *parameterCache) get(host string) (*parameterEntry, bool) {
+	if c.items == nil {
+		return nil, false
+	}
+	elem, ok := c.items[host]
+	if !ok {
+		return nil, false
+	}
+	c.ll.MoveToFront(elem)
+	return elem.Value.(*parameterEntry), true
+}
+
+// add adds the entry, and returns the number of entries evicted because the cache exceeds the size.
+func (c *parameterCache) add(entry *parameterEntry, size int) int {
+	if c.items == nil {
+		c.ll = list.New()
+		c.items = make(map[string]*list.Element)
+	}
+	if elem, ok := c.items[entry.host]; ok {
+		elem.Value = entry
+		c.ll.MoveToFront(elem)
+		return 0
+	}
+	c.items[entry.host] = c.ll.PushFront(entry)
+	evicted := 0
+	for c.ll.Len() > size {
+		elem := c.ll.Back()
+		c.ll.Remove(elem)
+		delete(c.items, elem.Value.(*parameterEntry).host)
+		evicted++
+	}
+	return evicted
+}
+
+// remove removes the entry of the host.
+func (c *parameterCache) remove(host string) {
+	if elem, ok := c.items[host]; ok {
+		c.ll.Remove(elem)
+		delete(c.items, host)
+	}
+}
+
+func (c *parameterCache) len() int {
+	return len(c.items)
+}
+
+// ages returns the oldest and the mean age of the entries.
+func (c *parameterCache) ages(now time.Time) (oldest, mean time.Duration) {
+	if len(c.items) == 0 {
+		return 0, 0
+	}
+	var sum time.Duration
+	for _, elem := range c.items {
+		age := now.Sub(elem.Value.(*parameterEntry).fetched)
+		if age > oldest {
+			oldest = age
+		}
+		sum += age
+	}
+	return oldest, sum / time.Duration(len(c.items))
+}
+
+// negativeCache remembers the hosts which have no parameters.
+// It is not safe for concurrent use.
+type negativeCache struct {
+	ll    *list.List // the front is the newest entry.
+	items map[string]*list.Element
+}
+
+type negativeEntry struct {
+	host    string
+	expires time.Time
+}
+
+// get reports whether the host is known to have no parameters.
+func (c *negativeCache) get(host string, now time.Time) bool {
+	if c.items == nil {
+		return false
+	}
+	elem, ok := c.items[host]
+	if !ok {
+		return false
+	}
+	if now.After(elem.Value.(*negativeEntry).expires) {
+		c.ll.Remove(elem)
+		delete(c.items, host)
+		return false
+	}
+	return true
+}
+
+// add adds the host, and evicts the oldest entries if the cache exceeds the size.
+func (c *negativeCache) add(host string, expires time.Time, size int) {
+	if c.items == nil {
+		c.ll = list.New()
+		c.items = make(map[string]*list.Element)
+	}
+	if elem, ok := c.items[host]; ok {
+		elem.Value.(*negativeEntry).expires = expires
+		c.ll.MoveToFront(elem)
+		return
+	}
+	c.items[host] = c.ll.PushFront(&negativeEntry{
+		host:    host,
+		expires: expires,
+	})
+	for c.ll.Len() > size {
+		elem := c.ll.Back()
+		c.ll.Remove(elem)
+		delete(c.items, elem.Value.(*negativeEntry).host)
+	}
+}
+
+// remove removes the host.
+func (c *negativeCache) remove(host string) {
+	if elem, ok := c.items[host]; ok {
+		c.ll.Remove(elem)
+		delete(c.items, host)
+	}
+}
+
+func (c *negativeCache) len() int {
+	return len(c.items)
+}
+
+func (l *Lambda) cacheTTL() time.Duration {
+	if l.CacheTTL != 0 {
+		return l.CacheTTL
+	}
+	return defaultCacheTTL
+}
+
+func (l *Lambda) cacheSize() int {
+	if l.CacheSize > 0 {
+		return l.CacheSize
+	}
+	return defaultCacheSize
+}
+
+func (l *Lambda) cacheRefreshWindow(ttl time.Duration) time.Duration {
+	if l.CacheRefreshWindow > 0 && l.CacheRefreshWindow < ttl {
+		return l.CacheRefreshWindow
+	}
+	return ttl / 5
+}
+
+func (l *Lambda) cacheMaxStale() time.Duration {
+	if l.CacheMaxStale != 0 {
+		return l.CacheMaxStale
+	}
+	return defaultCacheMaxStale
+}
+
+// getCache returns the entry of the host from the cache.
+// The entry may be expired, and it is removed if it is too stale to use.
+func (l *Lambda) getCache(host string, now time.Time) (*parameterEntry, bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	entry, ok := l.cache.get(host)
+	if !ok {
+		return nil, false
+	}
+	if entry.expired(now) {
+		l.stats.Expirations++
+		if maxStale := l.cacheMaxStale(); maxStale < 0 || now.After(entry.expires.Add(maxStale)) {
+			l.cache.remove(host)
+			return nil, false
+		}
+		return entry, true
+	}
+	l.stats.Hits++
+	if entry.shouldRefresh(now) {
+		l.stats.Refreshes++
+	}
+	return entry, true
+}
+
+// useStale reports whether the expired entry can be used because refreshing failed.
+func (l *Lambda) useStale(entry *parameterEntry, now time.Time) bool {
+	maxStale := l.cacheMaxStale()
+	if maxStale < 0 || now.After(entry.expires.Add(maxStale)) {
+		return false
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.stats.StaleHits++
+	return true
+}
+
+// setCache adds the parameter of the host to the cache.
+func (l *Lambda) setCache(host string, param *Parameter) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	now := time.Now()
+	entry := &parameterEntry{
+		host:    host,
+		param:   param,
+		fetched: now,
+	}
+	ttl := l.cacheTTL()
+	if param.CacheTTL != 0 {
+		ttl = param.CacheTTL
+	}
+	if ttl > 0 {
+		entry.expires = now.Add(ttl)
+		entry.refresh = entry.expires.Add(-l.cacheRefreshWindow(ttl))
+	}
+	l.stats.Misses++
+	l.stats.Evictions += int64(l.cache.add(entry, l.cacheSize()))
+}
+
+// peekCache returns the cached parameter of the host, even if it is expired.
+func (l *Lambda) peekCache(host string) *Parameter {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if elem, ok := l.cache.items[host]; ok {
+		return elem.Value.(*parameterEntry).param
+	}
+	return nil
+}
+
+// swapSigner records the parameter of the host, and returns the previous one.
+// Unlike the cache, the previous one is kept after the cache is evicted or purged.
+func (l *Lambda) swapSigner(host string, param *Parameter) *Parameter {
+	l.signersMu.Lock()
+	defer l.signersMu.Unlock()
+	if l.signers == nil {
+		l.signers = map[string]*Parameter{}
+	}
+	old := l.signers[host]
+	l.signers[host] = param
+	return old
+}
+
+// removeSigner removes the host which no longer has the parameters.
+func (l *Lambda) removeSigner(host string) {
+	l.signersMu.Lock()
+	defer l.signersMu.Unlock()
+	delete(l.signers, host)
+}
+
+// removeCache removes the host from the cache.
+func (l *Lambda) removeCache(host string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.cache.remove(host)
+}
+
+func (l *Lambda) negativeCacheTTL() time.Duration {
+	if l.NegativeCacheTTL != 0 {
+		return l.NegativeCacheTTL
+	}
+	return defaultNegativeCacheTTL
+}
+
+func (l *Lambda) negativeCacheSize() int {
+	if l.NegativeCacheSize > 0 {
+		return l.NegativeCacheSize
+	}
+	return defaultNegativeCacheSize
+}
+
+// isUnknownHost reports whether the host is in the negative cache.
+func (l *Lambda) isUnknownHost(host string) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if !l.negative.get(host, time.Now()) {
+		return false
+	}
+	l.stats.NegativeHits++
+	return true
+}
+
+// addUnknownHost adds the host to the negative cache.
+func (l *Lambda) addUnknownHost(host string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.stats.NegativeMisses++
+	ttl := l.negativeCacheTTL()
+	if ttl < 0 {
+		// the negative cache is disabled.
+		return
+	}
+	l.negative.add(host, time.Now().Add(ttl), l.negativeCacheSize())
+}
+
+// CacheStats returns the statistics of the parameter cache.
+func (l *Lambda) CacheStats() CacheStats {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	stats := l.stats
+	stats.Entries = l.cache.len()
+	stats.OldestEntryAge, stats.MeanEntryAge = l.cache.ages(time.Now())
+	stats.NegativeEntries = l.negative.len()
+	return stats
+}
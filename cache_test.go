@@ -0,0 +1,299 @@
+package proxy
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/aws/awserr"
+	"github.com/aws/aws-sdk-go-v2/service/ssm"
+)
+
+func TestNegativeCache(t *testing.T) {
+	var c negativeCache
+	now := time.Now()
+	c.add("a.example.com", now.Add(time.Minute), 2)
+	c.add("b.example.com", now.Add(time.Second), 2)
+	if !c.get("a.example.com", now) {
+		t.Error("want a.example.com in the cache")
+	}
+	if c.get("b.example.com", now.Add(2*time.Second)) {
+		t.Error("b.example.com should be expired")
+	}
+
+	c.add("c.example.com", now.Add(time.Minute), 2)
+	c.add("d.example.com", now.Add(time.Minute), 2)
+	if c.get("a.example.com", now) {
+		t.Error("a.example.com should be evicted")
+	}
+	if c.len() != 2 {
+		t.Errorf("want %d, got %d", 2, c.len())
+	}
+}
+
+func TestLambdaNegativeCache(t *testing.T) {
+	t.Run("enabled", func(t *testing.T) {
+		mock := &ssmMock{
+			output: &ssm.GetParametersByPathOutput{
+				Parameters: []ssm.Parameter{},
+			},
+		}
+		l := &Lambda{
+			Prefix: "development",
+			svcssm: mock,
+		}
+		for i := 0; i < 3; i++ {
+			if _, err := l.getParam(context.Background(), "Unknown.Example.com"); err != ErrParamNotFound {
+				t.Errorf("want ErrParamNotFound, got %v", err)
+			}
+		}
+		if mock.calls != 1 {
+			t.Errorf("want %d, got %d", 1, mock.calls)
+		}
+		stats := l.CacheStats()
+		if stats.NegativeHits != 2 {
+			t.Errorf("want %d, got %d", 2, stats.NegativeHits)
+		}
+		if stats.NegativeMisses != 1 {
+			t.Errorf("want %d, got %d", 1, stats.NegativeMisses)
+		}
+		if stats.NegativeEntries != 1 {
+			t.Errorf("want %d, got %d", 1, stats.NegativeEntries)
+		}
+	})
+
+	t.Run("disabled", func(t *testing.T) {
+		mock := &ssmMock{
+			output: &ssm.GetParametersByPathOutput{
+				Parameters: []ssm.Parameter{},
+			},
+		}
+		l := &Lambda{
+			Prefix:           "development",
+			NegativeCacheTTL: -1,
+			svcssm:           mock,
+		}
+		for i := 0; i < 3; i++ {
+			if _, err := l.getParam(context.Background(), "unknown.example.com"); err != ErrParamNotFound {
+				t.Errorf("want ErrParamNotFound, got %v", err)
+			}
+		}
+		if mock.calls != 3 {
+			t.Errorf("want %d, got %d", 3, mock.calls)
+		}
+	})
+}
+
+func TestParameterCache(t *testing.T) {
+	var c parameterCache
+	now := time.Now()
+	c.add(&parameterEntry{host: "a.example.com", fetched: now.Add(-time.Minute)}, 2)
+	c.add(&parameterEntry{host: "b.example.com", fetched: now, expires: now.Add(time.Second)}, 2)
+	if _, ok := c.get("a.example.com"); !ok {
+		t.Error("want a.example.com in the cache")
+	}
+	entry, ok := c.get("b.example.com")
+	if !ok {
+		t.Fatal("want b.example.com in the cache")
+	}
+	if entry.expired(now) {
+		t.Error("b.example.com should not be expired yet")
+	}
+	if !entry.expired(now.Add(2 * time.Second)) {
+		t.Error("b.example.com should be expired")
+	}
+
+	oldest, mean := c.ages(now)
+	if oldest != time.Minute {
+		t.Errorf("want %s, got %s", time.Minute, oldest)
+	}
+	if mean != 30*time.Second {
+		t.Errorf("want %s, got %s", 30*time.Second, mean)
+	}
+
+	// a.example.com is the least recently used.
+	if n := c.add(&parameterEntry{host: "c.example.com", fetched: now}, 2); n != 1 {
+		t.Errorf("want %d, got %d", 1, n)
+	}
+	if _, ok := c.get("a.example.com"); ok {
+		t.Error("a.example.com should be evicted")
+	}
+	if c.len() != 2 {
+		t.Errorf("want %d, got %d", 2, c.len())
+	}
+}
+
+func TestLambdaCacheTTL(t *testing.T) {
+	newMock := func(params ...ssm.Parameter) *ssmMock {
+		return &ssmMock{
+			output: &ssm.GetParametersByPathOutput{
+				Parameters: append([]ssm.Parameter{
+					{
+						Name:  aws.String("/example.com/headers/Authorization"),
+						Value: aws.String("token very-secret"),
+					},
+				}, params...),
+			},
+		}
+	}
+
+	t.Run("default", func(t *testing.T) {
+		mock := newMock()
+		l := &Lambda{
+			svcssm: mock,
+		}
+		for i := 0; i < 3; i++ {
+			if _, err := l.getParam(context.Background(), "example.com"); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if mock.calls != 1 {
+			t.Errorf("want %d, got %d", 1, mock.calls)
+		}
+		stats := l.CacheStats()
+		if stats.Hits != 2 {
+			t.Errorf("want %d, got %d", 2, stats.Hits)
+		}
+		if stats.Entries != 1 {
+			t.Errorf("want %d, got %d", 1, stats.Entries)
+		}
+	})
+
+	t.Run("expired", func(t *testing.T) {
+		mock := newMock()
+		l := &Lambda{
+			CacheTTL: time.Nanosecond,
+			svcssm:   mock,
+		}
+		for i := 0; i < 3; i++ {
+			if _, err := l.getParam(context.Background(), "example.com"); err != nil {
+				t.Fatal(err)
+			}
+			time.Sleep(time.Millisecond)
+		}
+		if mock.calls != 3 {
+			t.Errorf("want %d, got %d", 3, mock.calls)
+		}
+		if stats := l.CacheStats(); stats.Expirations != 2 {
+			t.Errorf("want %d, got %d", 2, stats.Expirations)
+		}
+	})
+
+	t.Run("override", func(t *testing.T) {
+		mock := newMock(ssm.Parameter{
+			Name:  aws.String("/example.com/cache/ttl"),
+			Value: aws.String("1h"),
+		})
+		l := &Lambda{
+			CacheTTL: time.Nanosecond,
+			svcssm:   mock,
+		}
+		for i := 0; i < 3; i++ {
+			if _, err := l.getParam(context.Background(), "example.com"); err != nil {
+				t.Fatal(err)
+			}
+			time.Sleep(time.Millisecond)
+		}
+		if mock.calls != 1 {
+			t.Errorf("want %d, got %d", 1, mock.calls)
+		}
+	})
+}
+
+func TestLambdaStaleWhileRevalidate(t *testing.T) {
+	newMock := func(errs ...error) *ssmMock {
+		return &ssmMock{
+			output: &ssm.GetParametersByPathOutput{
+				Parameters: []ssm.Parameter{
+					{
+						Name:  aws.String("/example.com/headers/Authorization"),
+						Value: aws.String("token very-secret"),
+					},
+				},
+			},
+			errs: errs,
+		}
+	}
+
+	t.Run("refresh", func(t *testing.T) {
+		l := &Lambda{
+			CacheTTL:           time.Hour,
+			CacheRefreshWindow: time.Hour - time.Millisecond,
+			svcssm:             newMock(),
+		}
+		if _, err := l.getParam(context.Background(), "example.com"); err != nil {
+			t.Fatal(err)
+		}
+		time.Sleep(2 * time.Millisecond)
+
+		// the entry is approaching the expiry. it is refreshed in background.
+		if _, err := l.getParam(context.Background(), "example.com"); err != nil {
+			t.Fatal(err)
+		}
+		deadline := time.Now().Add(time.Second)
+		for l.CacheStats().Misses < 2 {
+			if time.Now().After(deadline) {
+				t.Fatal("the entry is not refreshed")
+			}
+			time.Sleep(time.Millisecond)
+		}
+		if stats := l.CacheStats(); stats.Refreshes != 1 {
+			t.Errorf("want %d, got %d", 1, stats.Refreshes)
+		}
+	})
+
+	t.Run("stale", func(t *testing.T) {
+		mock := newMock(nil, awserr.New("InternalServerError", "something wrong", nil))
+		l := &Lambda{
+			CacheTTL: time.Nanosecond,
+			svcssm:   mock,
+		}
+		if _, err := l.getParam(context.Background(), "example.com"); err != nil {
+			t.Fatal(err)
+		}
+		time.Sleep(time.Millisecond)
+
+		// refreshing fails, but the stale entry is available.
+		param, err := l.getParam(context.Background(), "example.com")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := param.Headers.Get("Authorization"); got != "token very-secret" {
+			t.Errorf("want %s, got %s", "token very-secret", got)
+		}
+		if stats := l.CacheStats(); stats.StaleHits != 1 {
+			t.Errorf("want %d, got %d", 1, stats.StaleHits)
+		}
+	})
+
+	t.Run("max stale", func(t *testing.T) {
+		mock := newMock(nil, awserr.New("InternalServerError", "something wrong", nil))
+		l := &Lambda{
+			CacheTTL:      time.Nanosecond,
+			CacheMaxStale: -1,
+			svcssm:        mock,
+		}
+		if _, err := l.getParam(context.Background(), "example.com"); err != nil {
+			t.Fatal(err)
+		}
+		time.Sleep(time.Millisecond)
+		if _, err := l.getParam(context.Background(), "example.com"); err == nil {
+			t.Error("want error, got nil")
+		}
+	})
+
+	t.Run("throttling", func(t *testing.T) {
+		throttled := awserr.New("ThrottlingException", "Rate exceeded", nil)
+		mock := newMock(throttled, throttled)
+		l := &Lambda{
+			svcssm: mock,
+		}
+		if _, err := l.getParam(context.Background(), "example.com"); err != nil {
+			t.Fatal(err)
+		}
+		if mock.calls != 3 {
+			t.Errorf("want %d, got %d", 3, mock.calls)
+		}
+	})
+}
@@ -0,0 +1,127 @@
+package proxy
+
+import (
+	"log"
+	"math/rand"
+)
+
+// latestQualifier is the qualifier used when no qualifier is specified.
+const latestQualifier = "$LATEST"
+
+// defaultMinInvocations is the default number of the canary invocations required before evaluating the error rate.
+const defaultMinInvocations = 100
+
+// Canary splits the invocations between the stable qualifier and the canary qualifier.
+type Canary struct {
+	// Qualifier is the alias or the version of the canary.
+	Qualifier string
+
+	// Weight is the ratio of the invocations routed to the canary, between 0 and 1.
+	Weight float64
+
+	// MaxErrorRate is the error rate of the canary that triggers the rollback to the stable qualifier.
+	// Zero disables the automatic rollback.
+	MaxErrorRate float64
+
+	// MinInvocations is the number of the canary invocations required before evaluating the error rate.
+	// The default is 100.
+	MinInvocations int64
+}
+
+func (c *Canary) minInvocations() int64 {
+	if c.MinInvocations > 0 {
+		return c.MinInvocations
+	}
+	return defaultMinInvocations
+}
+
+// InvocationMetrics is the statistics of invocations per qualifier.
+type InvocationMetrics struct {
+	Invocations int64
+	Errors      int64
+}
+
+// ErrorRate returns the ratio of errors to invocations.
+func (m InvocationMetrics) ErrorRate() float64 {
+	if m.Invocations == 0 {
+		return 0
+	}
+	return float64(m.Errors) / float64(m.Invocations)
+}
+
+// Metrics returns the invocation metrics per qualifier.
+func (p *Proxy) Metrics() map[string]InvocationMetrics {
+	p.metricsMu.Lock()
+	defer p.metricsMu.Unlock()
+	ret := make(map[string]InvocationMetrics, len(p.metrics))
+	for k, v := range p.metrics {
+		ret[k] = *v
+	}
+	return ret
+}
+
+// RolledBack reports whether the canary has been rolled back.
+func (p *Proxy) RolledBack() bool {
+	p.metricsMu.Lock()
+	defer p.metricsMu.Unlock()
+	return p.rolledBack
+}
+
+func (p *Proxy) stableQualifier() string {
+	if p.Qualifier != "" {
+		return p.Qualifier
+	}
+	return latestQualifier
+}
+
+// selectQualifier returns the qualifier for the next invocation.
+func (p *Proxy) selectQualifier() string {
+	c := p.Canary
+	if c == nil || c.Qualifier == "" || c.Weight <= 0 {
+		return p.stableQualifier()
+	}
+
+	p.metricsMu.Lock()
+	defer p.metricsMu.Unlock()
+	if p.rolledBack {
+		return p.stableQualifier()
+	}
+	r := p.rand
+	if r == nil {
+		r = rand.Float64
+	}
+	if r() < c.Weight {
+		return c.Qualifier
+	}
+	return p.stableQualifier()
+}
+
+// recordInvocation updates the metrics, and rolls back the canary if its error rate exceeds the threshold.
+func (p *Proxy) recordInvocation(qualifier string, failed bool) {
+	p.metricsMu.Lock()
+	defer p.metricsMu.Unlock()
+	if p.metrics == nil {
+		p.metrics = make(map[string]*InvocationMetrics)
+	}
+	m, ok := p.metrics[qualifier]
+	if !ok {
+		m = &InvocationMetrics{}
+		p.metrics[qualifier] = m
+	}
+	m.Invocations++
+	if failed {
+		m.Errors++
+	}
+
+	c := p.Canary
+	if c == nil || p.rolledBack || qualifier != c.Qualifier || c.MaxErrorRate <= 0 {
+		return
+	}
+	if m.Invocations < c.minInvocations() {
+		return
+	}
+	if rate := m.ErrorRate(); rate > c.MaxErrorRate {
+		p.rolledBack = true
+		log.Printf("canary %s is rolled back to %s: error rate %.3f exceeds %.3f", c.Qualifier, p.stableQualifier(), rate, c.MaxErrorRate)
+	}
+}
@@ -0,0 +1,145 @@
+package proxy
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/lambda"
+)
+
+func TestProxyQualifier(t *testing.T) {
+	l := &lambdaMock{}
+	p := &Proxy{
+		FunctionName: "proxy-test",
+		Metadata:     testMetadata,
+		Qualifier:    "stable",
+		scvlambda:    l,
+	}
+	httpreq := httptest.NewRequest(http.MethodGet, "https://example.com/", nil)
+	rec := httptest.NewRecorder()
+	p.ServeHTTP(rec, httpreq)
+
+	if aws.StringValue(l.input.Qualifier) != "stable" {
+		t.Errorf("want %s, got %s", "stable", aws.StringValue(l.input.Qualifier))
+	}
+	if m := p.Metrics()["stable"]; m.Invocations != 1 || m.Errors != 0 {
+		t.Errorf("unexpected metrics: %#v", m)
+	}
+}
+
+func TestProxyCanary(t *testing.T) {
+	t.Run("split", func(t *testing.T) {
+		l := &lambdaMock{}
+		values := []float64{0.05, 0.5, 0.09, 0.95}
+		p := &Proxy{
+			FunctionName: "proxy-test",
+			Metadata:     testMetadata,
+			Qualifier:    "stable",
+			Canary: &Canary{
+				Qualifier: "canary",
+				Weight:    0.1,
+			},
+			scvlambda: l,
+			rand: func() float64 {
+				v := values[0]
+				values = values[1:]
+				return v
+			},
+		}
+		want := []string{"canary", "stable", "canary", "stable"}
+		for _, w := range want {
+			httpreq := httptest.NewRequest(http.MethodGet, "https://example.com/", nil)
+			rec := httptest.NewRecorder()
+			p.ServeHTTP(rec, httpreq)
+			if aws.StringValue(l.input.Qualifier) != w {
+				t.Errorf("want %s, got %s", w, aws.StringValue(l.input.Qualifier))
+			}
+		}
+
+		metrics := p.Metrics()
+		if metrics["stable"].Invocations != 2 {
+			t.Errorf("want %d, got %d", 2, metrics["stable"].Invocations)
+		}
+		if metrics["canary"].Invocations != 2 {
+			t.Errorf("want %d, got %d", 2, metrics["canary"].Invocations)
+		}
+	})
+
+	t.Run("rollback", func(t *testing.T) {
+		l := &lambdaMock{
+			invoke: func(input *lambda.InvokeInput) *lambda.InvokeOutput {
+				if aws.StringValue(input.Qualifier) == "canary" {
+					return &lambda.InvokeOutput{
+						FunctionError: aws.String("Unhandled"),
+						Payload:       []byte(`{"errorMessage":"broken","errorType":"errorString"}`),
+					}
+				}
+				return &lambda.InvokeOutput{
+					Payload: []byte(`{"statusCode":200,"body":"ok"}`),
+				}
+			},
+		}
+		p := &Proxy{
+			FunctionName: "proxy-test",
+			Metadata:     testMetadata,
+			Canary: &Canary{
+				Qualifier:      "canary",
+				Weight:         1,
+				MaxErrorRate:   0.5,
+				MinInvocations: 3,
+			},
+			scvlambda: l,
+			rand:      func() float64 { return 0 },
+		}
+		for i := 0; i < 3; i++ {
+			httpreq := httptest.NewRequest(http.MethodGet, "https://example.com/", nil)
+			rec := httptest.NewRecorder()
+			p.ServeHTTP(rec, httpreq)
+			if rec.Code != http.StatusBadGateway {
+				t.Errorf("want %d, got %d", http.StatusBadGateway, rec.Code)
+			}
+		}
+		if !p.RolledBack() {
+			t.Fatal("want rolled back, but not")
+		}
+
+		httpreq := httptest.NewRequest(http.MethodGet, "https://example.com/", nil)
+		rec := httptest.NewRecorder()
+		p.ServeHTTP(rec, httpreq)
+		if l.input.Qualifier != nil {
+			t.Errorf("want $LATEST, got %s", aws.StringValue(l.input.Qualifier))
+		}
+		if rec.Code != http.StatusOK {
+			t.Errorf("want %d, got %d", http.StatusOK, rec.Code)
+		}
+
+		metrics := p.Metrics()
+		if m := metrics["canary"]; m.Invocations != 3 || m.Errors != 3 {
+			t.Errorf("unexpected canary metrics: %#v", m)
+		}
+		if m := metrics["$LATEST"]; m.Invocations != 1 || m.Errors != 0 {
+			t.Errorf("unexpected stable metrics: %#v", m)
+		}
+	})
+	t.Run("default min invocations", func(t *testing.T) {
+		p := &Proxy{
+			Canary: &Canary{
+				Qualifier:    "canary",
+				Weight:       1,
+				MaxErrorRate: 0.5,
+			},
+		}
+		p.recordInvocation("canary", true)
+		if p.RolledBack() {
+			t.Error("one error must not roll back the canary")
+		}
+		for i := int64(1); i < defaultMinInvocations; i++ {
+			p.recordInvocation("canary", true)
+		}
+		if !p.RolledBack() {
+			t.Error("want rolled back, but not")
+		}
+	})
+}
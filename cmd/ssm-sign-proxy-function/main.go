@@ -3,8 +3,12 @@ package main
 import (
 	"log"
 	"os"
+	"strconv"
+	"strings"
+	"time"
 
 	"github.com/aws/aws-lambda-go/lambda"
+	"github.com/aws/aws-sdk-go-v2/aws"
 	"github.com/aws/aws-sdk-go-v2/aws/external"
 	proxy "github.com/shogo82148/ssm-sign-proxy"
 )
@@ -14,10 +18,89 @@ func main() {
 	if err != nil {
 		log.Fatal(err)
 	}
+	prefix := os.Getenv("SSM_SIGN_PROXY_PREFIX")
 	l := &proxy.Lambda{
-		Config: cfg,
-		Prefix: os.Getenv("SSM_SIGN_PROXY_PREFIX"),
+		Config:            cfg,
+		Prefix:            prefix,
+		Source:            getenvSource("SSM_SIGN_PROXY_SOURCES", cfg, prefix),
+		CacheTTL:          getenvDuration("SSM_SIGN_PROXY_CACHE_TTL"),
+		CacheSize:         getenvInt("SSM_SIGN_PROXY_CACHE_SIZE"),
+		CacheMaxStale:     getenvDuration("SSM_SIGN_PROXY_CACHE_MAX_STALE"),
+		SSMTimeout:        getenvDuration("SSM_SIGN_PROXY_SSM_TIMEOUT"),
+		NegativeCacheTTL:  getenvDuration("SSM_SIGN_PROXY_NEGATIVE_CACHE_TTL"),
+		NegativeCacheSize: getenvInt("SSM_SIGN_PROXY_NEGATIVE_CACHE_SIZE"),
+		STSEndpoint:       os.Getenv("SSM_SIGN_PROXY_STS_ENDPOINT"),
+		RequireIdentity:   getenvBool("SSM_SIGN_PROXY_REQUIRE_IDENTITY"),
+
+		GenerationParameter: os.Getenv("SSM_SIGN_PROXY_GENERATION_PARAMETER"),
 	}
 
-	lambda.Start(l.Handle)
+	// l handles both of the requests from the proxy and the change events of the parameters.
+	lambda.StartHandler(l)
+}
+
+// getenvSource returns the source from the comma separated list of "ssm" and "secretsmanager".
+// The default is "ssm".
+func getenvSource(key string, cfg aws.Config, prefix string) proxy.Source {
+	v := os.Getenv(key)
+	if v == "" {
+		return nil
+	}
+	var chain proxy.ChainSource
+	for _, name := range strings.Split(v, ",") {
+		switch strings.TrimSpace(name) {
+		case "ssm":
+			chain = append(chain, &proxy.SSMSource{
+				Config: cfg,
+				Prefix: prefix,
+			})
+		case "secretsmanager":
+			chain = append(chain, &proxy.SecretsManagerSource{
+				Config: cfg,
+				Prefix: prefix,
+			})
+		default:
+			log.Fatalf("invalid %s: unknown source %q", key, name)
+		}
+	}
+	if len(chain) == 1 {
+		return chain[0]
+	}
+	return chain
+}
+
+func getenvDuration(key string) time.Duration {
+	v := os.Getenv(key)
+	if v == "" {
+		return 0
+	}
+	d, err := time.ParseDuration(v)
+	if err != nil {
+		log.Fatalf("invalid %s: %v", key, err)
+	}
+	return d
+}
+
+func getenvInt(key string) int {
+	v := os.Getenv(key)
+	if v == "" {
+		return 0
+	}
+	i, err := strconv.Atoi(v)
+	if err != nil {
+		log.Fatalf("invalid %s: %v", key, err)
+	}
+	return i
+}
+
+func getenvBool(key string) bool {
+	v := os.Getenv(key)
+	if v == "" {
+		return false
+	}
+	b, err := strconv.ParseBool(v)
+	if err != nil {
+		log.Fatalf("invalid %s: %v", key, err)
+	}
+	return b
 }
@@ -2,21 +2,67 @@ package main
 
 import (
 	"flag"
+	"fmt"
 	"log"
 	"net/http"
+	"os"
+	"strings"
+	"time"
 
 	"github.com/aws/aws-sdk-go-v2/aws/external"
 	proxy "github.com/shogo82148/ssm-sign-proxy"
 )
 
 var functionName, address string
+var qualifier string
+var canary proxy.Canary
+var passThrough bool
+var passThroughTTL time.Duration
+var disableIMDS bool
+var metadataRefreshInterval time.Duration
+var tags = tagsFlag{}
+
+// tagsFlag is a flag.Value for key=value pairs.
+type tagsFlag map[string]string
+
+func (f tagsFlag) String() string {
+	pairs := make([]string, 0, len(f))
+	for k, v := range f {
+		pairs = append(pairs, k+"="+v)
+	}
+	return strings.Join(pairs, ",")
+}
+
+func (f tagsFlag) Set(s string) error {
+	idx := strings.IndexByte(s, '=')
+	if idx < 0 {
+		return fmt.Errorf("invalid tag %q: key=value is expected", s)
+	}
+	f[s[:idx]] = s[idx+1:]
+	return nil
+}
 
 func init() {
 	flag.StringVar(&functionName, "function-name", "", "aws lambda function name")
 	flag.StringVar(&address, "address", "localhost:8000", "address for listening")
+	flag.StringVar(&qualifier, "qualifier", "", "alias or version of the function")
+	flag.StringVar(&canary.Qualifier, "canary-qualifier", "", "alias or version of the canary function")
+	flag.Float64Var(&canary.Weight, "canary-weight", 0, "ratio of the invocations routed to the canary, between 0 and 1")
+	flag.Float64Var(&canary.MaxErrorRate, "canary-max-error-rate", 0, "error rate of the canary that triggers the rollback")
+	flag.Int64Var(&canary.MinInvocations, "canary-min-invocations", 100, "number of the canary invocations required before evaluating the error rate")
+	flag.BoolVar(&passThrough, "pass-through", false, "forward requests to hosts without parameters directly")
+	flag.DurationVar(&passThroughTTL, "pass-through-ttl", 5*time.Minute, "duration for remembering hosts without parameters")
+	flag.BoolVar(&disableIMDS, "disable-imds", false, "disable EC2 instance metadata service")
+	flag.DurationVar(&metadataRefreshInterval, "metadata-refresh-interval", 10*time.Minute, "interval for refreshing the instance metadata")
+	flag.Var(tags, "tag", "key=value tag sent to the function. can be repeated")
 }
 
 func main() {
+	if len(os.Args) > 1 && os.Args[1] == "oauth" {
+		oauthMain(os.Args[2:])
+		return
+	}
+
 	flag.Parse()
 	if functionName == "" {
 		log.Fatal("-function-name is missing")
@@ -27,8 +73,19 @@ func main() {
 		log.Fatal(err)
 	}
 	p := &proxy.Proxy{
-		Config:       cfg,
-		FunctionName: functionName,
+		Config:         cfg,
+		FunctionName:   functionName,
+		Qualifier:      qualifier,
+		PassThrough:    passThrough,
+		PassThroughTTL: passThroughTTL,
+		Metadata: &proxy.Metadata{
+			DisableIMDS: disableIMDS,
+			Tags:        tags,
+		},
+		MetadataRefreshInterval: metadataRefreshInterval,
+	}
+	if canary.Qualifier != "" {
+		p.Canary = &canary
 	}
 
 	http.ListenAndServe(address, p)
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"log"
+	"net/url"
+	"os"
+	"os/exec"
+	"runtime"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws/external"
+	proxy "github.com/shogo82148/ssm-sign-proxy"
+)
+
+// oauthMain runs the subcommand "oauth".
+func oauthMain(args []string) {
+	if len(args) == 0 || args[0] != "login" {
+		log.Fatal("usage: ssm-sign-proxy oauth login [flags]")
+	}
+
+	var login proxy.OAuthLogin
+	var scopes, params string
+	var timeout time.Duration
+	fs := flag.NewFlagSet("oauth login", flag.ExitOnError)
+	fs.StringVar(&login.Prefix, "prefix", "", "prefix of the parameters")
+	fs.StringVar(&login.Host, "host", "", "host of the api")
+	fs.StringVar(&login.AuthURL, "auth-url", "", "authorization endpoint")
+	fs.StringVar(&login.TokenURL, "token-url", "", "token endpoint")
+	fs.StringVar(&login.ClientID, "client-id", "", "client id")
+	fs.StringVar(&login.ClientSecret, "client-secret", "", "client secret")
+	fs.StringVar(&scopes, "scopes", "", "comma separated scopes")
+	fs.StringVar(&login.AuthStyle, "auth-style", "", "how the client authenticates: header or params")
+	fs.StringVar(&params, "auth-params", "", "additional parameters of the authorization request, e.g. access_type=offline")
+	fs.StringVar(&login.RedirectAddress, "redirect-address", "127.0.0.1:0", "loopback address for receiving the redirect")
+	fs.DurationVar(&timeout, "timeout", 5*time.Minute, "timeout for the authorization")
+	fs.Parse(args[1:])
+
+	if scopes != "" {
+		login.Scopes = strings.Split(scopes, ",")
+	}
+	if params != "" {
+		v, err := url.ParseQuery(params)
+		if err != nil {
+			log.Fatal(err)
+		}
+		login.AuthParams = v
+	}
+
+	cfg, err := external.LoadDefaultAWSConfig()
+	if err != nil {
+		log.Fatal(err)
+	}
+	login.Config = cfg
+	login.OpenURL = openURL
+
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	if err := login.Run(ctx); err != nil {
+		log.Fatal(err)
+	}
+	fmt.Fprintf(os.Stderr, "the refresh token of %s is stored\n", login.Host)
+}
+
+// openURL opens the URL in the browser.
+// The URL is also printed, because the browser may not be available.
+func openURL(u string) error {
+	fmt.Fprintf(os.Stderr, "open the following URL in your browser:\n\n%s\n\n", u)
+	var cmd *exec.Cmd
+	switch runtime.GOOS {
+	case "darwin":
+		cmd = exec.Command("open", u)
+	case "windows":
+		cmd = exec.Command("rundll32", "url.dll,FileProtocolHandler", u)
+	default:
+		cmd = exec.Command("xdg-open", u)
+	}
+	// ignore the error, the user can open the URL manually.
+	cmd.Start()
+	return nil
+}
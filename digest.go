@@ -0,0 +1,325 @@
+package proxy
+
+import (
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Digest is the parameter for HTTP Digest Access Authentication (RFC 7616).
+// The function learns the challenge from the 401 response, and sends the credentials from the next request.
+type Digest struct {
+	User     string
+	Password string
+
+	state *digestState
+}
+
+// digestState is the challenge of the server, which is shared among the requests.
+type digestState struct {
+	mu        sync.Mutex
+	challenge *digestChallenge
+
+	// nc is the count of the requests with the nonce.
+	nc int
+}
+
+// digestChallenge is the Digest challenge in the WWW-Authenticate header.
+type digestChallenge struct {
+	Realm     string
+	Nonce     string
+	Opaque    string
+	Algorithm string
+	QOP       []string
+	Stale     bool
+	UserHash  bool
+}
+
+// set sets the parameter digest/{name}.
+func (d *Digest) set(name, value string) {
+	switch name {
+	case "username":
+		d.User = value
+	case "password":
+		d.Password = value
+	}
+}
+
+// init sets up the state. It takes over the challenge from old if it has the same credentials.
+func (d *Digest) init(old *Digest) {
+	if old != nil && old.state != nil && d.User == old.User && d.Password == old.Password {
+		d.state = old.state
+		return
+	}
+	d.state = &digestState{}
+}
+
+// Sign sets the credentials to the Authorization header if the challenge is known.
+func (d *Digest) Sign(req *http.Request) error {
+	if d.User == "" {
+		return errors.New("proxy: digest/username is required")
+	}
+	if d.state == nil {
+		return errors.New("proxy: the state for digest is not configured")
+	}
+
+	d.state.mu.Lock()
+	c := d.state.challenge
+	d.state.nc++
+	nc := d.state.nc
+	d.state.mu.Unlock()
+	if c == nil {
+		// the first request gets the challenge.
+		return nil
+	}
+
+	auth, err := d.authorization(req, c, nc)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", auth)
+	return nil
+}
+
+// update updates the challenge from the 401 response.
+// It reports whether the request should be retried with the new challenge.
+func (d *Digest) update(h http.Header) bool {
+	if d.state == nil {
+		return false
+	}
+	c := selectDigestChallenge(parseChallenges(h["Www-Authenticate"]))
+	if c == nil {
+		return false
+	}
+
+	d.state.mu.Lock()
+	defer d.state.mu.Unlock()
+	old := d.state.challenge
+	d.state.challenge = c
+	if old != nil && old.Nonce == c.Nonce && !c.Stale {
+		// the credentials are rejected. retrying doesn't help.
+		return false
+	}
+	d.state.nc = 0
+	return true
+}
+
+func (d *Digest) authorization(req *http.Request, c *digestChallenge, nc int) (string, error) {
+	newHash, sess, err := digestAlgorithm(c.Algorithm)
+	if err != nil {
+		return "", err
+	}
+	h := func(s string) string {
+		hash := newHash()
+		hash.Write([]byte(s))
+		return hex.EncodeToString(hash.Sum(nil))
+	}
+
+	cnonce, err := newNonce()
+	if err != nil {
+		return "", err
+	}
+	ha1 := h(d.User + ":" + c.Realm + ":" + d.Password)
+	if sess {
+		ha1 = h(ha1 + ":" + c.Nonce + ":" + cnonce)
+	}
+
+	uri := req.URL.RequestURI()
+	qop := selectQOP(c.QOP)
+	ha2 := h(req.Method + ":" + uri)
+	if qop == "auth-int" {
+		body, err := bufferBody(req)
+		if err != nil {
+			return "", err
+		}
+		ha2 = h(req.Method + ":" + uri + ":" + h(string(body)))
+	}
+
+	ncValue := fmt.Sprintf("%08x", nc)
+	var response string
+	if qop == "" {
+		// RFC 2069 compatibility.
+		response = h(ha1 + ":" + c.Nonce + ":" + ha2)
+	} else {
+		response = h(ha1 + ":" + c.Nonce + ":" + ncValue + ":" + cnonce + ":" + qop + ":" + ha2)
+	}
+
+	user := d.User
+	if c.UserHash {
+		user = h(d.User + ":" + c.Realm)
+	}
+	params := []string{
+		"username=" + strconv.Quote(user),
+		"realm=" + strconv.Quote(c.Realm),
+		"uri=" + strconv.Quote(uri),
+	}
+	if c.Algorithm != "" {
+		params = append(params, "algorithm="+c.Algorithm)
+	}
+	params = append(params, "nonce="+strconv.Quote(c.Nonce))
+	if qop != "" {
+		params = append(params, "nc="+ncValue, "cnonce="+strconv.Quote(cnonce), "qop="+qop)
+	}
+	params = append(params, "response="+strconv.Quote(response))
+	if c.Opaque != "" {
+		params = append(params, "opaque="+strconv.Quote(c.Opaque))
+	}
+	if c.UserHash {
+		params = append(params, "userhash=true")
+	}
+	return "Digest " + strings.Join(params, ", "), nil
+}
+
+// digestAlgorithm returns the hash function of the algorithm, and whether it is the session variant.
+func digestAlgorithm(alg string) (func() hash.Hash, bool, error) {
+	switch strings.ToUpper(alg) {
+	case "", "MD5":
+		return md5.New, false, nil
+	case "MD5-SESS":
+		return md5.New, true, nil
+	case "SHA-256":
+		return sha256.New, false, nil
+	case "SHA-256-SESS":
+		return sha256.New, true, nil
+	}
+	return nil, false, fmt.Errorf("proxy: unsupported digest algorithm %q", alg)
+}
+
+// selectDigestChallenge returns the challenge with the strongest algorithm.
+func selectDigestChallenge(challenges []*authChallenge) *digestChallenge {
+	var ret *digestChallenge
+	best := -1
+	for _, ch := range challenges {
+		if !strings.EqualFold(ch.Scheme, "Digest") {
+			continue
+		}
+		c := &digestChallenge{
+			Realm:     ch.Params["realm"],
+			Nonce:     ch.Params["nonce"],
+			Opaque:    ch.Params["opaque"],
+			Algorithm: ch.Params["algorithm"],
+			Stale:     strings.EqualFold(ch.Params["stale"], "true"),
+			UserHash:  strings.EqualFold(ch.Params["userhash"], "true"),
+		}
+		for _, q := range strings.Split(ch.Params["qop"], ",") {
+			if q = strings.TrimSpace(q); q != "" {
+				c.QOP = append(c.QOP, strings.ToLower(q))
+			}
+		}
+		if c.Nonce == "" {
+			continue
+		}
+		if _, _, err := digestAlgorithm(c.Algorithm); err != nil {
+			continue
+		}
+		rank := 0
+		if strings.HasPrefix(strings.ToUpper(c.Algorithm), "SHA-256") {
+			rank = 1
+		}
+		if rank > best {
+			ret, best = c, rank
+		}
+	}
+	return ret
+}
+
+// selectQOP prefers "auth", because "auth-int" needs the body.
+func selectQOP(qops []string) string {
+	for _, q := range qops {
+		if q == "auth" {
+			return q
+		}
+	}
+	for _, q := range qops {
+		if q == "auth-int" {
+			return q
+		}
+	}
+	return ""
+}
+
+// authChallenge is a challenge in the WWW-Authenticate header.
+type authChallenge struct {
+	Scheme string
+	Params map[string]string
+}
+
+// parseChallenges parses the WWW-Authenticate headers.
+// A header may contain multiple challenges, e.g. `Digest realm="a", nonce="b", Basic realm="a"`.
+func parseChallenges(headers []string) []*authChallenge {
+	var ret []*authChallenge
+	for _, h := range headers {
+		var current *authChallenge
+		s := h
+		for {
+			s = strings.TrimLeft(s, " \t,")
+			if s == "" {
+				break
+			}
+			token, rest := splitToken(s)
+			if token == "" {
+				// skip the invalid character.
+				s = s[1:]
+				continue
+			}
+			rest = strings.TrimLeft(rest, " \t")
+			if strings.HasPrefix(rest, "=") && current != nil {
+				// auth-param
+				value, r := parseParamValue(strings.TrimLeft(rest[1:], " \t"))
+				current.Params[strings.ToLower(token)] = value
+				s = r
+				continue
+			}
+			// a new challenge
+			current = &authChallenge{
+				Scheme: token,
+				Params: map[string]string{},
+			}
+			ret = append(ret, current)
+			s = rest
+		}
+	}
+	return ret
+}
+
+func splitToken(s string) (token, rest string) {
+	i := strings.IndexFunc(s, func(r rune) bool {
+		return r == ' ' || r == '\t' || r == ',' || r == '=' || r == '"'
+	})
+	if i < 0 {
+		return s, ""
+	}
+	return s[:i], s[i:]
+}
+
+func parseParamValue(s string) (value, rest string) {
+	if !strings.HasPrefix(s, `"`) {
+		i := strings.IndexAny(s, " \t,")
+		if i < 0 {
+			return s, ""
+		}
+		return s[:i], s[i:]
+	}
+	var buf strings.Builder
+	for i := 1; i < len(s); i++ {
+		switch s[i] {
+		case '\\':
+			if i+1 < len(s) {
+				i++
+				buf.WriteByte(s[i])
+			}
+		case '"':
+			return buf.String(), s[i+1:]
+		default:
+			buf.WriteByte(s[i])
+		}
+	}
+	return buf.String(), ""
+}
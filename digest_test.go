@@ -0,0 +1,247 @@
+package proxy
+
+import (
+	"context"
+	"crypto/md5"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/ssm"
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestDigest(t *testing.T) {
+	// the example in RFC 7616 Section 3.9.1.
+	defer setNonce("f2/wE4q74E6zIJEtWaHKaf5wv/H5QzzpXusqGemxURZJ")()
+	const challenge = `realm="http-auth@example.org", qop="auth, auth-int", nonce="7ypf/xlj9XXwfDPEoM4URrv/xwf94BcCAzFZH4GiTo0v", opaque="FQhe/qaU925kfnzjCev0ciny7QMkPqMAFRtzCUYo5tdS"`
+
+	tests := []struct {
+		name   string
+		header []string
+		want   string
+	}{
+		{
+			name:   "md5",
+			header: []string{`Digest ` + challenge + `, algorithm=MD5`},
+			want:   `Digest username="Mufasa", realm="http-auth@example.org", uri="/dir/index.html", algorithm=MD5, nonce="7ypf/xlj9XXwfDPEoM4URrv/xwf94BcCAzFZH4GiTo0v", nc=00000001, cnonce="f2/wE4q74E6zIJEtWaHKaf5wv/H5QzzpXusqGemxURZJ", qop=auth, response="8ca523f5e9506fed4657c9700eebdbec", opaque="FQhe/qaU925kfnzjCev0ciny7QMkPqMAFRtzCUYo5tdS"`,
+		},
+		{
+			name: "sha-256",
+			header: []string{
+				`Digest ` + challenge + `, algorithm=SHA-256`,
+				`Digest ` + challenge + `, algorithm=MD5`,
+				`Basic realm="http-auth@example.org"`,
+			},
+			want: `Digest username="Mufasa", realm="http-auth@example.org", uri="/dir/index.html", algorithm=SHA-256, nonce="7ypf/xlj9XXwfDPEoM4URrv/xwf94BcCAzFZH4GiTo0v", nc=00000001, cnonce="f2/wE4q74E6zIJEtWaHKaf5wv/H5QzzpXusqGemxURZJ", qop=auth, response="753927fa0e85d155564e2e272a28d1802ca10daf4496794697cf8db5856cb6c1", opaque="FQhe/qaU925kfnzjCev0ciny7QMkPqMAFRtzCUYo5tdS"`,
+		},
+		{
+			name: "one header",
+			header: []string{
+				`Basic realm="http-auth@example.org", Digest ` + challenge + `, algorithm=SHA-256`,
+			},
+			want: `Digest username="Mufasa", realm="http-auth@example.org", uri="/dir/index.html", algorithm=SHA-256, nonce="7ypf/xlj9XXwfDPEoM4URrv/xwf94BcCAzFZH4GiTo0v", nc=00000001, cnonce="f2/wE4q74E6zIJEtWaHKaf5wv/H5QzzpXusqGemxURZJ", qop=auth, response="753927fa0e85d155564e2e272a28d1802ca10daf4496794697cf8db5856cb6c1", opaque="FQhe/qaU925kfnzjCev0ciny7QMkPqMAFRtzCUYo5tdS"`,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			d := &Digest{User: "Mufasa", Password: "Circle of Life"}
+			d.init(nil)
+
+			req := httptest.NewRequest(http.MethodGet, "http://www.example.org/dir/index.html", nil)
+			if err := d.Sign(req); err != nil {
+				t.Fatal(err)
+			}
+			if auth := req.Header.Get("Authorization"); auth != "" {
+				t.Errorf("want no credentials before the challenge, got %s", auth)
+			}
+
+			if !d.update(http.Header{"Www-Authenticate": tt.header}) {
+				t.Fatal("want to retry, but not")
+			}
+			req = httptest.NewRequest(http.MethodGet, "http://www.example.org/dir/index.html", nil)
+			if err := d.Sign(req); err != nil {
+				t.Fatal(err)
+			}
+			if diff := cmp.Diff(tt.want, req.Header.Get("Authorization")); diff != "" {
+				t.Errorf("Authorization differs: (-want/+got)\n%s", diff)
+			}
+
+			// the same nonce means that the credentials are rejected.
+			if d.update(http.Header{"Www-Authenticate": tt.header}) {
+				t.Error("want not to retry, but do")
+			}
+		})
+	}
+
+	t.Run("stale", func(t *testing.T) {
+		d := &Digest{User: "Mufasa", Password: "Circle of Life"}
+		d.init(nil)
+		header := http.Header{"Www-Authenticate": []string{`Digest ` + challenge}}
+		if !d.update(header) {
+			t.Fatal("want to retry, but not")
+		}
+		header = http.Header{"Www-Authenticate": []string{`Digest ` + challenge + `, stale=true`}}
+		if !d.update(header) {
+			t.Error("want to retry, but not")
+		}
+	})
+
+	t.Run("unsupported algorithm", func(t *testing.T) {
+		d := &Digest{User: "Mufasa", Password: "Circle of Life"}
+		d.init(nil)
+		header := http.Header{"Www-Authenticate": []string{`Digest ` + challenge + `, algorithm=SHA-512-256`}}
+		if d.update(header) {
+			t.Error("want not to retry, but do")
+		}
+	})
+
+	t.Run("no username", func(t *testing.T) {
+		d := &Digest{}
+		d.init(nil)
+		req := httptest.NewRequest(http.MethodGet, "http://www.example.org/dir/index.html", nil)
+		if err := d.Sign(req); err == nil {
+			t.Error("want error, got nil")
+		}
+	})
+}
+
+func TestParseChallenges(t *testing.T) {
+	got := parseChallenges([]string{
+		`Newauth realm="apps", type=1, title="Login to \"apps\"", Basic realm="simple"`,
+		`Digest realm="example", nonce="abc,def"`,
+	})
+	want := []*authChallenge{
+		{
+			Scheme: "Newauth",
+			Params: map[string]string{"realm": "apps", "type": "1", "title": `Login to "apps"`},
+		},
+		{
+			Scheme: "Basic",
+			Params: map[string]string{"realm": "simple"},
+		},
+		{
+			Scheme: "Digest",
+			Params: map[string]string{"realm": "example", "nonce": "abc,def"},
+		},
+	}
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Errorf("challenges differ: (-want/+got)\n%s", diff)
+	}
+}
+
+// fakeDigestServer is a server which requires HTTP Digest Access Authentication with MD5.
+type fakeDigestServer struct {
+	t        *testing.T
+	mu       sync.Mutex
+	nonce    int
+	received []string
+}
+
+func (s *fakeDigestServer) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	body, err := ioutil.ReadAll(req.Body)
+	if err != nil {
+		s.t.Error(err)
+		return
+	}
+	nonce := fmt.Sprintf("nonce%d", s.nonce)
+	challenges := parseChallenges(req.Header["Authorization"])
+	if len(challenges) == 0 {
+		s.received = append(s.received, "none")
+		s.challenge(w, nonce)
+		return
+	}
+	params := challenges[0].Params
+	s.received = append(s.received, params["nonce"]+":"+params["nc"])
+
+	h := func(s string) string {
+		sum := md5.Sum([]byte(s))
+		return hex.EncodeToString(sum[:])
+	}
+	ha1 := h("user:digest@example.com:secret")
+	ha2 := h(req.Method + ":" + req.URL.RequestURI())
+	want := h(ha1 + ":" + nonce + ":" + params["nc"] + ":" + params["cnonce"] + ":auth:" + ha2)
+	if params["nonce"] != nonce || params["response"] != want || params["uri"] != req.URL.RequestURI() {
+		s.challenge(w, nonce)
+		return
+	}
+	if string(body) != "hello" {
+		s.t.Errorf("want %s, got %s", "hello", string(body))
+	}
+	fmt.Fprint(w, "ok")
+}
+
+func (s *fakeDigestServer) challenge(w http.ResponseWriter, nonce string) {
+	w.Header().Set("WWW-Authenticate", `Digest realm="digest@example.com", qop="auth", algorithm=MD5, nonce="`+nonce+`"`)
+	http.Error(w, "Unauthorized", http.StatusUnauthorized)
+}
+
+func TestLambdaDigest(t *testing.T) {
+	defer setNonce("0123456789abcdef")()
+	server := &fakeDigestServer{t: t}
+	ts := httptest.NewTLSServer(server)
+	defer ts.Close()
+
+	u, err := url.Parse(ts.URL)
+	if err != nil {
+		panic(err)
+	}
+	mock := &ssmMock{
+		output: &ssm.GetParametersByPathOutput{
+			Parameters: []ssm.Parameter{
+				{
+					Name:  aws.String("/" + u.Host + "/digest/username"),
+					Value: aws.String("user"),
+				},
+				{
+					Name:  aws.String("/" + u.Host + "/digest/password"),
+					Value: aws.String("secret"),
+				},
+			},
+		},
+	}
+	l := &Lambda{
+		Client: ts.Client(),
+		Audit:  &auditMock{},
+		svcssm: mock,
+	}
+	do := func() {
+		t.Helper()
+		r, err := NewRequest(httptest.NewRequest(http.MethodPost, ts.URL+"/api?foo=bar", strings.NewReader("hello")))
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp, err := l.Handle(context.Background(), r)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if resp.StatusCode != http.StatusOK {
+			t.Errorf("want %d, got %d", http.StatusOK, resp.StatusCode)
+		}
+	}
+
+	// the first request gets the challenge, and the retry answers it.
+	do()
+	// the second request answers the cached challenge.
+	do()
+	// the server expires the nonce.
+	server.mu.Lock()
+	server.nonce++
+	server.mu.Unlock()
+	do()
+
+	want := "none,nonce0:00000001,nonce0:00000002,nonce0:00000003,nonce1:00000001"
+	if got := strings.Join(server.received, ","); got != want {
+		t.Errorf("want %s, got %s", want, got)
+	}
+}
@@ -0,0 +1,193 @@
+package proxy
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/base64"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strings"
+)
+
+// BodyEncodingGzip is the body encoding which compresses the body with gzip,
+// and encodes the result with base64.
+const BodyEncodingGzip = "gzip"
+
+// supportedBodyEncodings is the list of body encodings this version understands.
+var supportedBodyEncodings = []string{BodyEncodingGzip}
+
+// minCompressSize is the minimum size of bodies to be compressed.
+// Smaller bodies don't get any benefit from compression.
+const minCompressSize = 1024
+
+// compressBody compresses the body.
+// ok is false if the compression doesn't make the body smaller.
+func compressBody(body string, isBase64 bool) (compressed string, ok bool, err error) {
+	if len(body) < minCompressSize {
+		return "", false, nil
+	}
+	raw := []byte(body)
+	if isBase64 {
+		raw, err = base64.StdEncoding.DecodeString(body)
+		if err != nil {
+			return "", false, err
+		}
+	}
+
+	var buf bytes.Buffer
+	w := gzip.NewWriter(&buf)
+	if _, err := w.Write(raw); err != nil {
+		return "", false, err
+	}
+	if err := w.Close(); err != nil {
+		return "", false, err
+	}
+	compressed = base64.StdEncoding.EncodeToString(buf.Bytes())
+	if len(compressed) >= len(body) {
+		return "", false, nil
+	}
+	return compressed, true, nil
+}
+
+// decodeBody returns the raw body.
+func decodeBody(body string, isBase64 bool, encoding string) ([]byte, error) {
+	switch encoding {
+	case "":
+		if isBase64 {
+			return base64.StdEncoding.DecodeString(body)
+		}
+		return []byte(body), nil
+	case BodyEncodingGzip:
+		r, err := gzip.NewReader(base64.NewDecoder(base64.StdEncoding, strings.NewReader(body)))
+		if err != nil {
+			return nil, err
+		}
+		defer r.Close()
+		return ioutil.ReadAll(r)
+	}
+	return nil, errors.New("proxy: unknown body encoding: " + encoding)
+}
+
+func acceptsBodyEncoding(encodings []string, encoding string) bool {
+	for _, e := range encodings {
+		if e == encoding {
+			return true
+		}
+	}
+	return false
+}
+
+// hasContentEncoding reports whether the body is already encoded, e.g. gzip.
+func hasContentEncoding(header http.Header) bool {
+	ce := header.Get("Content-Encoding")
+	return ce != "" && !strings.EqualFold(ce, "identity")
+}
+
+// Compress compresses the body if it makes the payload smaller.
+// It should be called only when the receiver understands BodyEncodingGzip.
+func (req *Request) Compress() error {
+	if req.BodyEncoding != "" {
+		return nil
+	}
+	if hasContentEncoding(req.header()) {
+		// the body is already compressed.
+		return nil
+	}
+	body, ok, err := compressBody(req.Body, req.IsBase64Encoded)
+	if err != nil || !ok {
+		return err
+	}
+	req.Body = body
+	req.IsBase64Encoded = true
+	req.BodyEncoding = BodyEncodingGzip
+	return nil
+}
+
+// Compress compresses the body if it makes the payload smaller.
+// It should be called only when the receiver understands BodyEncodingGzip.
+func (resp *Response) Compress() error {
+	if resp.BodyEncoding != "" {
+		return nil
+	}
+	if hasContentEncoding(resp.header()) {
+		// the body is already compressed.
+		return nil
+	}
+	body, ok, err := compressBody(resp.Body, resp.IsBase64Encoded)
+	if err != nil || !ok {
+		return err
+	}
+	resp.Body = body
+	resp.IsBase64Encoded = true
+	resp.BodyEncoding = BodyEncodingGzip
+	return nil
+}
+
+// requestContentEncoding asks the upstream for gzip if the client doesn't care about the encoding.
+// It reports whether the response should be decoded by decodeContentEncoding.
+// We handle Content-Encoding by ourselves instead of the transparent decompression of http.Transport,
+// because it depends on the details of the transport.
+func requestContentEncoding(req *http.Request) bool {
+	if req.Header.Get("Accept-Encoding") != "" {
+		// the client can decode the response. pass it through.
+		return false
+	}
+	req.Header.Set("Accept-Encoding", "gzip")
+	return true
+}
+
+// restrictAcceptEncoding limits the encodings that the client accepts to gzip,
+// because we can't decode the others.
+func restrictAcceptEncoding(req *http.Request) {
+	ae := req.Header.Get("Accept-Encoding")
+	if ae == "" {
+		return
+	}
+	for _, coding := range strings.Split(ae, ",") {
+		params := strings.Split(coding, ";")
+		name := strings.ToLower(strings.TrimSpace(params[0]))
+		if name != "gzip" && name != "*" {
+			continue
+		}
+		if len(params) > 1 && strings.Replace(params[1], " ", "", -1) == "q=0" {
+			continue
+		}
+		req.Header.Set("Accept-Encoding", "gzip")
+		return
+	}
+	req.Header.Set("Accept-Encoding", "identity")
+}
+
+// decodeContentEncoding decodes the body encoded by Content-Encoding.
+func decodeContentEncoding(resp *http.Response) error {
+	if !strings.EqualFold(resp.Header.Get("Content-Encoding"), "gzip") {
+		return nil
+	}
+	r, err := gzip.NewReader(resp.Body)
+	if err != nil {
+		if err == io.EOF {
+			// empty body
+			resp.Header.Del("Content-Encoding")
+			return nil
+		}
+		return err
+	}
+	resp.Body = &gzipReadCloser{Reader: r, body: resp.Body}
+	resp.Header.Del("Content-Encoding")
+	resp.Header.Del("Content-Length")
+	resp.ContentLength = -1
+	resp.Uncompressed = true
+	return nil
+}
+
+type gzipReadCloser struct {
+	*gzip.Reader
+	body io.ReadCloser
+}
+
+func (r *gzipReadCloser) Close() error {
+	r.Reader.Close()
+	return r.body.Close()
+}
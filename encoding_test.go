@@ -0,0 +1,438 @@
+package proxy
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/lambda"
+	"github.com/aws/aws-sdk-go-v2/service/ssm"
+)
+
+func TestRequestCompress(t *testing.T) {
+	t.Run("text", func(t *testing.T) {
+		str := strings.Repeat(`{"hello":"world"}`, 100)
+		httpreq := httptest.NewRequest(http.MethodPost, "http://example.com/", strings.NewReader(str))
+		req, err := NewRequest(httpreq)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := req.Compress(); err != nil {
+			t.Fatal(err)
+		}
+		if req.BodyEncoding != BodyEncodingGzip {
+			t.Errorf("want %s, got %s", BodyEncodingGzip, req.BodyEncoding)
+		}
+		if len(req.Body) >= len(str) {
+			t.Errorf("the body is not compressed: %d bytes", len(req.Body))
+		}
+
+		r, err := req.Request()
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(body) != str {
+			t.Errorf("want %s, got %s", str, string(body))
+		}
+	})
+
+	t.Run("small", func(t *testing.T) {
+		str := `{"hello":"world"}`
+		httpreq := httptest.NewRequest(http.MethodPost, "http://example.com/", strings.NewReader(str))
+		req, err := NewRequest(httpreq)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := req.Compress(); err != nil {
+			t.Fatal(err)
+		}
+		if req.BodyEncoding != "" {
+			t.Errorf("want no encoding, got %s", req.BodyEncoding)
+		}
+		if req.Body != str {
+			t.Errorf("want %s, got %s", str, req.Body)
+		}
+	})
+
+	t.Run("content-encoding", func(t *testing.T) {
+		str := strings.Repeat(`{"hello":"world"}`, 100)
+		httpreq := httptest.NewRequest(http.MethodPost, "http://example.com/", strings.NewReader(str))
+		httpreq.Header.Set("Content-Encoding", "br")
+		req, err := NewRequest(httpreq)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := req.Compress(); err != nil {
+			t.Fatal(err)
+		}
+		if req.BodyEncoding != "" {
+			t.Errorf("want no encoding, got %s", req.BodyEncoding)
+		}
+	})
+}
+
+func TestResponseCompress(t *testing.T) {
+	var buf bytes.Buffer
+	for i := 0; i < 1024; i++ {
+		buf.WriteByte(byte(i % 7))
+	}
+	buf.WriteByte(0xff) // invalid utf-8
+	raw := buf.Bytes()
+
+	resp, err := NewResponse(&http.Response{
+		StatusCode: http.StatusOK,
+		Header:     http.Header{"Content-Type": []string{"application/octet-stream"}},
+		Body:       ioutil.NopCloser(bytes.NewReader(raw)),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := resp.Compress(); err != nil {
+		t.Fatal(err)
+	}
+	if resp.BodyEncoding != BodyEncodingGzip {
+		t.Errorf("want %s, got %s", BodyEncodingGzip, resp.BodyEncoding)
+	}
+
+	rec := httptest.NewRecorder()
+	if err := resp.WriteTo(rec); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(rec.Body.Bytes(), raw) {
+		t.Errorf("unexpected body: %x", rec.Body.Bytes())
+	}
+
+	httpresp, err := resp.Response()
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, err := ioutil.ReadAll(httpresp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(body, raw) {
+		t.Errorf("unexpected body: %x", body)
+	}
+	if httpresp.ContentLength != int64(len(raw)) {
+		t.Errorf("want %d, got %d", len(raw), httpresp.ContentLength)
+	}
+}
+
+func TestLambdaContentEncoding(t *testing.T) {
+	str := strings.Repeat("Hello World!\n", 100)
+	ts := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.Header.Get("Accept-Encoding") != "gzip" {
+			t.Errorf("want gzip, got %s", req.Header.Get("Accept-Encoding"))
+		}
+		w.Header().Set("Content-Type", "text/plain")
+		w.Header().Set("Content-Encoding", "gzip")
+		gw := gzip.NewWriter(w)
+		fmt.Fprint(gw, str)
+		gw.Close()
+	}))
+	defer ts.Close()
+
+	u, err := url.Parse(ts.URL)
+	if err != nil {
+		panic(err)
+	}
+	mock := &ssmMock{
+		output: &ssm.GetParametersByPathOutput{
+			Parameters: []ssm.Parameter{
+				{
+					Name:  aws.String("/development/" + u.Host + "/headers/secret-key"),
+					Value: aws.String("very-secret"),
+				},
+			},
+		},
+	}
+	l := &Lambda{
+		Prefix: "development",
+		Client: ts.Client(),
+		svcssm: mock,
+	}
+
+	t.Run("decode", func(t *testing.T) {
+		req := httptest.NewRequest(http.MethodGet, ts.URL, nil)
+		r, err := NewRequest(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp, err := l.Handle(context.Background(), r)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if resp.Body != str {
+			t.Errorf("want %s, got %s", str, resp.Body)
+		}
+		if ce := http.Header(resp.MultiValueHeaders).Get("Content-Encoding"); ce != "" {
+			t.Errorf("want no Content-Encoding, got %s", ce)
+		}
+		if !acceptsBodyEncoding(resp.AcceptBodyEncodings, BodyEncodingGzip) {
+			t.Errorf("want gzip in %v", resp.AcceptBodyEncodings)
+		}
+	})
+
+	t.Run("compress payload", func(t *testing.T) {
+		req := httptest.NewRequest(http.MethodGet, ts.URL, nil)
+		r, err := NewRequest(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		r.AcceptBodyEncodings = []string{BodyEncodingGzip}
+		resp, err := l.Handle(context.Background(), r)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if resp.BodyEncoding != BodyEncodingGzip {
+			t.Errorf("want %s, got %s", BodyEncodingGzip, resp.BodyEncoding)
+		}
+		rec := httptest.NewRecorder()
+		if err := resp.WriteTo(rec); err != nil {
+			t.Fatal(err)
+		}
+		if rec.Body.String() != str {
+			t.Errorf("want %s, got %s", str, rec.Body.String())
+		}
+	})
+
+	t.Run("pass through", func(t *testing.T) {
+		req := httptest.NewRequest(http.MethodGet, ts.URL, nil)
+		req.Header.Set("Accept-Encoding", "gzip")
+		r, err := NewRequest(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		r.AcceptBodyEncodings = []string{BodyEncodingGzip}
+		resp, err := l.Handle(context.Background(), r)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if resp.BodyEncoding != "" {
+			t.Errorf("the body is compressed twice")
+		}
+		rec := httptest.NewRecorder()
+		if err := resp.WriteTo(rec); err != nil {
+			t.Fatal(err)
+		}
+		if rec.HeaderMap.Get("Content-Encoding") != "gzip" {
+			t.Errorf("want gzip, got %s", rec.HeaderMap.Get("Content-Encoding"))
+		}
+		gr, err := gzip.NewReader(rec.Body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, err := ioutil.ReadAll(gr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(body) != str {
+			t.Errorf("want %s, got %s", str, string(body))
+		}
+	})
+}
+
+func TestProxyNegotiateBodyEncoding(t *testing.T) {
+	str := strings.Repeat(`{"hello":"world"}`, 100)
+	var inputs []*lambda.InvokeInput
+	var requests []Request
+	l := &lambdaMock{
+		invoke: func(input *lambda.InvokeInput) *lambda.InvokeOutput {
+			var req Request
+			if err := json.Unmarshal(input.Payload, &req); err != nil {
+				t.Fatal(err)
+			}
+			inputs = append(inputs, input)
+			requests = append(requests, req)
+			return &lambda.InvokeOutput{
+				ExecutedVersion: aws.String("3"),
+				Payload:         []byte(`{"statusCode":200,"body":"ok","acceptBodyEncodings":["gzip"]}`),
+			}
+		},
+	}
+	p := &Proxy{
+		FunctionName: "proxy-test",
+		Qualifier:    "live",
+		Metadata:     testMetadata,
+		scvlambda:    l,
+	}
+	for i := 0; i < 2; i++ {
+		httpreq := httptest.NewRequest(http.MethodPost, "https://example.com/", strings.NewReader(str))
+		rec := httptest.NewRecorder()
+		p.ServeHTTP(rec, httpreq)
+		if rec.Code != http.StatusOK {
+			t.Errorf("want %d, got %d", http.StatusOK, rec.Code)
+		}
+	}
+
+	// the first request is not compressed, because the proxy doesn't know whether the function supports gzip.
+	if requests[0].BodyEncoding != "" {
+		t.Errorf("want no encoding, got %s", requests[0].BodyEncoding)
+	}
+	if got := aws.StringValue(inputs[0].Qualifier); got != "live" {
+		t.Errorf("want %s, got %s", "live", got)
+	}
+
+	// the compressed request is sent to the version which understands gzip.
+	if requests[1].BodyEncoding != BodyEncodingGzip {
+		t.Errorf("want %s, got %s", BodyEncodingGzip, requests[1].BodyEncoding)
+	}
+	if got := aws.StringValue(inputs[1].Qualifier); got != "3" {
+		t.Errorf("want %s, got %s", "3", got)
+	}
+	r, err := requests[1].Request()
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(body) != str {
+		t.Errorf("want %s, got %s", str, string(body))
+	}
+}
+
+func TestProxyDowngradeBodyEncoding(t *testing.T) {
+	now := time.Now()
+	defer setTimeNow(now)()
+	str := strings.Repeat(`{"hello":"world"}`, 100)
+
+	// the version 1 is built before the body encoding, and the version 2 understands it.
+	alias := "2"
+	var compressed int
+	l := &lambdaMock{
+		invoke: func(input *lambda.InvokeInput) *lambda.InvokeOutput {
+			var req Request
+			if err := json.Unmarshal(input.Payload, &req); err != nil {
+				t.Fatal(err)
+			}
+			version := aws.StringValue(input.Qualifier)
+			if version == "live" {
+				version = alias
+			}
+			if version == "1" {
+				if req.BodyEncoding != "" {
+					t.Errorf("the version 1 receives the body encoded by %s", req.BodyEncoding)
+				}
+				return &lambda.InvokeOutput{
+					ExecutedVersion: aws.String("1"),
+					Payload:         []byte(`{"statusCode":200,"body":"ok"}`),
+				}
+			}
+			if req.BodyEncoding != "" {
+				compressed++
+			}
+			return &lambda.InvokeOutput{
+				ExecutedVersion: aws.String(version),
+				Payload:         []byte(`{"statusCode":200,"body":"ok","acceptBodyEncodings":["gzip"]}`),
+			}
+		},
+	}
+	p := &Proxy{
+		FunctionName: "proxy-test",
+		Qualifier:    "live",
+		Metadata:     testMetadata,
+		scvlambda:    l,
+	}
+	do := func() {
+		t.Helper()
+		httpreq := httptest.NewRequest(http.MethodPost, "https://example.com/", strings.NewReader(str))
+		rec := httptest.NewRecorder()
+		p.ServeHTTP(rec, httpreq)
+		if rec.Code != http.StatusOK {
+			t.Errorf("want %d, got %d", http.StatusOK, rec.Code)
+		}
+	}
+
+	do()
+	do()
+	if compressed != 1 {
+		t.Errorf("want %d, got %d", 1, compressed)
+	}
+
+	// the alias is moved back to the version 1.
+	// the compressed requests are still sent to the version 2 until the learned version expires.
+	alias = "1"
+	do()
+	if compressed != 2 {
+		t.Errorf("want %d, got %d", 2, compressed)
+	}
+	defer setTimeNow(now.Add(gzipVersionTTL))()
+	do()
+	do()
+	if compressed != 2 {
+		t.Errorf("want %d, got %d", 2, compressed)
+	}
+}
+
+func TestProxyLatestBodyEncoding(t *testing.T) {
+	// $LATEST is mutable, so the requests to it are never compressed.
+	str := strings.Repeat(`{"hello":"world"}`, 100)
+	l := &lambdaMock{
+		invoke: func(input *lambda.InvokeInput) *lambda.InvokeOutput {
+			var req Request
+			if err := json.Unmarshal(input.Payload, &req); err != nil {
+				t.Fatal(err)
+			}
+			if req.BodyEncoding != "" {
+				t.Errorf("want no encoding, got %s", req.BodyEncoding)
+			}
+			return &lambda.InvokeOutput{
+				ExecutedVersion: aws.String(latestQualifier),
+				Payload:         []byte(`{"statusCode":200,"body":"ok","acceptBodyEncodings":["gzip"]}`),
+			}
+		},
+	}
+	p := &Proxy{
+		FunctionName: "proxy-test",
+		Metadata:     testMetadata,
+		scvlambda:    l,
+	}
+	for i := 0; i < 2; i++ {
+		httpreq := httptest.NewRequest(http.MethodPost, "https://example.com/", strings.NewReader(str))
+		rec := httptest.NewRecorder()
+		p.ServeHTTP(rec, httpreq)
+		if rec.Code != http.StatusOK {
+			t.Errorf("want %d, got %d", http.StatusOK, rec.Code)
+		}
+	}
+}
+
+func TestRestrictAcceptEncoding(t *testing.T) {
+	tests := []struct {
+		input string
+		want  string
+	}{
+		{"", ""},
+		{"gzip", "gzip"},
+		{"br, gzip;q=0.8", "gzip"},
+		{"br, gzip;q=0", "identity"},
+		{"*", "gzip"},
+		{"br", "identity"},
+	}
+	for _, tt := range tests {
+		req := httptest.NewRequest(http.MethodGet, "https://example.com/", nil)
+		if tt.input != "" {
+			req.Header.Set("Accept-Encoding", tt.input)
+		}
+		restrictAcceptEncoding(req)
+		if got := req.Header.Get("Accept-Encoding"); got != tt.want {
+			t.Errorf("%s: want %s, got %s", tt.input, tt.want, got)
+		}
+	}
+}
@@ -0,0 +1,208 @@
+package proxy
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/aws/awserr"
+	"github.com/aws/aws-sdk-go-v2/service/ssm"
+)
+
+// parameterChangeDetailType is the detail type of ParameterChangeEvent.
+const parameterChangeDetailType = "Parameter Store Change"
+
+// defaultGenerationCheckInterval is the default interval for checking the generation.
+const defaultGenerationCheckInterval = 10 * time.Second
+
+// ParameterChangeEvent is the EventBridge event of AWS SSM Parameter Store.
+type ParameterChangeEvent struct {
+	ID         string                `json:"id"`
+	DetailType string                `json:"detail-type"`
+	Source     string                `json:"source"`
+	Time       time.Time             `json:"time"`
+	Detail     ParameterChangeDetail `json:"detail"`
+}
+
+// ParameterChangeDetail is the detail of ParameterChangeEvent.
+type ParameterChangeDetail struct {
+	// Operation is the operation for the parameter, e.g. "Create", "Update" and "Delete".
+	Operation string `json:"operation"`
+
+	// Name is the name of the parameter.
+	Name string `json:"name"`
+
+	// Type is the type of the parameter, e.g. "String" and "SecureString".
+	Type string `json:"type"`
+}
+
+// Invoke implements the handler of AWS Lambda.
+// It handles Request and ParameterChangeEvent.
+func (l *Lambda) Invoke(ctx context.Context, payload []byte) ([]byte, error) {
+	var event struct {
+		DetailType string `json:"detail-type"`
+	}
+	if err := json.Unmarshal(payload, &event); err != nil {
+		return nil, err
+	}
+
+	if event.DetailType == parameterChangeDetailType {
+		var event ParameterChangeEvent
+		if err := json.Unmarshal(payload, &event); err != nil {
+			return nil, err
+		}
+		if err := l.HandleParameterChange(ctx, &event); err != nil {
+			return nil, err
+		}
+		return []byte("null"), nil
+	}
+
+	var req Request
+	if err := json.Unmarshal(payload, &req); err != nil {
+		return nil, err
+	}
+	resp, err := l.Handle(ctx, &req)
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(resp)
+}
+
+// HandleParameterChange evicts the cache of the host that the changed parameter belongs to.
+// It also updates the generation parameter, and the other containers purge their cache.
+// The updates of the refresh tokens are ignored, because they are the rotated tokens written back by the function.
+func (l *Lambda) HandleParameterChange(ctx context.Context, event *ParameterChangeEvent) error {
+	name := event.Detail.Name
+	if l.GenerationParameter != "" && name == l.GenerationParameter {
+		return nil
+	}
+	if event.Detail.Operation == "Update" && strings.HasSuffix(name, "/oauth2/refresh_token") {
+		// the other containers reload the rotated token when the authorization server rejects the old one.
+		return nil
+	}
+	host, ok := l.hostOfParameter(name)
+	if !ok {
+		return nil
+	}
+	l.evict(host)
+	return l.updateGeneration(ctx, event.ID)
+}
+
+// hostOfParameter returns the host that the parameter belongs to.
+func (l *Lambda) hostOfParameter(name string) (string, bool) {
+	base := path.Join("/", l.Prefix)
+	if base != "/" {
+		base += "/"
+	}
+	if !strings.HasPrefix(name, base) {
+		return "", false
+	}
+	name = name[len(base):]
+	idx := strings.IndexByte(name, '/')
+	if idx <= 0 {
+		return "", false
+	}
+	return strings.ToLower(name[:idx]), true
+}
+
+// evict removes the host from the cache and the negative cache.
+func (l *Lambda) evict(host string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.cache.remove(host)
+	l.negative.remove(host)
+}
+
+// purge removes all hosts from the cache and the negative cache.
+func (l *Lambda) purge() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.cache = parameterCache{}
+	l.negative = negativeCache{}
+}
+
+func (l *Lambda) generationCheckInterval() time.Duration {
+	if l.GenerationCheckInterval > 0 {
+		return l.GenerationCheckInterval
+	}
+	return defaultGenerationCheckInterval
+}
+
+// checkGeneration purges the cache if the generation is changed by other containers.
+func (l *Lambda) checkGeneration(ctx context.Context) {
+	if l.GenerationParameter == "" {
+		return
+	}
+	l.generationMu.Lock()
+	now := time.Now()
+	if now.Before(l.generationChecked.Add(l.generationCheckInterval())) {
+		l.generationMu.Unlock()
+		return
+	}
+	l.generationChecked = now
+	current := l.generation
+	// don't block the other requests while getting the generation.
+	l.generationMu.Unlock()
+
+	ctx, cancel := context.WithTimeout(ctx, l.ssmTimeout())
+	defer cancel()
+	req := l.ssm().GetParameterRequest(&ssm.GetParameterInput{
+		Name: aws.String(l.GenerationParameter),
+	})
+	req.SetContext(ctx)
+	resp, err := req.Send()
+	var generation int64
+	if err != nil {
+		if aerr, ok := err.(awserr.Error); !ok || aerr.Code() != ssm.ErrCodeParameterNotFound {
+			// use the current cache.
+			log.Println("failed to get the generation:", err)
+			return
+		}
+	} else if resp.Parameter != nil {
+		generation = aws.Int64Value(resp.Parameter.Version)
+	}
+
+	l.generationMu.Lock()
+	defer l.generationMu.Unlock()
+	if l.generation != current {
+		// updateGeneration has updated it in the meantime, and the response may be stale.
+		return
+	}
+	if generation != l.generation {
+		l.purge()
+		l.generation = generation
+	}
+}
+
+// updateGeneration updates the generation parameter.
+func (l *Lambda) updateGeneration(ctx context.Context, id string) error {
+	if l.GenerationParameter == "" {
+		return nil
+	}
+	if id == "" {
+		id = time.Now().UTC().Format(time.RFC3339Nano)
+	}
+	ctx, cancel := context.WithTimeout(ctx, l.ssmTimeout())
+	defer cancel()
+	req := l.ssm().PutParameterRequest(&ssm.PutParameterInput{
+		Name:      aws.String(l.GenerationParameter),
+		Value:     aws.String(id),
+		Type:      ssm.ParameterTypeString,
+		Overwrite: aws.Bool(true),
+	})
+	req.SetContext(ctx)
+	resp, err := req.Send()
+	if err != nil {
+		return err
+	}
+
+	// this container has already evicted the cache.
+	l.generationMu.Lock()
+	defer l.generationMu.Unlock()
+	l.generation = aws.Int64Value(resp.Version)
+	return nil
+}
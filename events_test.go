@@ -0,0 +1,244 @@
+package proxy
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/aws/awserr"
+	"github.com/aws/aws-sdk-go-v2/service/ssm"
+)
+
+// generationMock mocks the generation parameter.
+type generationMock struct {
+	*ssmMock
+	version int64
+	puts    []string
+
+	// if wait is not nil, GetParameterRequest notifies blocked, and waits for wait to be closed.
+	blocked chan struct{}
+	wait    chan struct{}
+}
+
+func (mock *generationMock) GetParameterRequest(input *ssm.GetParameterInput) ssm.GetParameterRequest {
+	if mock.wait != nil {
+		close(mock.blocked)
+		<-mock.wait
+	}
+	req := &aws.Request{
+		Data: &ssm.GetParameterOutput{
+			Parameter: &ssm.Parameter{
+				Name:    input.Name,
+				Version: aws.Int64(mock.version),
+			},
+		},
+		HTTPRequest: &http.Request{},
+		Operation:   &aws.Operation{},
+	}
+	if mock.version == 0 {
+		req.Error = awserr.New(ssm.ErrCodeParameterNotFound, "not found", nil)
+	}
+	return ssm.GetParameterRequest{
+		Request: req,
+		Input:   input,
+	}
+}
+
+func (mock *generationMock) PutParameterRequest(input *ssm.PutParameterInput) ssm.PutParameterRequest {
+	mock.version++
+	mock.puts = append(mock.puts, aws.StringValue(input.Value))
+	return ssm.PutParameterRequest{
+		Request: &aws.Request{
+			Data: &ssm.PutParameterOutput{
+				Version: aws.Int64(mock.version),
+			},
+			HTTPRequest: &http.Request{},
+			Operation:   &aws.Operation{},
+		},
+		Input: input,
+	}
+}
+
+func TestHostOfParameter(t *testing.T) {
+	tests := []struct {
+		prefix string
+		name   string
+		host   string
+		ok     bool
+	}{
+		{"", "/api.github.com/headers/Authorization", "api.github.com", true},
+		{"development", "/development/API.github.com/headers/Authorization", "api.github.com", true},
+		{"/development/", "/development/api.github.com/headers/Authorization", "api.github.com", true},
+		{"development", "/production/api.github.com/headers/Authorization", "", false},
+		{"development", "/development", "", false},
+	}
+	for _, tt := range tests {
+		l := &Lambda{Prefix: tt.prefix}
+		host, ok := l.hostOfParameter(tt.name)
+		if host != tt.host || ok != tt.ok {
+			t.Errorf("%s%s: want (%s, %t), got (%s, %t)", tt.prefix, tt.name, tt.host, tt.ok, host, ok)
+		}
+	}
+}
+
+func TestLambdaParameterChange(t *testing.T) {
+	newMock := func() *generationMock {
+		return &generationMock{
+			ssmMock: &ssmMock{
+				output: &ssm.GetParametersByPathOutput{
+					Parameters: []ssm.Parameter{
+						{
+							Name:  aws.String("/development/example.com/headers/Authorization"),
+							Value: aws.String("token very-secret"),
+						},
+					},
+				},
+			},
+		}
+	}
+	event := []byte(`{
+  "version": "0",
+  "id": "9547ef2d-3b7e-4057-b6cb-5fdf09ee7c8f",
+  "detail-type": "Parameter Store Change",
+  "source": "aws.ssm",
+  "account": "123456789012",
+  "time": "2019-06-01T00:00:00Z",
+  "region": "us-east-1",
+  "resources": ["arn:aws:ssm:us-east-1:123456789012:parameter/development/example.com/headers/Authorization"],
+  "detail": {
+    "operation": "Update",
+    "name": "/development/example.com/headers/Authorization",
+    "type": "SecureString",
+    "description": ""
+  }
+}`)
+
+	t.Run("evict", func(t *testing.T) {
+		mock := newMock()
+		l := &Lambda{
+			Prefix:              "development",
+			GenerationParameter: "/ssm-sign-proxy/generation",
+			svcssm:              mock,
+		}
+		if _, err := l.getParam(context.Background(), "example.com"); err != nil {
+			t.Fatal(err)
+		}
+		resp, err := l.Invoke(context.Background(), event)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(resp) != "null" {
+			t.Errorf("want null, got %s", string(resp))
+		}
+		if _, err := l.getParam(context.Background(), "example.com"); err != nil {
+			t.Fatal(err)
+		}
+		if mock.calls != 2 {
+			t.Errorf("want %d, got %d", 2, mock.calls)
+		}
+		if len(mock.puts) != 1 || mock.puts[0] != "9547ef2d-3b7e-4057-b6cb-5fdf09ee7c8f" {
+			t.Errorf("unexpected generation: %v", mock.puts)
+		}
+	})
+
+	t.Run("generation", func(t *testing.T) {
+		mock := newMock()
+		l := &Lambda{
+			Prefix:                  "development",
+			GenerationParameter:     "/ssm-sign-proxy/generation",
+			GenerationCheckInterval: 1,
+			svcssm:                  mock,
+		}
+		if _, err := l.getParam(context.Background(), "example.com"); err != nil {
+			t.Fatal(err)
+		}
+
+		// another container updates the generation.
+		mock.version++
+		if _, err := l.getParam(context.Background(), "example.com"); err != nil {
+			t.Fatal(err)
+		}
+		if mock.calls != 2 {
+			t.Errorf("want %d, got %d", 2, mock.calls)
+		}
+
+		// the generation is not changed.
+		if _, err := l.getParam(context.Background(), "example.com"); err != nil {
+			t.Fatal(err)
+		}
+		if mock.calls != 2 {
+			t.Errorf("want %d, got %d", 2, mock.calls)
+		}
+	})
+
+	t.Run("slow generation", func(t *testing.T) {
+		mock := newMock()
+		mock.blocked = make(chan struct{})
+		mock.wait = make(chan struct{})
+		l := &Lambda{
+			Prefix:              "development",
+			GenerationParameter: "/ssm-sign-proxy/generation",
+			svcssm:              mock,
+		}
+		done := make(chan struct{})
+		go func() {
+			defer close(done)
+			l.checkGeneration(context.Background())
+		}()
+		<-mock.blocked
+
+		// getting the generation doesn't block updating it.
+		updated := make(chan error, 1)
+		go func() {
+			updated <- l.updateGeneration(context.Background(), "9547ef2d-3b7e-4057-b6cb-5fdf09ee7c8f")
+		}()
+		select {
+		case err := <-updated:
+			if err != nil {
+				t.Fatal(err)
+			}
+		case <-time.After(time.Second):
+			t.Fatal("updateGeneration is blocked by checkGeneration")
+		}
+		close(mock.wait)
+		<-done
+
+		if l.generation != 1 {
+			t.Errorf("want %d, got %d", 1, l.generation)
+		}
+	})
+
+	t.Run("request", func(t *testing.T) {
+		l := &Lambda{
+			Prefix: "development",
+			Audit:  &auditMock{},
+			svcssm: newMock(),
+		}
+		payload, err := json.Marshal(&Request{
+			HTTPMethod: http.MethodGet,
+			Path:       "/",
+			Headers: map[string]string{
+				"Host": "unknown.example.com",
+			},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		mock := l.svcssm.(*generationMock)
+		mock.output.Parameters = nil
+		data, err := l.Invoke(context.Background(), payload)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var resp Response
+		if err := json.Unmarshal(data, &resp); err != nil {
+			t.Fatal(err)
+		}
+		if resp.StatusCode != http.StatusProxyAuthRequired {
+			t.Errorf("want %d, got %d", http.StatusProxyAuthRequired, resp.StatusCode)
+		}
+	})
+}
@@ -0,0 +1,207 @@
+package proxy
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	defaultGitHubAPIURL = "https://api.github.com"
+
+	// githubJWTLifetime is the lifetime of the app JWT. GitHub accepts up to 10 minutes.
+	githubJWTLifetime = 10 * time.Minute
+
+	// githubClockSkew is subtracted from iat, for the clock drift between the function and GitHub.
+	githubClockSkew = time.Minute
+)
+
+// GitHubApp is the parameter for authenticating as an installation of GitHub App.
+type GitHubApp struct {
+	AppID string
+
+	// PrivateKey is the PEM encoded private key of the app.
+	PrivateKey string
+
+	// KMSKeyID is the KMS key which signs the app JWT instead of PrivateKey.
+	KMSKeyID string
+
+	// InstallationID is the ID of the installation.
+	// If it is empty, the installation of Owner is used.
+	InstallationID string
+
+	// Owner is the login of the organization or the user where the app is installed.
+	Owner string
+
+	// APIURL is the endpoint of GitHub API. The default is https://api.github.com.
+	APIURL string
+
+	client *http.Client
+	signer signer
+	err    error
+	tokens *tokenCache
+}
+
+// set sets the parameter github/{name}.
+func (g *GitHubApp) set(name, value string) {
+	switch name {
+	case "app_id":
+		g.AppID = value
+	case "private_key":
+		g.PrivateKey = value
+	case "kms_key_id":
+		g.KMSKeyID = value
+	case "installation_id":
+		g.InstallationID = value
+	case "owner":
+		g.Owner = value
+	case "api_url":
+		g.APIURL = value
+	}
+}
+
+func (g *GitHubApp) apiURL() string {
+	if g.APIURL != "" {
+		return strings.TrimSuffix(g.APIURL, "/")
+	}
+	return defaultGitHubAPIURL
+}
+
+func (g *GitHubApp) sameConfig(other *GitHubApp) bool {
+	return g.AppID == other.AppID &&
+		g.PrivateKey == other.PrivateKey &&
+		g.KMSKeyID == other.KMSKeyID &&
+		g.InstallationID == other.InstallationID &&
+		g.Owner == other.Owner &&
+		g.APIURL == other.APIURL
+}
+
+// init sets up the signer and the token cache. It takes over the tokens from old if it has the same config.
+func (g *GitHubApp) init(client *http.Client, svc kmsAPI, old *GitHubApp) {
+	g.client = client
+	g.signer, g.err = newSigner(svc, "rsa-v1_5-sha256", g.PrivateKey, g.KMSKeyID)
+	if old != nil && old.tokens != nil && g.sameConfig(old) {
+		g.tokens = old.tokens
+		return
+	}
+	g.tokens = &tokenCache{}
+}
+
+// Sign sets the installation access token to the Authorization header.
+func (g *GitHubApp) Sign(req *http.Request) error {
+	if g.AppID == "" || (g.InstallationID == "" && g.Owner == "") {
+		return errors.New("proxy: github/app_id, and github/installation_id or github/owner are required")
+	}
+	if g.err != nil {
+		return fmt.Errorf("proxy: invalid github/private_key: %v", g.err)
+	}
+	if g.tokens == nil || g.signer == nil {
+		return errors.New("proxy: the signer for github is not configured")
+	}
+	token, err := g.tokens.get(req.Context(), g.fetch)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "token "+token)
+	return nil
+}
+
+func (g *GitHubApp) fetch(ctx context.Context) (*accessToken, error) {
+	jwt, err := g.appJWT(ctx)
+	if err != nil {
+		return nil, err
+	}
+	id := g.InstallationID
+	if id == "" {
+		id, err = g.installationID(ctx, jwt)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	var token struct {
+		Token     string    `json:"token"`
+		ExpiresAt time.Time `json:"expires_at"`
+	}
+	u := g.apiURL() + "/app/installations/" + url.PathEscape(id) + "/access_tokens"
+	if err := g.do(ctx, http.MethodPost, u, jwt, &token); err != nil {
+		return nil, err
+	}
+	if token.Token == "" {
+		return nil, errors.New("proxy: the github response has no token")
+	}
+	return &accessToken{
+		Value:   token.Token,
+		Expires: token.ExpiresAt,
+	}, nil
+}
+
+// appJWT returns the JWT for authenticating as the app.
+func (g *GitHubApp) appJWT(ctx context.Context) (string, error) {
+	now := timeNow()
+	return signJWT(ctx, g.signer, "RS256", "", map[string]interface{}{
+		"iss": g.AppID,
+		"iat": now.Add(-githubClockSkew).Unix(),
+		"exp": now.Add(githubJWTLifetime - githubClockSkew).Unix(),
+	})
+}
+
+// installationID resolves the installation of the owner.
+// The organization is tried first, and then the user.
+func (g *GitHubApp) installationID(ctx context.Context, jwt string) (string, error) {
+	var installation struct {
+		ID int64 `json:"id"`
+	}
+	owner := url.PathEscape(g.Owner)
+	err := g.do(ctx, http.MethodGet, g.apiURL()+"/orgs/"+owner+"/installation", jwt, &installation)
+	if gerr, ok := err.(*githubError); ok && gerr.StatusCode == http.StatusNotFound {
+		err = g.do(ctx, http.MethodGet, g.apiURL()+"/users/"+owner+"/installation", jwt, &installation)
+	}
+	if err != nil {
+		return "", err
+	}
+	return strconv.FormatInt(installation.ID, 10), nil
+}
+
+func (g *GitHubApp) do(ctx context.Context, method, u, jwt string, v interface{}) error {
+	req, err := http.NewRequest(method, u, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Accept", "application/vnd.github+json")
+	req.Header.Set("Authorization", "Bearer "+jwt)
+	resp, err := g.client.Do(req.WithContext(ctx))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode/100 != 2 {
+		io.Copy(ioutil.Discard, resp.Body)
+		return &githubError{
+			StatusCode: resp.StatusCode,
+			Status:     resp.Status,
+			URL:        u,
+		}
+	}
+	return json.NewDecoder(io.LimitReader(resp.Body, 1<<20)).Decode(v)
+}
+
+// githubError is the error response of GitHub API.
+type githubError struct {
+	StatusCode int
+	Status     string
+	URL        string
+}
+
+func (err *githubError) Error() string {
+	return fmt.Sprintf("proxy: failed to get the github installation token: %s %s", err.URL, err.Status)
+}
@@ -0,0 +1,237 @@
+package proxy
+
+import (
+	"context"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/ssm"
+)
+
+// fakeGitHub is a fake GitHub API which issues installation access tokens.
+type fakeGitHub struct {
+	t   *testing.T
+	key *rsa.PublicKey
+
+	mu       sync.Mutex
+	issued   int
+	requests []string
+}
+
+func (s *fakeGitHub) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.requests = append(s.requests, req.Method+" "+req.URL.Path)
+
+	// verify the app JWT.
+	_, claims := parseJWT(s.t, strings.TrimPrefix(req.Header.Get("Authorization"), "Bearer "), func(input, sig []byte) bool {
+		return rsa.VerifyPKCS1v15(s.key, crypto.SHA256, digest(crypto.SHA256, input), sig) == nil
+	})
+	if claims["iss"] != "12345" {
+		http.Error(w, `{"message":"A JSON web token could not be decoded"}`, http.StatusUnauthorized)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	switch req.Method + " " + req.URL.Path {
+	case "GET /orgs/shogo82148-org/installation":
+		fmt.Fprint(w, `{"id":1}`)
+	case "GET /users/shogo82148/installation":
+		fmt.Fprint(w, `{"id":2}`)
+	case "POST /app/installations/1/access_tokens", "POST /app/installations/2/access_tokens":
+		s.issued++
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"token":      fmt.Sprintf("ghs_%d", s.issued),
+			"expires_at": timeNow().Add(time.Hour).UTC().Format(time.RFC3339),
+		})
+	default:
+		http.Error(w, `{"message":"Not Found"}`, http.StatusNotFound)
+	}
+}
+
+func (s *fakeGitHub) history() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	ret := s.requests
+	s.requests = nil
+	return ret
+}
+
+func TestGitHubApp(t *testing.T) {
+	now := time.Date(2019, 6, 1, 12, 34, 56, 0, time.UTC)
+	defer setTimeNow(now)()
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	github := &fakeGitHub{t: t, key: &key.PublicKey}
+	ts := httptest.NewTLSServer(github)
+	defer ts.Close()
+
+	cases := []struct {
+		name     string
+		app      *GitHubApp
+		requests []string
+	}{
+		{
+			name: "installation id",
+			app: &GitHubApp{
+				InstallationID: "1",
+			},
+			requests: []string{"POST /app/installations/1/access_tokens"},
+		},
+		{
+			name: "organization",
+			app: &GitHubApp{
+				Owner: "shogo82148-org",
+			},
+			requests: []string{"GET /orgs/shogo82148-org/installation", "POST /app/installations/1/access_tokens"},
+		},
+		{
+			name: "user",
+			app: &GitHubApp{
+				Owner: "shogo82148",
+			},
+			requests: []string{"GET /orgs/shogo82148/installation", "GET /users/shogo82148/installation", "POST /app/installations/2/access_tokens"},
+		},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			app := tc.app
+			app.AppID = "12345"
+			app.PrivateKey = marshalPKCS8(t, key)
+			app.APIURL = ts.URL + "/"
+			app.init(ts.Client(), nil, nil)
+
+			// the token is cached.
+			var tokens []string
+			for i := 0; i < 2; i++ {
+				req := httptest.NewRequest(http.MethodGet, "https://api.github.com/user/repos", nil)
+				if err := app.Sign(req); err != nil {
+					t.Fatal(err)
+				}
+				tokens = append(tokens, req.Header.Get("Authorization"))
+			}
+			if !strings.HasPrefix(tokens[0], "token ghs_") || tokens[0] != tokens[1] {
+				t.Errorf("unexpected tokens: %v", tokens)
+			}
+			if got := github.history(); strings.Join(got, ",") != strings.Join(tc.requests, ",") {
+				t.Errorf("want %v, got %v", tc.requests, got)
+			}
+		})
+	}
+
+	t.Run("not installed", func(t *testing.T) {
+		app := &GitHubApp{
+			AppID:      "12345",
+			PrivateKey: marshalPKCS8(t, key),
+			Owner:      "unknown",
+			APIURL:     ts.URL,
+		}
+		app.init(ts.Client(), nil, nil)
+		req := httptest.NewRequest(http.MethodGet, "https://api.github.com/user/repos", nil)
+		err := app.Sign(req)
+		if err == nil || !strings.Contains(err.Error(), "404") {
+			t.Errorf("want not found error, got %v", err)
+		}
+		github.history()
+	})
+
+	t.Run("invalid key", func(t *testing.T) {
+		app := &GitHubApp{
+			AppID:          "12345",
+			PrivateKey:     "invalid",
+			InstallationID: "1",
+			APIURL:         ts.URL,
+		}
+		app.init(ts.Client(), nil, nil)
+		req := httptest.NewRequest(http.MethodGet, "https://api.github.com/user/repos", nil)
+		if err := app.Sign(req); err == nil {
+			t.Error("want error, got nil")
+		}
+	})
+}
+
+func TestLambdaGitHubApp(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	github := &fakeGitHub{t: t, key: &key.PublicKey}
+	api := httptest.NewTLSServer(github)
+	defer api.Close()
+
+	var mu sync.Mutex
+	var received []string
+	ts := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		auth := req.Header.Get("Authorization")
+		received = append(received, auth)
+		if auth == "token ghs_1" {
+			// the first token is revoked.
+			http.Error(w, "Bad credentials", http.StatusUnauthorized)
+			return
+		}
+		fmt.Fprint(w, "ok")
+	}))
+	defer ts.Close()
+
+	u, err := url.Parse(ts.URL)
+	if err != nil {
+		panic(err)
+	}
+	mock := &ssmMock{
+		output: &ssm.GetParametersByPathOutput{
+			Parameters: []ssm.Parameter{
+				{
+					Name:  aws.String("/" + u.Host + "/github/app_id"),
+					Value: aws.String("12345"),
+				},
+				{
+					Name:  aws.String("/" + u.Host + "/github/private_key"),
+					Value: aws.String(marshalPKCS8(t, key)),
+				},
+				{
+					Name:  aws.String("/" + u.Host + "/github/installation_id"),
+					Value: aws.String("1"),
+				},
+				{
+					Name:  aws.String("/" + u.Host + "/github/api_url"),
+					Value: aws.String(api.URL),
+				},
+			},
+		},
+	}
+	l := &Lambda{
+		Client: ts.Client(),
+		Audit:  &auditMock{},
+		svcssm: mock,
+	}
+	r, err := NewRequest(httptest.NewRequest(http.MethodGet, ts.URL+"/user/repos", nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err := l.Handle(context.Background(), r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("want %d, got %d", http.StatusOK, resp.StatusCode)
+	}
+	if want := "token ghs_1,token ghs_2"; strings.Join(received, ",") != want {
+		t.Errorf("want %s, got %s", want, strings.Join(received, ","))
+	}
+}
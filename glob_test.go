@@ -0,0 +1,36 @@
+package proxy
+
+import (
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestCompileGlob(t *testing.T) {
+	tests := []struct {
+		pattern string
+		input   string
+		want    bool
+	}{
+		{"/repos/*/issues", "/repos/foo/issues", true},
+		{"/repos/*/issues", "/repos/foo/bar/issues", false},
+		{"/repos/**/issues", "/repos/foo/bar/issues", true},
+		{"/user?", "/users", true},
+		{"/user?", "/user/", false},
+		{"/a.b", "/axb", false},
+		{"/日本*", "/日本語", true},
+	}
+	for _, tt := range tests {
+		if got := compileGlob(tt.pattern).MatchString(tt.input); got != tt.want {
+			t.Errorf("%q matches %q: want %t, got %t", tt.pattern, tt.input, tt.want, got)
+		}
+	}
+}
+
+func TestSplitList(t *testing.T) {
+	got := splitList("a, b,,c\nd ")
+	want := []string{"a", "b", "c", "d"}
+	if diff := cmp.Diff(got, want); diff != "" {
+		t.Errorf("list differs: (-got +want)\n%s", diff)
+	}
+}
@@ -1,5 +1,7 @@
 module github.com/shogo82148/ssm-sign-proxy
 
+go 1.15
+
 require (
 	github.com/aws/aws-lambda-go v1.9.0
 	github.com/aws/aws-sdk-go-v2 v0.7.0
@@ -0,0 +1,391 @@
+package proxy
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/md5"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash"
+	"io/ioutil"
+	"net/http"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// HMAC is the parameter for signing requests with HMAC.
+// The string to sign and the outputs are templates,
+// and the placeholders, e.g. "{method}" and "{body_sha256}", are replaced with the parts of the request.
+// See hmacPlaceholder for the list of the placeholders.
+type HMAC struct {
+	// Algorithm is the hash algorithm: sha256 (default), sha1, sha384, sha512 or md5.
+	Algorithm string
+
+	// Secret is the secret key.
+	Secret string
+
+	// SecretEncoding is the encoding of Secret: raw (default), hex or base64.
+	SecretEncoding string
+
+	// KMSKeyID is the KMS HMAC key which signs the requests instead of Secret.
+	// Only sha256, sha384 and sha512 are available.
+	KMSKeyID string
+
+	// StringToSign is the template of the string to sign, e.g. "{timestamp}{method}{request_uri}{body}".
+	StringToSign string
+
+	// SignatureEncoding is the encoding of the signature: hex (default), base64 or base64url.
+	SignatureEncoding string
+
+	// TimestampFormat is the format of "{timestamp}": unix (default), unix_ms, rfc3339, http or a layout of the time package.
+	TimestampFormat string
+
+	// Headers are the templates of the headers added to the request.
+	Headers map[string]string
+
+	// Queries are the templates of the queries added to the request.
+	Queries map[string]string
+
+	signer signer
+	err    error
+}
+
+// set sets the parameter hmac/{name}.
+func (h *HMAC) set(name, value string) {
+	switch name {
+	case "algorithm":
+		h.Algorithm = value
+	case "secret":
+		h.Secret = value
+	case "secret_encoding":
+		h.SecretEncoding = value
+	case "kms_key_id":
+		h.KMSKeyID = value
+	case "string_to_sign":
+		h.StringToSign = value
+	case "signature_encoding":
+		h.SignatureEncoding = value
+	case "timestamp_format":
+		h.TimestampFormat = value
+	default:
+		switch {
+		case strings.HasPrefix(name, "headers/"):
+			if h.Headers == nil {
+				h.Headers = map[string]string{}
+			}
+			h.Headers[http.CanonicalHeaderKey(strings.TrimPrefix(name, "headers/"))] = value
+		case strings.HasPrefix(name, "queries/"):
+			if h.Queries == nil {
+				h.Queries = map[string]string{}
+			}
+			h.Queries[strings.TrimPrefix(name, "queries/")] = value
+		}
+	}
+}
+
+// init prepares the signer of the KMS key.
+func (h *HMAC) init(svc kmsAPI) {
+	if h.KMSKeyID == "" {
+		return
+	}
+	alg := strings.ToLower(h.Algorithm)
+	if alg == "" {
+		alg = "sha256"
+	}
+	h.signer, h.err = newKMSSigner(svc, h.KMSKeyID, "hmac-"+alg)
+}
+
+func (h *HMAC) hash() (func() hash.Hash, error) {
+	switch strings.ToLower(h.Algorithm) {
+	case "", "sha256":
+		return sha256.New, nil
+	case "sha1":
+		return sha1.New, nil
+	case "sha384":
+		return sha512.New384, nil
+	case "sha512":
+		return sha512.New, nil
+	case "md5":
+		return md5.New, nil
+	}
+	return nil, fmt.Errorf("proxy: unknown hmac/algorithm %q", h.Algorithm)
+}
+
+func (h *HMAC) key() ([]byte, error) {
+	switch strings.ToLower(h.SecretEncoding) {
+	case "", "raw":
+		return []byte(h.Secret), nil
+	case "hex":
+		return hex.DecodeString(h.Secret)
+	case "base64":
+		return base64.StdEncoding.DecodeString(h.Secret)
+	}
+	return nil, fmt.Errorf("proxy: unknown hmac/secret_encoding %q", h.SecretEncoding)
+}
+
+func (h *HMAC) encodeSignature(sig []byte) (string, error) {
+	switch strings.ToLower(h.SignatureEncoding) {
+	case "", "hex":
+		return hex.EncodeToString(sig), nil
+	case "base64":
+		return base64.StdEncoding.EncodeToString(sig), nil
+	case "base64url":
+		return base64.RawURLEncoding.EncodeToString(sig), nil
+	}
+	return "", fmt.Errorf("proxy: unknown hmac/signature_encoding %q", h.SignatureEncoding)
+}
+
+// Sign signs the request.
+// The outputs without "{signature}" are added first, so that the string to sign can contain them,
+// e.g. the timestamp header and query.
+func (h *HMAC) Sign(req *http.Request) error {
+	if (h.Secret == "" && h.KMSKeyID == "") || h.StringToSign == "" {
+		return errors.New("proxy: hmac/secret or hmac/kms_key_id, and hmac/string_to_sign are required")
+	}
+	if len(h.Headers) == 0 && len(h.Queries) == 0 {
+		return errors.New("proxy: hmac/headers/* or hmac/queries/* is required")
+	}
+	mac, err := h.mac()
+	if err != nil {
+		return err
+	}
+	body, err := bufferBody(req)
+	if err != nil {
+		return err
+	}
+	nonce, err := newNonce()
+	if err != nil {
+		return err
+	}
+	p := &hmacPlaceholder{
+		req:       req,
+		body:      body,
+		timestamp: formatTimestamp(h.TimestampFormat),
+		nonce:     nonce,
+	}
+
+	if err := h.apply(req, p, false); err != nil {
+		return err
+	}
+	s, err := p.expand(h.StringToSign)
+	if err != nil {
+		return err
+	}
+	sig, err := mac.Sign(req.Context(), []byte(s))
+	if err != nil {
+		return err
+	}
+	p.signature, err = h.encodeSignature(sig)
+	if err != nil {
+		return err
+	}
+	return h.apply(req, p, true)
+}
+
+// mac returns the signer of the KMS key or the secret.
+func (h *HMAC) mac() (signer, error) {
+	if h.KMSKeyID != "" {
+		if h.err != nil {
+			return nil, h.err
+		}
+		if h.signer == nil {
+			return nil, errors.New("proxy: the signer for hmac is not configured")
+		}
+		return h.signer, nil
+	}
+	newHash, err := h.hash()
+	if err != nil {
+		return nil, err
+	}
+	key, err := h.key()
+	if err != nil {
+		return nil, err
+	}
+	return signerFunc(func(ctx context.Context, message []byte) ([]byte, error) {
+		mac := hmac.New(newHash, key)
+		mac.Write(message)
+		return mac.Sum(nil), nil
+	}), nil
+}
+
+// apply adds the outputs that contain "{signature}" or not.
+func (h *HMAC) apply(req *http.Request, p *hmacPlaceholder, signature bool) error {
+	for _, k := range sortedKeys(h.Headers) {
+		tmpl := h.Headers[k]
+		if strings.Contains(tmpl, "{signature}") != signature {
+			continue
+		}
+		v, err := p.expand(tmpl)
+		if err != nil {
+			return err
+		}
+		req.Header.Set(k, v)
+	}
+
+	if len(h.Queries) == 0 {
+		return nil
+	}
+	q := req.URL.Query()
+	changed := false
+	for _, k := range sortedKeys(h.Queries) {
+		tmpl := h.Queries[k]
+		if strings.Contains(tmpl, "{signature}") != signature {
+			continue
+		}
+		v, err := p.expand(tmpl)
+		if err != nil {
+			return err
+		}
+		q.Set(k, v)
+		changed = true
+	}
+	if changed {
+		req.URL.RawQuery = q.Encode()
+	}
+	return nil
+}
+
+// hmacPlaceholder expands the placeholders of the templates.
+//
+//	{method}       the method of the request
+//	{host}         the host of the request
+//	{path}         the escaped path of the request
+//	{query}        the raw query of the request
+//	{request_uri}  the path and the query of the request
+//	{body}         the body of the request
+//	{body_md5}, {body_sha1}, {body_sha256}, {body_sha512}
+//	               the hex encoded hash of the body
+//	{header:Name}  the value of the header
+//	{timestamp}    the current time formatted by hmac/timestamp_format
+//	{nonce}        a random hex string
+//	{signature}    the encoded signature, only available in the outputs
+//	\n             a new line
+type hmacPlaceholder struct {
+	req       *http.Request
+	body      []byte
+	timestamp string
+	nonce     string
+	signature string
+}
+
+var hmacPlaceholderPattern = regexp.MustCompile(`\{([a-z0-9_]+)(?::([^{}]+))?\}|\\n`)
+
+func (p *hmacPlaceholder) expand(tmpl string) (string, error) {
+	var err error
+	ret := hmacPlaceholderPattern.ReplaceAllStringFunc(tmpl, func(s string) string {
+		if s == `\n` {
+			return "\n"
+		}
+		m := hmacPlaceholderPattern.FindStringSubmatch(s)
+		v, ok := p.value(m[1], m[2])
+		if !ok && err == nil {
+			err = fmt.Errorf("proxy: unknown placeholder %s", s)
+		}
+		return v
+	})
+	if err != nil {
+		return "", err
+	}
+	return ret, nil
+}
+
+func (p *hmacPlaceholder) value(name, arg string) (string, bool) {
+	if arg != "" {
+		if name == "header" {
+			return p.req.Header.Get(arg), true
+		}
+		return "", false
+	}
+	switch name {
+	case "method":
+		return p.req.Method, true
+	case "host":
+		if p.req.Host != "" {
+			return p.req.Host, true
+		}
+		return p.req.URL.Host, true
+	case "path":
+		return p.req.URL.EscapedPath(), true
+	case "query":
+		return p.req.URL.RawQuery, true
+	case "request_uri":
+		return p.req.URL.RequestURI(), true
+	case "body":
+		return string(p.body), true
+	case "body_md5":
+		sum := md5.Sum(p.body)
+		return hex.EncodeToString(sum[:]), true
+	case "body_sha1":
+		sum := sha1.Sum(p.body)
+		return hex.EncodeToString(sum[:]), true
+	case "body_sha256":
+		sum := sha256.Sum256(p.body)
+		return hex.EncodeToString(sum[:]), true
+	case "body_sha512":
+		sum := sha512.Sum512(p.body)
+		return hex.EncodeToString(sum[:]), true
+	case "timestamp":
+		return p.timestamp, true
+	case "nonce":
+		return p.nonce, true
+	case "signature":
+		return p.signature, p.signature != ""
+	}
+	return "", false
+}
+
+func formatTimestamp(format string) string {
+	now := timeNow()
+	switch format {
+	case "", "unix":
+		return strconv.FormatInt(now.Unix(), 10)
+	case "unix_ms":
+		return strconv.FormatInt(now.UnixNano()/1e6, 10)
+	case "rfc3339":
+		return now.UTC().Format("2006-01-02T15:04:05Z")
+	case "http":
+		return now.UTC().Format(http.TimeFormat)
+	}
+	return now.UTC().Format(format)
+}
+
+// newNonce returns a random hex string. It is replaced in tests.
+var newNonce = func() (string, error) {
+	var b [16]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b[:]), nil
+}
+
+// bufferBody reads the body of the request, and replaces it with the buffer.
+func bufferBody(req *http.Request) ([]byte, error) {
+	if req.Body == nil {
+		return nil, nil
+	}
+	body, err := ioutil.ReadAll(req.Body)
+	if err != nil {
+		return nil, err
+	}
+	req.Body.Close()
+	req.Body = ioutil.NopCloser(bytes.NewReader(body))
+	return body, nil
+}
+
+func sortedKeys(m map[string]string) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
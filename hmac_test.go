@@ -0,0 +1,267 @@
+package proxy
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/ssm"
+)
+
+func setNonce(nonce string) func() {
+	orig := newNonce
+	newNonce = func() (string, error) { return nonce, nil }
+	return func() { newNonce = orig }
+}
+
+func TestHMAC(t *testing.T) {
+	defer setTimeNow(time.Date(2019, 6, 1, 12, 34, 56, 0, time.UTC))()
+	defer setNonce("0123456789abcdef")()
+
+	t.Run("rfc4231", func(t *testing.T) {
+		// Test Case 2 of RFC 4231.
+		h := &HMAC{
+			Secret:       "Jefe",
+			StringToSign: "what do ya want for nothing?",
+			Headers: map[string]string{
+				"X-Signature": "{signature}",
+			},
+		}
+		req := httptest.NewRequest(http.MethodGet, "https://example.com/", nil)
+		if err := h.Sign(req); err != nil {
+			t.Fatal(err)
+		}
+		want := "5bdcc146bf60754e6a042426089575c75a003f089d2739839dec58b964ec3843"
+		if got := req.Header.Get("X-Signature"); got != want {
+			t.Errorf("want %s, got %s", want, got)
+		}
+	})
+
+	t.Run("headers", func(t *testing.T) {
+		h := &HMAC{
+			Secret:            "very-secret",
+			StringToSign:      "{timestamp}{method}{request_uri}{body}",
+			SignatureEncoding: "base64",
+			Headers: map[string]string{
+				"X-Timestamp": "{timestamp}",
+				"X-Signature": "{signature}",
+			},
+		}
+		req := httptest.NewRequest(http.MethodPost, "https://example.com/orders?limit=10", strings.NewReader(`{"id":1}`))
+		if err := h.Sign(req); err != nil {
+			t.Fatal(err)
+		}
+
+		mac := hmac.New(sha256.New, []byte("very-secret"))
+		mac.Write([]byte(`1559392496POST/orders?limit=10{"id":1}`))
+		want := base64.StdEncoding.EncodeToString(mac.Sum(nil))
+		if got := req.Header.Get("X-Signature"); got != want {
+			t.Errorf("want %s, got %s", want, got)
+		}
+		if got := req.Header.Get("X-Timestamp"); got != "1559392496" {
+			t.Errorf("want %s, got %s", "1559392496", got)
+		}
+
+		// the body can be read again.
+		body, err := ioutil.ReadAll(req.Body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(body) != `{"id":1}` {
+			t.Errorf("want %s, got %s", `{"id":1}`, string(body))
+		}
+	})
+
+	t.Run("queries", func(t *testing.T) {
+		// the signature covers the timestamp query, because it doesn't contain {signature}.
+		h := &HMAC{
+			Secret:          "very-secret",
+			StringToSign:    "{query}",
+			TimestampFormat: "unix_ms",
+			Queries: map[string]string{
+				"timestamp": "{timestamp}",
+				"signature": "{signature}",
+			},
+		}
+		req := httptest.NewRequest(http.MethodGet, "https://example.com/api/v3/order?symbol=LTCBTC", nil)
+		if err := h.Sign(req); err != nil {
+			t.Fatal(err)
+		}
+
+		mac := hmac.New(sha256.New, []byte("very-secret"))
+		mac.Write([]byte("symbol=LTCBTC&timestamp=1559392496000"))
+		want := "signature=" + hex.EncodeToString(mac.Sum(nil)) + "&symbol=LTCBTC&timestamp=1559392496000"
+		if got := req.URL.RawQuery; got != want {
+			t.Errorf("want %s, got %s", want, got)
+		}
+	})
+
+	t.Run("canonical string", func(t *testing.T) {
+		h := &HMAC{
+			Algorithm:       "sha512",
+			Secret:          hex.EncodeToString([]byte("very-secret")),
+			SecretEncoding:  "hex",
+			StringToSign:    `{method}\n{host}\n{path}\n{header:X-Api-Key}\n{timestamp}\n{nonce}\n{body_sha256}`,
+			TimestampFormat: "rfc3339",
+			Headers: map[string]string{
+				"X-Nonce":     "{nonce}",
+				"X-Date":      "{timestamp}",
+				"X-Signature": "v1={signature}",
+			},
+		}
+		req := httptest.NewRequest(http.MethodPut, "https://example.com/a%2Fb", strings.NewReader("hello"))
+		req.Header.Set("X-Api-Key", "api-key")
+		if err := h.Sign(req); err != nil {
+			t.Fatal(err)
+		}
+
+		sum := sha256.Sum256([]byte("hello"))
+		mac := hmac.New(sha512.New, []byte("very-secret"))
+		mac.Write([]byte("PUT\nexample.com\n/a%2Fb\napi-key\n2019-06-01T12:34:56Z\n0123456789abcdef\n" + hex.EncodeToString(sum[:])))
+		want := "v1=" + hex.EncodeToString(mac.Sum(nil))
+		if got := req.Header.Get("X-Signature"); got != want {
+			t.Errorf("want %s, got %s", want, got)
+		}
+		if got := req.Header.Get("X-Nonce"); got != "0123456789abcdef" {
+			t.Errorf("want %s, got %s", "0123456789abcdef", got)
+		}
+	})
+
+	t.Run("kms", func(t *testing.T) {
+		h := &HMAC{
+			KMSKeyID:     "alias/hmac",
+			StringToSign: "{method}{request_uri}",
+			Headers: map[string]string{
+				"X-Signature": "{signature}",
+			},
+		}
+		h.init(&memoryKMS{
+			keys: map[string]interface{}{
+				"alias/hmac": []byte("very-secret"),
+			},
+		})
+		req := httptest.NewRequest(http.MethodGet, "https://example.com/items", nil)
+		if err := h.Sign(req); err != nil {
+			t.Fatal(err)
+		}
+
+		mac := hmac.New(sha256.New, []byte("very-secret"))
+		mac.Write([]byte("GET/items"))
+		want := hex.EncodeToString(mac.Sum(nil))
+		if got := req.Header.Get("X-Signature"); got != want {
+			t.Errorf("want %s, got %s", want, got)
+		}
+	})
+
+	t.Run("errors", func(t *testing.T) {
+		cases := []struct {
+			name string
+			hmac *HMAC
+		}{
+			{
+				name: "no secret",
+				hmac: &HMAC{StringToSign: "{method}", Headers: map[string]string{"X-Signature": "{signature}"}},
+			},
+			{
+				name: "no output",
+				hmac: &HMAC{Secret: "secret", StringToSign: "{method}"},
+			},
+			{
+				name: "unknown algorithm",
+				hmac: &HMAC{Algorithm: "crc32", Secret: "secret", StringToSign: "{method}", Headers: map[string]string{"X-Signature": "{signature}"}},
+			},
+			{
+				name: "unknown placeholder",
+				hmac: &HMAC{Secret: "secret", StringToSign: "{unknown}", Headers: map[string]string{"X-Signature": "{signature}"}},
+			},
+			{
+				name: "signature in the string to sign",
+				hmac: &HMAC{Secret: "secret", StringToSign: "{signature}", Headers: map[string]string{"X-Signature": "{signature}"}},
+			},
+		}
+		for _, tc := range cases {
+			t.Run(tc.name, func(t *testing.T) {
+				req := httptest.NewRequest(http.MethodGet, "https://example.com/", nil)
+				if err := tc.hmac.Sign(req); err == nil {
+					t.Error("want error, got nil")
+				}
+			})
+		}
+	})
+}
+
+func TestLambdaHMAC(t *testing.T) {
+	defer setTimeNow(time.Date(2019, 6, 1, 12, 34, 56, 0, time.UTC))()
+
+	ts := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		// the signature covers the headers added by the other parameters.
+		mac := hmac.New(sha256.New, []byte("very-secret"))
+		mac.Write([]byte(req.Header.Get("X-Api-Key") + req.URL.RequestURI()))
+		if want, got := hex.EncodeToString(mac.Sum(nil)), req.Header.Get("X-Signature"); got != want {
+			t.Errorf("want %s, got %s", want, got)
+			http.Error(w, "NG", http.StatusForbidden)
+			return
+		}
+		fmt.Fprint(w, "ok")
+	}))
+	defer ts.Close()
+
+	u, err := url.Parse(ts.URL)
+	if err != nil {
+		panic(err)
+	}
+	mock := &ssmMock{
+		output: &ssm.GetParametersByPathOutput{
+			Parameters: []ssm.Parameter{
+				{
+					Name:  aws.String("/" + u.Host + "/headers/X-Api-Key"),
+					Value: aws.String("api-key"),
+				},
+				{
+					Name:  aws.String("/" + u.Host + "/rewrite/path"),
+					Value: aws.String("/v1/items"),
+				},
+				{
+					Name:  aws.String("/" + u.Host + "/hmac/secret"),
+					Value: aws.String("very-secret"),
+				},
+				{
+					Name:  aws.String("/" + u.Host + "/hmac/string_to_sign"),
+					Value: aws.String("{header:X-Api-Key}{request_uri}"),
+				},
+				{
+					Name:  aws.String("/" + u.Host + "/hmac/headers/x-signature"),
+					Value: aws.String("{signature}"),
+				},
+			},
+		},
+	}
+	l := &Lambda{
+		Client: ts.Client(),
+		Audit:  &auditMock{},
+		svcssm: mock,
+	}
+	r, err := NewRequest(httptest.NewRequest(http.MethodGet, ts.URL+"/items", nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err := l.Handle(context.Background(), r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("want %d, got %d", http.StatusOK, resp.StatusCode)
+	}
+}
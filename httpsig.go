@@ -0,0 +1,355 @@
+package proxy
+
+import (
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// defaultHTTPSignatureComponents are the components covered by default.
+var defaultHTTPSignatureComponents = []string{`"@method"`, `"@authority"`, `"@path"`, `"@query"`}
+
+// HTTPSignature is the parameter for signing requests with HTTP Message Signatures (RFC 9421).
+type HTTPSignature struct {
+	// KeyID is the keyid parameter of the signature.
+	KeyID string
+
+	// Algorithm is the algorithm of the signature:
+	// hmac-sha256, ed25519, ecdsa-p256-sha256, ecdsa-p384-sha384, rsa-pss-sha512 or rsa-v1_5-sha256.
+	Algorithm string
+
+	// Key is the base64 encoded secret for hmac-sha256, or the PEM encoded private key for the others.
+	Key string
+
+	// KMSKeyID is the KMS key which signs the requests instead of Key.
+	KMSKeyID string
+
+	// Components are the covered components, e.g. `"@method"` and `"content-type"`.
+	// The default is "@method", "@authority", "@path" and "@query".
+	Components []string
+
+	// Label is the label of the signature. The default is "sig1".
+	Label string
+
+	// Tag is the tag parameter of the signature.
+	Tag string
+
+	// Expires is the lifetime of the signature. If it is zero, the expires parameter is omitted.
+	Expires time.Duration
+
+	// IncludeAlg adds the alg parameter to the signature.
+	IncludeAlg bool
+
+	// Digest is the algorithm of Content-Digest (RFC 9530): sha-256 or sha-512.
+	// If it is set, Content-Digest is added to the request and is covered by the signature.
+	Digest string
+
+	signer signer
+	err    error
+}
+
+// set sets the parameter httpsig/{name}.
+func (s *HTTPSignature) set(name, value string) {
+	switch name {
+	case "key_id":
+		s.KeyID = value
+	case "algorithm":
+		s.Algorithm = value
+	case "key":
+		s.Key = value
+	case "kms_key_id":
+		s.KMSKeyID = value
+	case "components":
+		s.Components = parseComponents(value)
+	case "label":
+		s.Label = value
+	case "tag":
+		s.Tag = value
+	case "expires":
+		if v, err := time.ParseDuration(value); err == nil {
+			s.Expires = v
+		}
+	case "include_alg":
+		if v, err := strconv.ParseBool(value); err == nil {
+			s.IncludeAlg = v
+		}
+	case "digest":
+		s.Digest = value
+	}
+}
+
+// init prepares the signer of the key.
+func (s *HTTPSignature) init(svc kmsAPI) {
+	s.signer, s.err = newSigner(svc, s.Algorithm, s.Key, s.KMSKeyID)
+}
+
+func (s *HTTPSignature) label() string {
+	if s.Label != "" {
+		return s.Label
+	}
+	return "sig1"
+}
+
+func (s *HTTPSignature) components() []string {
+	components := s.Components
+	if len(components) == 0 {
+		components = defaultHTTPSignatureComponents
+	}
+	if s.Digest != "" && !contains(components, `"content-digest"`) {
+		components = append(components[:len(components):len(components)], `"content-digest"`)
+	}
+	return components
+}
+
+// Sign signs the request.
+func (s *HTTPSignature) Sign(req *http.Request) error {
+	if s.err != nil {
+		return fmt.Errorf("proxy: invalid httpsig/key: %v", s.err)
+	}
+	if s.signer == nil {
+		return errors.New("proxy: httpsig/algorithm, and httpsig/key or httpsig/kms_key_id are required")
+	}
+
+	if s.Digest != "" {
+		body, err := bufferBody(req)
+		if err != nil {
+			return err
+		}
+		digest, err := contentDigest(s.Digest, body)
+		if err != nil {
+			return err
+		}
+		req.Header.Set("Content-Digest", digest)
+	}
+
+	params := s.signatureParams(timeNow())
+	base, err := signatureBase(req, s.components(), params)
+	if err != nil {
+		return err
+	}
+	sig, err := s.signer.Sign(req.Context(), []byte(base))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Signature-Input", s.label()+"="+params)
+	req.Header.Set("Signature", s.label()+"=:"+base64.StdEncoding.EncodeToString(sig)+":")
+	return nil
+}
+
+// signatureParams returns the value of "@signature-params".
+func (s *HTTPSignature) signatureParams(now time.Time) string {
+	var buf strings.Builder
+	buf.WriteString("(")
+	buf.WriteString(strings.Join(s.components(), " "))
+	buf.WriteString(")")
+	buf.WriteString(";created=" + strconv.FormatInt(now.Unix(), 10))
+	if s.Expires > 0 {
+		buf.WriteString(";expires=" + strconv.FormatInt(now.Add(s.Expires).Unix(), 10))
+	}
+	if s.KeyID != "" {
+		buf.WriteString(";keyid=" + strconv.Quote(s.KeyID))
+	}
+	if s.IncludeAlg {
+		buf.WriteString(";alg=" + strconv.Quote(s.Algorithm))
+	}
+	if s.Tag != "" {
+		buf.WriteString(";tag=" + strconv.Quote(s.Tag))
+	}
+	return buf.String()
+}
+
+// signatureBase returns the signature base of the request.
+func signatureBase(req *http.Request, components []string, params string) (string, error) {
+	var buf strings.Builder
+	for _, c := range components {
+		name, param, err := parseComponent(c)
+		if err != nil {
+			return "", err
+		}
+		values, err := componentValues(req, name, param)
+		if err != nil {
+			return "", err
+		}
+		for _, v := range values {
+			buf.WriteString(c)
+			buf.WriteString(": ")
+			buf.WriteString(v)
+			buf.WriteString("\n")
+		}
+	}
+	buf.WriteString(`"@signature-params": `)
+	buf.WriteString(params)
+	return buf.String(), nil
+}
+
+// componentValues returns the values of the component.
+// Only "@query-param" has multiple values if the query is repeated.
+func componentValues(req *http.Request, name, param string) ([]string, error) {
+	if name == "@query-param" {
+		values, ok := req.URL.Query()[param]
+		if !ok {
+			return nil, fmt.Errorf("proxy: the query %q is not found", param)
+		}
+		ret := make([]string, 0, len(values))
+		for _, v := range values {
+			ret = append(ret, queryParamEscape(v))
+		}
+		return ret, nil
+	}
+	if param != "" {
+		return nil, fmt.Errorf("proxy: the component %q doesn't have parameters", name)
+	}
+
+	switch name {
+	case "@method":
+		return []string{req.Method}, nil
+	case "@target-uri":
+		return []string{scheme(req) + "://" + authority(req) + req.URL.RequestURI()}, nil
+	case "@authority":
+		return []string{authority(req)}, nil
+	case "@scheme":
+		return []string{scheme(req)}, nil
+	case "@request-target":
+		return []string{req.URL.RequestURI()}, nil
+	case "@path":
+		path := req.URL.EscapedPath()
+		if path == "" {
+			path = "/"
+		}
+		return []string{path}, nil
+	case "@query":
+		return []string{"?" + req.URL.RawQuery}, nil
+	}
+	if strings.HasPrefix(name, "@") {
+		return nil, fmt.Errorf("proxy: unknown component %q", name)
+	}
+
+	values, ok := req.Header[http.CanonicalHeaderKey(name)]
+	if !ok {
+		// Content-Length is not in the header of the client requests.
+		if name == "content-length" && req.ContentLength > 0 {
+			return []string{strconv.FormatInt(req.ContentLength, 10)}, nil
+		}
+		return nil, fmt.Errorf("proxy: the header %q is not found", name)
+	}
+	trimmed := make([]string, 0, len(values))
+	for _, v := range values {
+		trimmed = append(trimmed, strings.TrimSpace(v))
+	}
+	return []string{strings.Join(trimmed, ", ")}, nil
+}
+
+func scheme(req *http.Request) string {
+	if req.URL.Scheme != "" {
+		return strings.ToLower(req.URL.Scheme)
+	}
+	return "https"
+}
+
+// authority returns the host of the request in lower case, without the default port.
+func authority(req *http.Request) string {
+	host := req.Host
+	if host == "" {
+		host = req.URL.Host
+	}
+	host = strings.ToLower(host)
+	if h, port, err := net.SplitHostPort(host); err == nil {
+		if (port == "443" && scheme(req) == "https") || (port == "80" && scheme(req) == "http") {
+			return h
+		}
+	}
+	return host
+}
+
+// queryParamEscape encodes the value with the application/x-www-form-urlencoded percent-encode set,
+// except that spaces are encoded as "%20".
+func queryParamEscape(s string) string {
+	return strings.Replace(url.QueryEscape(s), "+", "%20", -1)
+}
+
+// parseComponents parses the list of the components, e.g. `"@method" "content-type"`.
+// The quotes are optional, and the items are separated by spaces or commas.
+func parseComponents(s string) []string {
+	var ret []string
+	var buf strings.Builder
+	quoted := false
+	flush := func() {
+		if buf.Len() > 0 {
+			ret = append(ret, normalizeComponent(buf.String()))
+			buf.Reset()
+		}
+	}
+	for _, r := range s {
+		switch {
+		case r == '"':
+			quoted = !quoted
+			buf.WriteRune(r)
+		case !quoted && (r == ' ' || r == ',' || r == '\n' || r == '\t' || r == '(' || r == ')'):
+			flush()
+		default:
+			buf.WriteRune(r)
+		}
+	}
+	flush()
+	return ret
+}
+
+// normalizeComponent quotes the name of the component, and converts it to lower case.
+func normalizeComponent(s string) string {
+	name, params := s, ""
+	if strings.HasPrefix(s, `"`) {
+		if idx := strings.IndexByte(s[1:], '"'); idx >= 0 {
+			name, params = s[1:idx+1], s[idx+2:]
+		}
+	} else if idx := strings.IndexByte(s, ';'); idx >= 0 {
+		name, params = s[:idx], s[idx:]
+	}
+	return strconv.Quote(strings.ToLower(name)) + params
+}
+
+// parseComponent parses the component identifier, e.g. `"@query-param";name="Pet"`.
+func parseComponent(c string) (name, param string, err error) {
+	if !strings.HasPrefix(c, `"`) {
+		return "", "", fmt.Errorf("proxy: invalid component %s", c)
+	}
+	idx := strings.IndexByte(c[1:], '"')
+	if idx < 0 {
+		return "", "", fmt.Errorf("proxy: invalid component %s", c)
+	}
+	name, rest := c[1:idx+1], c[idx+2:]
+	if rest == "" {
+		return name, "", nil
+	}
+	if name != "@query-param" || !strings.HasPrefix(rest, ";name=") {
+		return "", "", fmt.Errorf("proxy: unsupported parameter of component %s", c)
+	}
+	param, err = strconv.Unquote(strings.TrimPrefix(rest, ";name="))
+	if err != nil || param == "" {
+		return "", "", fmt.Errorf("proxy: invalid component %s", c)
+	}
+	return name, param, nil
+}
+
+// contentDigest returns the value of Content-Digest (RFC 9530).
+func contentDigest(alg string, body []byte) (string, error) {
+	var sum []byte
+	switch alg {
+	case "sha-256":
+		s := sha256.Sum256(body)
+		sum = s[:]
+	case "sha-512":
+		s := sha512.Sum512(body)
+		sum = s[:]
+	default:
+		return "", fmt.Errorf("proxy: unknown httpsig/digest %q", alg)
+	}
+	return alg + "=:" + base64.StdEncoding.EncodeToString(sum) + ":", nil
+}
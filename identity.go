@@ -0,0 +1,233 @@
+package proxy
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/service/sts"
+	"github.com/aws/aws-sdk-go-v2/service/sts/stsiface"
+)
+
+const (
+	// presignExpires is the lifetime of the presigned sts:GetCallerIdentity URL.
+	presignExpires = 15 * time.Minute
+
+	// presignRefresh is the age of presigned URLs to be regenerated.
+	presignRefresh = 10 * time.Minute
+)
+
+// stsHostPattern matches the global, regional and FIPS endpoints of AWS STS.
+// The label between "sts." and ".amazonaws.com" must look like a region,
+// otherwise S3 virtual-hosted buckets such as sts.s3.amazonaws.com match.
+var stsHostPattern = regexp.MustCompile(`^sts(-fips)?(\.[a-z]{2}(-[a-z]+)+-[0-9]+)?\.amazonaws\.com(\.cn)?$`)
+
+// IdentityContext contains the verifiable identity of the caller.
+type IdentityContext struct {
+	// GetCallerIdentityURL is a presigned URL of sts:GetCallerIdentity,
+	// generated from the credentials of the proxy.
+	GetCallerIdentityURL string `json:"get_caller_identity_url,omitempty"`
+
+	// The following fields are filled by the function after the verification.
+	// The values in the payload are never trusted.
+	Account string `json:"-"`
+	ARN     string `json:"-"`
+	UserID  string `json:"-"`
+}
+
+func (p *Proxy) sts() stsiface.STSAPI {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.svcsts == nil {
+		p.svcsts = sts.New(p.Config)
+	}
+	return p.svcsts
+}
+
+// callerIdentityURL returns a presigned URL of sts:GetCallerIdentity.
+// It returns an empty string if the proxy has no credentials.
+func (p *Proxy) callerIdentityURL(ctx context.Context) (string, error) {
+	if p.Config.Credentials == nil {
+		return "", nil
+	}
+
+	p.identityMu.Lock()
+	defer p.identityMu.Unlock()
+	now := time.Now()
+	if p.identityURL != "" && now.Before(p.identityExpires) {
+		return p.identityURL, nil
+	}
+
+	creds, err := p.Config.Credentials.Retrieve()
+	if err != nil {
+		return "", err
+	}
+	req := p.sts().GetCallerIdentityRequest(&sts.GetCallerIdentityInput{})
+	req.SetContext(ctx)
+	u, err := req.Presign(presignExpires)
+	if err != nil {
+		return "", err
+	}
+	expires := now.Add(presignRefresh)
+	if creds.CanExpire && creds.Expires.Before(expires) {
+		// AWS STS rejects the URL after the session credentials expire.
+		expires = creds.Expires
+	}
+	p.identityURL = u
+	p.identityExpires = expires
+	return u, nil
+}
+
+// verifiedIdentity is the cached result of the verification.
+type verifiedIdentity struct {
+	account string
+	arn     string
+	userID  string
+	expires time.Time
+}
+
+var errInvalidCallerIdentityURL = errors.New("proxy: invalid GetCallerIdentity URL")
+
+// verifyIdentity verifies the caller identity by executing the presigned sts:GetCallerIdentity.
+func (l *Lambda) verifyIdentity(ctx context.Context, identity *IdentityContext) error {
+	identity.Account = ""
+	identity.ARN = ""
+	identity.UserID = ""
+	if identity.GetCallerIdentityURL == "" {
+		return nil
+	}
+
+	u, expires, err := l.parseCallerIdentityURL(identity.GetCallerIdentityURL)
+	if err != nil {
+		return err
+	}
+
+	// search from the cache.
+	now := time.Now()
+	key := u.String()
+	l.identityMu.Lock()
+	if v, ok := l.identities[key]; ok && now.Before(v.expires) {
+		l.identityMu.Unlock()
+		identity.Account, identity.ARN, identity.UserID = v.account, v.arn, v.userID
+		return nil
+	}
+	l.identityMu.Unlock()
+
+	v, err := l.getCallerIdentity(ctx, u)
+	if err != nil {
+		return err
+	}
+	v.expires = expires
+	identity.Account, identity.ARN, identity.UserID = v.account, v.arn, v.userID
+
+	// set to the cache.
+	l.identityMu.Lock()
+	defer l.identityMu.Unlock()
+	if l.identities == nil {
+		l.identities = make(map[string]*verifiedIdentity)
+	}
+	for k, v := range l.identities {
+		// remove expired entries to avoid the memory leak.
+		if now.After(v.expires) {
+			delete(l.identities, k)
+		}
+	}
+	l.identities[key] = v
+	return nil
+}
+
+// parseCallerIdentityURL validates the presigned URL, and returns its expiry.
+func (l *Lambda) parseCallerIdentityURL(s string) (*url.URL, time.Time, error) {
+	u, err := url.Parse(s)
+	if err != nil {
+		return nil, time.Time{}, err
+	}
+	if u.User != nil || u.Fragment != "" || (u.Path != "" && u.Path != "/") {
+		return nil, time.Time{}, errInvalidCallerIdentityURL
+	}
+
+	// the presigned URL must point to AWS STS.
+	// otherwise, anyone can forge the identity by their own server.
+	if l.STSEndpoint != "" {
+		endpoint, err := url.Parse(l.STSEndpoint)
+		if err != nil {
+			return nil, time.Time{}, err
+		}
+		if u.Scheme != endpoint.Scheme || u.Host != endpoint.Host {
+			return nil, time.Time{}, errInvalidCallerIdentityURL
+		}
+	} else {
+		if u.Scheme != "https" || !stsHostPattern.MatchString(u.Host) {
+			return nil, time.Time{}, errInvalidCallerIdentityURL
+		}
+	}
+
+	q := u.Query()
+	if q.Get("Action") != "GetCallerIdentity" {
+		return nil, time.Time{}, errInvalidCallerIdentityURL
+	}
+	date, err := time.Parse("20060102T150405Z", q.Get("X-Amz-Date"))
+	if err != nil {
+		return nil, time.Time{}, errInvalidCallerIdentityURL
+	}
+	sec, err := strconv.Atoi(q.Get("X-Amz-Expires"))
+	if err != nil || sec <= 0 {
+		return nil, time.Time{}, errInvalidCallerIdentityURL
+	}
+	expires := date.Add(time.Duration(sec) * time.Second)
+	if time.Now().After(expires) {
+		return nil, time.Time{}, errors.New("proxy: GetCallerIdentity URL is expired")
+	}
+	return u, expires, nil
+}
+
+type getCallerIdentityResponse struct {
+	GetCallerIdentityResponse struct {
+		GetCallerIdentityResult struct {
+			Account string `json:"Account"`
+			Arn     string `json:"Arn"`
+			UserID  string `json:"UserId"`
+		} `json:"GetCallerIdentityResult"`
+	} `json:"GetCallerIdentityResponse"`
+}
+
+func (l *Lambda) getCallerIdentity(ctx context.Context, u *url.URL) (*verifiedIdentity, error) {
+	req, err := http.NewRequest(http.MethodGet, u.String(), nil)
+	if err != nil {
+		return nil, err
+	}
+	req = req.WithContext(ctx)
+	req.Header.Set("Accept", "application/json")
+	resp, err := l.client().Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		io.Copy(ioutil.Discard, resp.Body)
+		return nil, errors.New("proxy: failed to verify the caller identity: " + resp.Status)
+	}
+
+	var result getCallerIdentityResponse
+	dec := json.NewDecoder(resp.Body)
+	if err := dec.Decode(&result); err != nil {
+		return nil, err
+	}
+	r := result.GetCallerIdentityResponse.GetCallerIdentityResult
+	if r.Arn == "" || !strings.HasPrefix(r.Arn, "arn:") {
+		return nil, errors.New("proxy: failed to verify the caller identity: invalid response")
+	}
+	return &verifiedIdentity{
+		account: r.Account,
+		arn:     r.Arn,
+		userID:  r.UserID,
+	}, nil
+}
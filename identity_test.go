@@ -0,0 +1,314 @@
+package proxy
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/aws/defaults"
+	"github.com/aws/aws-sdk-go-v2/service/ssm"
+)
+
+func newSTSServer(t *testing.T, calls *int) *httptest.Server {
+	return httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		*calls++
+		q := req.URL.Query()
+		if q.Get("Action") != "GetCallerIdentity" {
+			t.Errorf("unexpected action: %s", q.Get("Action"))
+		}
+		if q.Get("X-Amz-Signature") == "" {
+			t.Error("the request is not signed")
+		}
+		w.Header().Set("Content-Type", "application/json")
+		fmt.Fprint(w, `{"GetCallerIdentityResponse":{"GetCallerIdentityResult":{"Account":"123456789012","Arn":"arn:aws:sts::123456789012:assumed-role/proxy/i-1234567890abcdef0","UserId":"AROAEXAMPLE:i-1234567890abcdef0"}}}`)
+	}))
+}
+
+func TestLambdaVerifyIdentity(t *testing.T) {
+	var calls int
+	ts := newSTSServer(t, &calls)
+	defer ts.Close()
+
+	cfg := defaults.Config()
+	cfg.Region = "us-east-1"
+	cfg.EndpointResolver = aws.ResolveWithEndpointURL(ts.URL)
+	cfg.Credentials = aws.NewStaticCredentialsProvider("AKIDEXAMPLE", "wJalrXUtnFEMI/K7MDENG+bPxRfiCYEXAMPLEKEY", "")
+	p := &Proxy{
+		Config: cfg,
+	}
+	presigned, err := p.callerIdentityURL(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	t.Run("verify", func(t *testing.T) {
+		calls = 0
+		l := &Lambda{
+			Client:      ts.Client(),
+			STSEndpoint: ts.URL,
+		}
+		for i := 0; i < 2; i++ {
+			identity := &IdentityContext{
+				GetCallerIdentityURL: presigned,
+				ARN:                  "arn:aws:iam::123456789012:user/forged",
+			}
+			if err := l.verifyIdentity(context.Background(), identity); err != nil {
+				t.Fatal(err)
+			}
+			if identity.ARN != "arn:aws:sts::123456789012:assumed-role/proxy/i-1234567890abcdef0" {
+				t.Errorf("unexpected arn: %s", identity.ARN)
+			}
+			if identity.Account != "123456789012" {
+				t.Errorf("want %s, got %s", "123456789012", identity.Account)
+			}
+		}
+		// the result is cached.
+		if calls != 1 {
+			t.Errorf("want %d, got %d", 1, calls)
+		}
+	})
+
+	t.Run("untrusted endpoint", func(t *testing.T) {
+		calls = 0
+		l := &Lambda{
+			Client: ts.Client(),
+		}
+		identity := &IdentityContext{
+			GetCallerIdentityURL: presigned,
+		}
+		if err := l.verifyIdentity(context.Background(), identity); err == nil {
+			t.Error("want error, got nil")
+		}
+		if calls != 0 {
+			t.Errorf("the function must not access untrusted endpoints")
+		}
+	})
+
+	t.Run("handle", func(t *testing.T) {
+		upstream := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			fmt.Fprint(w, "ok")
+		}))
+		defer upstream.Close()
+		u, err := url.Parse(upstream.URL)
+		if err != nil {
+			panic(err)
+		}
+		mock := &ssmMock{
+			output: &ssm.GetParametersByPathOutput{
+				Parameters: []ssm.Parameter{
+					{
+						Name:  aws.String("/" + u.Host + "/headers/secret-key"),
+						Value: aws.String("very-secret"),
+					},
+				},
+			},
+		}
+		l := &Lambda{
+			Client:          ts.Client(),
+			STSEndpoint:     ts.URL,
+			RequireIdentity: true,
+			svcssm:          mock,
+		}
+
+		req := httptest.NewRequest(http.MethodGet, upstream.URL, nil)
+		r, err := NewRequest(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp, err := l.Handle(context.Background(), r)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if resp.StatusCode != http.StatusForbidden {
+			t.Errorf("want %d, got %d", http.StatusForbidden, resp.StatusCode)
+		}
+
+		r.RequestContext.Identity.GetCallerIdentityURL = presigned
+		resp, err = l.Handle(context.Background(), r)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if resp.StatusCode != http.StatusOK {
+			t.Errorf("want %d, got %d", http.StatusOK, resp.StatusCode)
+		}
+	})
+}
+
+func TestParseCallerIdentityURL(t *testing.T) {
+	l := &Lambda{}
+	tests := []string{
+		"http://sts.amazonaws.com/?Action=GetCallerIdentity&X-Amz-Date=20990101T000000Z&X-Amz-Expires=900",
+		"https://example.com/?Action=GetCallerIdentity&X-Amz-Date=20990101T000000Z&X-Amz-Expires=900",
+		"https://sts.amazonaws.com.example.com/?Action=GetCallerIdentity&X-Amz-Date=20990101T000000Z&X-Amz-Expires=900",
+		"https://sts.amazonaws.com/?Action=AssumeRole&X-Amz-Date=20990101T000000Z&X-Amz-Expires=900",
+		"https://sts.amazonaws.com/?Action=GetCallerIdentity&X-Amz-Date=20000101T000000Z&X-Amz-Expires=900",
+
+		// S3 virtual-hosted buckets named "sts"
+		"https://sts.s3.amazonaws.com/?Action=GetCallerIdentity&X-Amz-Date=20990101T000000Z&X-Amz-Expires=900",
+		"https://sts.s3-us-west-2.amazonaws.com/?Action=GetCallerIdentity&X-Amz-Date=20990101T000000Z&X-Amz-Expires=900",
+		"https://sts.s3.us-west-2.amazonaws.com/?Action=GetCallerIdentity&X-Amz-Date=20990101T000000Z&X-Amz-Expires=900",
+	}
+	for _, tt := range tests {
+		if _, _, err := l.parseCallerIdentityURL(tt); err == nil {
+			t.Errorf("%s: want error, got nil", tt)
+		}
+	}
+
+	valid := []string{
+		"https://sts.amazonaws.com/?Action=GetCallerIdentity&X-Amz-Date=20990101T000000Z&X-Amz-Expires=900",
+		"https://sts.ap-northeast-1.amazonaws.com/?Action=GetCallerIdentity&X-Amz-Date=20990101T000000Z&X-Amz-Expires=900",
+		"https://sts-fips.us-east-1.amazonaws.com/?Action=GetCallerIdentity&X-Amz-Date=20990101T000000Z&X-Amz-Expires=900",
+		"https://sts.us-gov-west-1.amazonaws.com/?Action=GetCallerIdentity&X-Amz-Date=20990101T000000Z&X-Amz-Expires=900",
+		"https://sts.cn-north-1.amazonaws.com.cn/?Action=GetCallerIdentity&X-Amz-Date=20990101T000000Z&X-Amz-Expires=900",
+	}
+	for _, tt := range valid {
+		if _, _, err := l.parseCallerIdentityURL(tt); err != nil {
+			t.Errorf("%s: %v", tt, err)
+		}
+	}
+}
+
+func TestLambdaIdentityFailure(t *testing.T) {
+	upstream := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		fmt.Fprint(w, "ok")
+	}))
+	defer upstream.Close()
+	u, err := url.Parse(upstream.URL)
+	if err != nil {
+		panic(err)
+	}
+
+	// the URL is expired.
+	const expired = "https://sts.amazonaws.com/?Action=GetCallerIdentity&X-Amz-Date=20000101T000000Z&X-Amz-Expires=900"
+	tests := []struct {
+		name    string
+		acl     []ssm.Parameter
+		require bool
+		want    int
+	}{
+		{
+			name: "no acl",
+			want: http.StatusOK,
+		},
+		{
+			name: "acl/accounts",
+			acl: []ssm.Parameter{
+				{
+					Name:  aws.String("/" + u.Host + "/acl/accounts"),
+					Value: aws.String("123456789012"),
+				},
+			},
+			want: http.StatusForbidden,
+		},
+		{
+			name:    "require identity",
+			require: true,
+			want:    http.StatusForbidden,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mock := &ssmMock{
+				output: &ssm.GetParametersByPathOutput{
+					Parameters: append([]ssm.Parameter{
+						{
+							Name:  aws.String("/" + u.Host + "/headers/X-Api-Key"),
+							Value: aws.String("very-secret"),
+						},
+					}, tt.acl...),
+				},
+			}
+			audit := &auditMock{}
+			l := &Lambda{
+				Client:          upstream.Client(),
+				RequireIdentity: tt.require,
+				Audit:           audit,
+				svcssm:          mock,
+			}
+			r, err := NewRequest(httptest.NewRequest(http.MethodGet, upstream.URL, nil))
+			if err != nil {
+				t.Fatal(err)
+			}
+			r.RequestContext.Identity.GetCallerIdentityURL = expired
+			resp, err := l.Handle(context.Background(), r)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if resp.StatusCode != tt.want {
+				t.Errorf("want %d, got %d", tt.want, resp.StatusCode)
+			}
+			if len(audit.records) != 1 || audit.records[0].IdentityError == "" {
+				t.Error("want the failure in the audit log, but not")
+			}
+		})
+	}
+}
+
+// expiringCredentials is the session credentials which expire at the time.
+type expiringCredentials time.Time
+
+func (c expiringCredentials) Retrieve() (aws.Credentials, error) {
+	return aws.Credentials{
+		AccessKeyID:     "AKIDEXAMPLE",
+		SecretAccessKey: "wJalrXUtnFEMI/K7MDENG+bPxRfiCYEXAMPLEKEY",
+		SessionToken:    "session-token",
+		CanExpire:       true,
+		Expires:         time.Time(c),
+	}, nil
+}
+
+type failingCredentials struct{}
+
+func (failingCredentials) Retrieve() (aws.Credentials, error) {
+	return aws.Credentials{}, errors.New("no credentials")
+}
+
+func TestProxyCallerIdentityURL(t *testing.T) {
+	t.Run("session credentials", func(t *testing.T) {
+		expires := time.Now().Add(time.Minute)
+		cfg := defaults.Config()
+		cfg.Region = "us-east-1"
+		cfg.Credentials = expiringCredentials(expires)
+		p := &Proxy{
+			Config: cfg,
+		}
+		if _, err := p.callerIdentityURL(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+		if p.identityExpires.After(expires) {
+			t.Errorf("the URL is cached after the credentials expire: %s", p.identityExpires)
+		}
+	})
+
+	t.Run("failure", func(t *testing.T) {
+		l := &lambdaMock{}
+		cfg := defaults.Config()
+		cfg.Region = "us-east-1"
+		cfg.Credentials = failingCredentials{}
+		p := &Proxy{
+			Config:       cfg,
+			FunctionName: "proxy-test",
+			Metadata:     testMetadata,
+			scvlambda:    l,
+		}
+		rec := httptest.NewRecorder()
+		p.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "https://example.com/", nil))
+		if rec.Code != http.StatusOK {
+			t.Errorf("want %d, got %d", http.StatusOK, rec.Code)
+		}
+		var req Request
+		if err := json.Unmarshal(l.input.Payload, &req); err != nil {
+			t.Fatal(err)
+		}
+		if req.RequestContext.Identity.GetCallerIdentityURL != "" {
+			t.Errorf("want no identity, got %s", req.RequestContext.Identity.GetCallerIdentityURL)
+		}
+	})
+}
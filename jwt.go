@@ -0,0 +1,229 @@
+package proxy
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+const (
+	// defaultJWTLifetime is the default lifetime of the minted tokens.
+	defaultJWTLifetime = 5 * time.Minute
+
+	// jwtBearerGrantType is the grant type of the token exchange (RFC 7523).
+	jwtBearerGrantType = "urn:ietf:params:oauth:grant-type:jwt-bearer"
+)
+
+// jwtAlgorithms maps the JWS algorithms to the signer algorithms.
+var jwtAlgorithms = map[string]string{
+	"HS256": "hmac-sha256",
+	"RS256": "rsa-v1_5-sha256",
+	"ES256": "ecdsa-p256-sha256",
+	"ES384": "ecdsa-p384-sha384",
+	"EdDSA": "ed25519",
+}
+
+// JWT is the parameter for minting JSON Web Tokens signed by the private key.
+// The token is sent as the bearer token, or is exchanged for an access token if TokenURL is set.
+type JWT struct {
+	// Algorithm is the JWS algorithm: RS256, ES256, ES384, EdDSA or HS256.
+	Algorithm string
+
+	// Key is the PEM encoded private key, or the secret for HS256.
+	Key string
+
+	// KMSKeyID is the KMS key which signs the tokens instead of Key.
+	KMSKeyID string
+
+	// KeyID is the kid header of the token.
+	KeyID string
+
+	Issuer   string
+	Subject  string
+	Audience string
+
+	// Lifetime is the lifetime of the token. The default is 5 minutes.
+	Lifetime time.Duration
+
+	// Claims are the additional claims of the token.
+	Claims map[string]string
+
+	// TokenURL is the token endpoint which exchanges the token for an access token with the JWT bearer grant.
+	TokenURL string
+
+	client *http.Client
+	signer signer
+	err    error
+	tokens *tokenCache
+}
+
+// set sets the parameter jwt/{name}.
+func (j *JWT) set(name, value string) {
+	switch name {
+	case "algorithm":
+		j.Algorithm = value
+	case "key":
+		j.Key = value
+	case "kms_key_id":
+		j.KMSKeyID = value
+	case "kid":
+		j.KeyID = value
+	case "iss":
+		j.Issuer = value
+	case "sub":
+		j.Subject = value
+	case "aud":
+		j.Audience = value
+	case "lifetime":
+		if v, err := time.ParseDuration(value); err == nil {
+			j.Lifetime = v
+		}
+	case "token_url":
+		j.TokenURL = value
+	default:
+		if strings.HasPrefix(name, "claims/") {
+			if j.Claims == nil {
+				j.Claims = map[string]string{}
+			}
+			j.Claims[strings.TrimPrefix(name, "claims/")] = value
+		}
+	}
+}
+
+func (j *JWT) lifetime() time.Duration {
+	if j.Lifetime > 0 {
+		return j.Lifetime
+	}
+	return defaultJWTLifetime
+}
+
+func (j *JWT) sameConfig(other *JWT) bool {
+	if len(j.Claims) != len(other.Claims) {
+		return false
+	}
+	for k, v := range j.Claims {
+		if w, ok := other.Claims[k]; !ok || v != w {
+			return false
+		}
+	}
+	return j.Algorithm == other.Algorithm &&
+		j.Key == other.Key &&
+		j.KMSKeyID == other.KMSKeyID &&
+		j.KeyID == other.KeyID &&
+		j.Issuer == other.Issuer &&
+		j.Subject == other.Subject &&
+		j.Audience == other.Audience &&
+		j.Lifetime == other.Lifetime &&
+		j.TokenURL == other.TokenURL
+}
+
+// init sets up the signer and the token cache. It takes over the tokens from old if it has the same config.
+func (j *JWT) init(client *http.Client, svc kmsAPI, old *JWT) {
+	j.client = client
+	if alg, ok := jwtAlgorithms[j.Algorithm]; ok {
+		key := j.Key
+		if alg == "hmac-sha256" {
+			key = base64.StdEncoding.EncodeToString([]byte(key))
+		}
+		j.signer, j.err = newSigner(svc, alg, key, j.KMSKeyID)
+	} else {
+		j.err = fmt.Errorf("proxy: unknown jwt/algorithm %q", j.Algorithm)
+	}
+	if old != nil && old.tokens != nil && j.sameConfig(old) {
+		j.tokens = old.tokens
+		return
+	}
+	j.tokens = &tokenCache{}
+}
+
+// Sign sets the token to the Authorization header.
+func (j *JWT) Sign(req *http.Request) error {
+	if j.err != nil {
+		return j.err
+	}
+	if j.tokens == nil || j.signer == nil {
+		return errors.New("proxy: the signer for jwt is not configured")
+	}
+	token, err := j.tokens.get(req.Context(), j.fetch)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "Bearer "+token)
+	return nil
+}
+
+func (j *JWT) fetch(ctx context.Context) (*accessToken, error) {
+	now := timeNow()
+	expires := now.Add(j.lifetime())
+	claims := make(map[string]interface{}, len(j.Claims)+5)
+	for k, v := range j.Claims {
+		claims[k] = v
+	}
+	if j.Issuer != "" {
+		claims["iss"] = j.Issuer
+	}
+	if j.Subject != "" {
+		claims["sub"] = j.Subject
+	}
+	if j.Audience != "" {
+		claims["aud"] = j.Audience
+	}
+	claims["iat"] = now.Unix()
+	claims["exp"] = expires.Unix()
+
+	token, err := signJWT(ctx, j.signer, j.Algorithm, j.KeyID, claims)
+	if err != nil {
+		return nil, err
+	}
+	if j.TokenURL == "" {
+		return &accessToken{
+			Value:   token,
+			Expires: time.Unix(expires.Unix(), 0),
+		}, nil
+	}
+
+	// exchange the token for an access token.
+	o := &OAuth2{
+		TokenURL: j.TokenURL,
+		client:   j.client,
+	}
+	resp, err := o.requestToken(ctx, url.Values{
+		"grant_type": {jwtBearerGrantType},
+		"assertion":  {token},
+	})
+	if err != nil {
+		return nil, err
+	}
+	return resp.accessToken(), nil
+}
+
+// signJWT returns the JSON Web Token signed by the signer.
+func signJWT(ctx context.Context, s signer, alg, kid string, claims map[string]interface{}) (string, error) {
+	header := map[string]string{
+		"alg": alg,
+		"typ": "JWT",
+	}
+	if kid != "" {
+		header["kid"] = kid
+	}
+	h, err := json.Marshal(header)
+	if err != nil {
+		return "", err
+	}
+	c, err := json.Marshal(claims)
+	if err != nil {
+		return "", err
+	}
+	input := base64.RawURLEncoding.EncodeToString(h) + "." + base64.RawURLEncoding.EncodeToString(c)
+	sig, err := s.Sign(ctx, []byte(input))
+	if err != nil {
+		return "", err
+	}
+	return input + "." + base64.RawURLEncoding.EncodeToString(sig), nil
+}
@@ -0,0 +1,280 @@
+package proxy
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/ssm"
+	"github.com/google/go-cmp/cmp"
+)
+
+// parseJWT decodes the token, and verifies the signature with verify.
+// It doesn't call t.Fatal, because it is also called by the handlers of the test servers.
+func parseJWT(t *testing.T, token string, verify func(input, sig []byte) bool) (header, claims map[string]interface{}) {
+	t.Helper()
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		t.Errorf("invalid token: %s", token)
+		return nil, nil
+	}
+	for i, v := range []*map[string]interface{}{&header, &claims} {
+		data, err := base64.RawURLEncoding.DecodeString(parts[i])
+		if err != nil {
+			t.Error(err)
+			return nil, nil
+		}
+		if err := json.Unmarshal(data, v); err != nil {
+			t.Error(err)
+			return nil, nil
+		}
+	}
+	sig, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		t.Error(err)
+		return nil, nil
+	}
+	if !verify([]byte(parts[0]+"."+parts[1]), sig) {
+		t.Errorf("invalid signature: %s", token)
+	}
+	return
+}
+
+func verifyHS256(secret string) func(input, sig []byte) bool {
+	return func(input, sig []byte) bool {
+		mac := hmac.New(sha256.New, []byte(secret))
+		mac.Write(input)
+		return hmac.Equal(mac.Sum(nil), sig)
+	}
+}
+
+func TestJWT(t *testing.T) {
+	now := time.Date(2019, 6, 1, 12, 34, 56, 0, time.UTC)
+	defer setTimeNow(now)()
+
+	t.Run("ES256", func(t *testing.T) {
+		key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		if err != nil {
+			t.Fatal(err)
+		}
+		j := &JWT{
+			Algorithm: "ES256",
+			Key:       marshalPKCS8(t, key),
+			KeyID:     "2X9R4HXF34",
+			Issuer:    "57246542-96fe-1a63-e053-0824d011072a",
+			Audience:  "appstoreconnect-v1",
+			Lifetime:  20 * time.Minute,
+			Claims: map[string]string{
+				"bid": "com.example.app",
+			},
+		}
+		j.init(http.DefaultClient, nil, nil)
+		req := httptest.NewRequest(http.MethodGet, "https://api.appstoreconnect.apple.com/v1/apps", nil)
+		if err := j.Sign(req); err != nil {
+			t.Fatal(err)
+		}
+
+		token := strings.TrimPrefix(req.Header.Get("Authorization"), "Bearer ")
+		header, claims := parseJWT(t, token, func(input, sig []byte) bool {
+			r := new(big.Int).SetBytes(sig[:32])
+			s := new(big.Int).SetBytes(sig[32:])
+			return ecdsa.Verify(&key.PublicKey, digest(crypto.SHA256, input), r, s)
+		})
+		wantHeader := map[string]interface{}{
+			"alg": "ES256",
+			"kid": "2X9R4HXF34",
+			"typ": "JWT",
+		}
+		if diff := cmp.Diff(wantHeader, header); diff != "" {
+			t.Errorf("header differs: (-want +got)\n%s", diff)
+		}
+		wantClaims := map[string]interface{}{
+			"iss": "57246542-96fe-1a63-e053-0824d011072a",
+			"aud": "appstoreconnect-v1",
+			"bid": "com.example.app",
+			"iat": float64(now.Unix()),
+			"exp": float64(now.Add(20 * time.Minute).Unix()),
+		}
+		if diff := cmp.Diff(wantClaims, claims); diff != "" {
+			t.Errorf("claims differ: (-want +got)\n%s", diff)
+		}
+	})
+
+	t.Run("cache", func(t *testing.T) {
+		j := &JWT{
+			Algorithm: "HS256",
+			Key:       "very-secret",
+			Issuer:    "issuer",
+		}
+		j.init(http.DefaultClient, nil, nil)
+		sign := func() string {
+			req := httptest.NewRequest(http.MethodGet, "https://example.com/", nil)
+			if err := j.Sign(req); err != nil {
+				t.Fatal(err)
+			}
+			return req.Header.Get("Authorization")
+		}
+
+		first := sign()
+		parseJWT(t, strings.TrimPrefix(first, "Bearer "), verifyHS256("very-secret"))
+		if second := sign(); second != first {
+			t.Errorf("want %s, got %s", first, second)
+		}
+
+		// the token is refreshed shortly before it expires.
+		defer setTimeNow(now.Add(defaultJWTLifetime - tokenExpiryDelta + time.Second))()
+		if third := sign(); third == first {
+			t.Error("the token is not refreshed")
+		}
+
+		// the new parameter takes over the token.
+		j2 := &JWT{
+			Algorithm: "HS256",
+			Key:       "very-secret",
+			Issuer:    "issuer",
+		}
+		j2.init(http.DefaultClient, nil, j)
+		if j2.tokens != j.tokens {
+			t.Error("the token cache is not taken over")
+		}
+		j3 := &JWT{
+			Algorithm: "HS256",
+			Key:       "rotated-secret",
+			Issuer:    "issuer",
+		}
+		j3.init(http.DefaultClient, nil, j)
+		if j3.tokens == j.tokens {
+			t.Error("the token cache is taken over for the different key")
+		}
+	})
+
+	t.Run("exchange", func(t *testing.T) {
+		var exchanged int32
+		auth := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			if err := req.ParseForm(); err != nil {
+				panic(err)
+			}
+			if _, _, ok := req.BasicAuth(); ok {
+				t.Error("unexpected client authentication")
+			}
+			if got := req.PostForm.Get("grant_type"); got != jwtBearerGrantType {
+				t.Errorf("want %s, got %s", jwtBearerGrantType, got)
+			}
+			_, claims := parseJWT(t, req.PostForm.Get("assertion"), verifyHS256("very-secret"))
+			if claims["scope"] != "https://www.googleapis.com/auth/cloud-platform" {
+				t.Errorf("unexpected scope: %v", claims["scope"])
+			}
+			atomic.AddInt32(&exchanged, 1)
+			w.Header().Set("Content-Type", "application/json")
+			fmt.Fprint(w, `{"access_token":"access-token","token_type":"Bearer","expires_in":3600}`)
+		}))
+		defer auth.Close()
+
+		j := &JWT{
+			Algorithm: "HS256",
+			Key:       "very-secret",
+			Issuer:    "service-account@example.iam.gserviceaccount.com",
+			Audience:  auth.URL,
+			Claims: map[string]string{
+				"scope": "https://www.googleapis.com/auth/cloud-platform",
+			},
+			TokenURL: auth.URL,
+		}
+		j.init(auth.Client(), nil, nil)
+		for i := 0; i < 2; i++ {
+			req := httptest.NewRequest(http.MethodGet, "https://example.com/", nil)
+			if err := j.Sign(req); err != nil {
+				t.Fatal(err)
+			}
+			if got := req.Header.Get("Authorization"); got != "Bearer access-token" {
+				t.Errorf("want %s, got %s", "Bearer access-token", got)
+			}
+		}
+		if got := atomic.LoadInt32(&exchanged); got != 1 {
+			t.Errorf("want %d, got %d", 1, got)
+		}
+	})
+
+	t.Run("unknown algorithm", func(t *testing.T) {
+		j := &JWT{
+			Algorithm: "none",
+			Key:       "very-secret",
+		}
+		j.init(http.DefaultClient, nil, nil)
+		req := httptest.NewRequest(http.MethodGet, "https://example.com/", nil)
+		if err := j.Sign(req); err == nil {
+			t.Error("want error, got nil")
+		}
+	})
+}
+
+func TestLambdaJWT(t *testing.T) {
+	ts := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		token := strings.TrimPrefix(req.Header.Get("Authorization"), "Bearer ")
+		_, claims := parseJWT(t, token, verifyHS256("very-secret"))
+		if claims["iss"] != "issuer" {
+			t.Errorf("want %s, got %v", "issuer", claims["iss"])
+		}
+		// the token must not be echoed back.
+		fmt.Fprint(w, token)
+	}))
+	defer ts.Close()
+
+	u, err := url.Parse(ts.URL)
+	if err != nil {
+		panic(err)
+	}
+	mock := &ssmMock{
+		output: &ssm.GetParametersByPathOutput{
+			Parameters: []ssm.Parameter{
+				{
+					Name:  aws.String("/" + u.Host + "/jwt/algorithm"),
+					Value: aws.String("HS256"),
+				},
+				{
+					Name:  aws.String("/" + u.Host + "/jwt/key"),
+					Value: aws.String("very-secret"),
+				},
+				{
+					Name:  aws.String("/" + u.Host + "/jwt/iss"),
+					Value: aws.String("issuer"),
+				},
+			},
+		},
+	}
+	l := &Lambda{
+		Client: ts.Client(),
+		Audit:  &auditMock{},
+		svcssm: mock,
+	}
+	r, err := NewRequest(httptest.NewRequest(http.MethodGet, ts.URL, nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err := l.Handle(context.Background(), r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("want %d, got %d", http.StatusOK, resp.StatusCode)
+	}
+	if resp.Body != redactedMarker {
+		t.Errorf("want %s, got %s", redactedMarker, resp.Body)
+	}
+}
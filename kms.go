@@ -0,0 +1,198 @@
+package proxy
+
+import (
+	"context"
+	"crypto"
+	"encoding/asn1"
+	"errors"
+	"fmt"
+	"math/big"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/kms"
+)
+
+// kmsAPI is the subset of AWS KMS used for signing.
+// The private keys and the secrets never leave KMS.
+type kmsAPI interface {
+	// Sign signs the message with the asymmetric key. messageType is RAW or DIGEST.
+	Sign(ctx context.Context, keyID, algorithm, messageType string, message []byte) ([]byte, error)
+
+	// GenerateMac returns the HMAC of the message with the HMAC key.
+	GenerateMac(ctx context.Context, keyID, algorithm string, message []byte) ([]byte, error)
+}
+
+// kmsClient implements kmsAPI.
+// The SDK doesn't have the Sign and GenerateMac operations, so they are sent with the generic request.
+type kmsClient struct {
+	svc *kms.KMS
+}
+
+type kmsSignInput struct {
+	_ struct{} `type:"structure"`
+
+	KeyId            *string `type:"string"`
+	Message          []byte  `type:"blob"`
+	MessageType      *string `type:"string"`
+	SigningAlgorithm *string `type:"string"`
+}
+
+type kmsSignOutput struct {
+	_ struct{} `type:"structure"`
+
+	KeyId            *string `type:"string"`
+	Signature        []byte  `type:"blob"`
+	SigningAlgorithm *string `type:"string"`
+}
+
+type kmsGenerateMacInput struct {
+	_ struct{} `type:"structure"`
+
+	KeyId        *string `type:"string"`
+	MacAlgorithm *string `type:"string"`
+	Message      []byte  `type:"blob"`
+}
+
+type kmsGenerateMacOutput struct {
+	_ struct{} `type:"structure"`
+
+	KeyId        *string `type:"string"`
+	Mac          []byte  `type:"blob"`
+	MacAlgorithm *string `type:"string"`
+}
+
+func (c *kmsClient) Sign(ctx context.Context, keyID, algorithm, messageType string, message []byte) ([]byte, error) {
+	input := &kmsSignInput{
+		KeyId:            aws.String(keyID),
+		Message:          message,
+		MessageType:      aws.String(messageType),
+		SigningAlgorithm: aws.String(algorithm),
+	}
+	output := &kmsSignOutput{}
+	if err := c.send(ctx, "Sign", input, output); err != nil {
+		return nil, err
+	}
+	return output.Signature, nil
+}
+
+func (c *kmsClient) GenerateMac(ctx context.Context, keyID, algorithm string, message []byte) ([]byte, error) {
+	input := &kmsGenerateMacInput{
+		KeyId:        aws.String(keyID),
+		MacAlgorithm: aws.String(algorithm),
+		Message:      message,
+	}
+	output := &kmsGenerateMacOutput{}
+	if err := c.send(ctx, "GenerateMac", input, output); err != nil {
+		return nil, err
+	}
+	return output.Mac, nil
+}
+
+func (c *kmsClient) send(ctx context.Context, name string, input, output interface{}) error {
+	op := &aws.Operation{
+		Name:       name,
+		HTTPMethod: "POST",
+		HTTPPath:   "/",
+	}
+	req := c.svc.NewRequest(op, input, output)
+	req.SetContext(ctx)
+	return req.Send()
+}
+
+func (l *Lambda) kms() kmsAPI {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.svckms == nil {
+		l.svckms = &kmsClient{svc: kms.New(l.Config)}
+	}
+	return l.svckms
+}
+
+// kmsMessageLimit is the maximum size of the messages that KMS accepts.
+const kmsMessageLimit = 4096
+
+// kmsAlgorithm is the KMS algorithm for the signer algorithm.
+type kmsAlgorithm struct {
+	name string
+
+	// hash is used for signing the digest instead of the message. Zero means RAW.
+	hash crypto.Hash
+
+	// ecdsaSize is the size of r and s of ECDSA.
+	ecdsaSize int
+
+	mac bool
+}
+
+var kmsAlgorithms = map[string]kmsAlgorithm{
+	"hmac-sha256":       {name: "HMAC_SHA_256", mac: true},
+	"hmac-sha384":       {name: "HMAC_SHA_384", mac: true},
+	"hmac-sha512":       {name: "HMAC_SHA_512", mac: true},
+	"ed25519":           {name: "ED25519_SHA_512"},
+	"ecdsa-p256-sha256": {name: "ECDSA_SHA_256", hash: crypto.SHA256, ecdsaSize: 32},
+	"ecdsa-p384-sha384": {name: "ECDSA_SHA_384", hash: crypto.SHA384, ecdsaSize: 48},
+	"rsa-pss-sha512":    {name: "RSASSA_PSS_SHA_512", hash: crypto.SHA512},
+	"rsa-v1_5-sha256":   {name: "RSASSA_PKCS1_V1_5_SHA_256", hash: crypto.SHA256},
+}
+
+// newKMSSigner returns the signer which asks KMS for the signatures.
+func newKMSSigner(svc kmsAPI, keyID, alg string) (signer, error) {
+	a, ok := kmsAlgorithms[alg]
+	if !ok {
+		return nil, fmt.Errorf("proxy: unknown algorithm %q", alg)
+	}
+	if a.mac {
+		return signerFunc(func(ctx context.Context, message []byte) ([]byte, error) {
+			if len(message) > kmsMessageLimit {
+				return nil, errors.New("proxy: the message is too large for KMS")
+			}
+			return svc.GenerateMac(ctx, keyID, a.name, message)
+		}), nil
+	}
+	return signerFunc(func(ctx context.Context, message []byte) ([]byte, error) {
+		var sig []byte
+		var err error
+		if a.hash != 0 {
+			sig, err = svc.Sign(ctx, keyID, a.name, "DIGEST", digest(a.hash, message))
+		} else {
+			if len(message) > kmsMessageLimit {
+				return nil, errors.New("proxy: the message is too large for KMS")
+			}
+			sig, err = svc.Sign(ctx, keyID, a.name, "RAW", message)
+		}
+		if err != nil {
+			return nil, err
+		}
+		if a.ecdsaSize > 0 {
+			// KMS returns the ECDSA signature in ASN.1 DER.
+			return ecdsaRaw(sig, a.ecdsaSize)
+		}
+		return sig, nil
+	}), nil
+}
+
+// ecdsaRaw converts the ASN.1 DER encoded ECDSA signature into the concatenation of r and s.
+func ecdsaRaw(der []byte, size int) ([]byte, error) {
+	var sig struct {
+		R, S *big.Int
+	}
+	rest, err := asn1.Unmarshal(der, &sig)
+	if err != nil {
+		return nil, err
+	}
+	if len(rest) > 0 || sig.R.Sign() <= 0 || sig.S.Sign() <= 0 || sig.R.BitLen() > size*8 || sig.S.BitLen() > size*8 {
+		return nil, errors.New("proxy: invalid ECDSA signature")
+	}
+	raw := make([]byte, 2*size)
+	sig.R.FillBytes(raw[:size])
+	sig.S.FillBytes(raw[size:])
+	return raw, nil
+}
+
+// newSigner returns the signer of the KMS key if kmsKeyID is set, or the signer of the key.
+func newSigner(svc kmsAPI, alg, key, kmsKeyID string) (signer, error) {
+	if kmsKeyID != "" {
+		return newKMSSigner(svc, kmsKeyID, alg)
+	}
+	return newKeySigner(alg, key)
+}
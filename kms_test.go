@@ -0,0 +1,309 @@
+package proxy
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/aws/defaults"
+	"github.com/aws/aws-sdk-go-v2/service/kms"
+	"github.com/aws/aws-sdk-go-v2/service/ssm"
+)
+
+// memoryKMS is an in-memory stand-in of AWS KMS.
+type memoryKMS struct {
+	mu    sync.Mutex
+	keys  map[string]interface{}
+	calls int
+}
+
+func (m *memoryKMS) key(keyID string) (interface{}, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.calls++
+	key, ok := m.keys[keyID]
+	if !ok {
+		return nil, errors.New("NotFoundException")
+	}
+	return key, nil
+}
+
+func (m *memoryKMS) Sign(ctx context.Context, keyID, algorithm, messageType string, message []byte) ([]byte, error) {
+	key, err := m.key(keyID)
+	if err != nil {
+		return nil, err
+	}
+	switch k := key.(type) {
+	case ed25519.PrivateKey:
+		if algorithm != "ED25519_SHA_512" || messageType != "RAW" {
+			return nil, errors.New("InvalidKeyUsageException")
+		}
+		return ed25519.Sign(k, message), nil
+	case *ecdsa.PrivateKey:
+		if messageType != "DIGEST" {
+			return nil, errors.New("ValidationException")
+		}
+		return ecdsa.SignASN1(rand.Reader, k, message)
+	case *rsa.PrivateKey:
+		if messageType != "DIGEST" {
+			return nil, errors.New("ValidationException")
+		}
+		switch algorithm {
+		case "RSASSA_PKCS1_V1_5_SHA_256":
+			return rsa.SignPKCS1v15(rand.Reader, k, crypto.SHA256, message)
+		case "RSASSA_PSS_SHA_512":
+			return rsa.SignPSS(rand.Reader, k, crypto.SHA512, message, &rsa.PSSOptions{SaltLength: rsa.PSSSaltLengthEqualsHash})
+		}
+	}
+	return nil, errors.New("InvalidKeyUsageException")
+}
+
+func (m *memoryKMS) GenerateMac(ctx context.Context, keyID, algorithm string, message []byte) ([]byte, error) {
+	key, err := m.key(keyID)
+	if err != nil {
+		return nil, err
+	}
+	secret, ok := key.([]byte)
+	if !ok || algorithm != "HMAC_SHA_256" {
+		return nil, errors.New("InvalidKeyUsageException")
+	}
+	mac := hmac.New(sha256.New, secret)
+	mac.Write(message)
+	return mac.Sum(nil), nil
+}
+
+func TestKMSSigner(t *testing.T) {
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	edKey, err := parsePrivateKey(testKeyEd25519)
+	if err != nil {
+		t.Fatal(err)
+	}
+	svc := &memoryKMS{
+		keys: map[string]interface{}{
+			"ecdsa":   ecKey,
+			"rsa":     rsaKey,
+			"ed25519": edKey,
+			"hmac":    []byte("very-secret"),
+		},
+	}
+	message := []byte("hello world")
+
+	cases := []struct {
+		alg    string
+		keyID  string
+		verify func(sig []byte) bool
+	}{
+		{
+			alg:   "ecdsa-p256-sha256",
+			keyID: "ecdsa",
+			verify: func(sig []byte) bool {
+				r := new(big.Int).SetBytes(sig[:32])
+				s := new(big.Int).SetBytes(sig[32:])
+				return len(sig) == 64 && ecdsa.Verify(&ecKey.PublicKey, digest(crypto.SHA256, message), r, s)
+			},
+		},
+		{
+			alg:   "rsa-v1_5-sha256",
+			keyID: "rsa",
+			verify: func(sig []byte) bool {
+				return rsa.VerifyPKCS1v15(&rsaKey.PublicKey, crypto.SHA256, digest(crypto.SHA256, message), sig) == nil
+			},
+		},
+		{
+			alg:   "rsa-pss-sha512",
+			keyID: "rsa",
+			verify: func(sig []byte) bool {
+				return rsa.VerifyPSS(&rsaKey.PublicKey, crypto.SHA512, digest(crypto.SHA512, message), sig, nil) == nil
+			},
+		},
+		{
+			alg:   "ed25519",
+			keyID: "ed25519",
+			verify: func(sig []byte) bool {
+				return ed25519.Verify(edKey.(ed25519.PrivateKey).Public().(ed25519.PublicKey), message, sig)
+			},
+		},
+		{
+			alg:   "hmac-sha256",
+			keyID: "hmac",
+			verify: func(sig []byte) bool {
+				mac := hmac.New(sha256.New, []byte("very-secret"))
+				mac.Write(message)
+				return hmac.Equal(mac.Sum(nil), sig)
+			},
+		},
+	}
+	for _, tc := range cases {
+		t.Run(tc.alg, func(t *testing.T) {
+			s, err := newKMSSigner(svc, tc.keyID, tc.alg)
+			if err != nil {
+				t.Fatal(err)
+			}
+			sig, err := s.Sign(context.Background(), message)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !tc.verify(sig) {
+				t.Error("invalid signature")
+			}
+		})
+	}
+
+	t.Run("too large", func(t *testing.T) {
+		s, err := newKMSSigner(svc, "hmac", "hmac-sha256")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := s.Sign(context.Background(), make([]byte, kmsMessageLimit+1)); err == nil {
+			t.Error("want error, got nil")
+		}
+	})
+}
+
+func TestKMSClient(t *testing.T) {
+	ts := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if !strings.HasPrefix(req.Header.Get("Authorization"), "AWS4-HMAC-SHA256 ") {
+			t.Errorf("the request is not signed: %s", req.Header.Get("Authorization"))
+		}
+		var input map[string]string
+		if err := json.NewDecoder(req.Body).Decode(&input); err != nil {
+			t.Error(err)
+		}
+		w.Header().Set("Content-Type", "application/x-amz-json-1.1")
+		switch target := req.Header.Get("X-Amz-Target"); target {
+		case "TrentService.Sign":
+			// "aGVsbG8=" is "hello", and "c2lnbmF0dXJl" is "signature".
+			if input["KeyId"] != "alias/signing" || input["Message"] != "aGVsbG8=" || input["MessageType"] != "RAW" || input["SigningAlgorithm"] != "ED25519_SHA_512" {
+				t.Errorf("unexpected input: %v", input)
+			}
+			fmt.Fprint(w, `{"KeyId":"alias/signing","Signature":"c2lnbmF0dXJl","SigningAlgorithm":"ED25519_SHA_512"}`)
+		case "TrentService.GenerateMac":
+			if input["KeyId"] != "alias/hmac" || input["Message"] != "aGVsbG8=" || input["MacAlgorithm"] != "HMAC_SHA_256" {
+				t.Errorf("unexpected input: %v", input)
+			}
+			fmt.Fprint(w, `{"KeyId":"alias/hmac","Mac":"bWFj","MacAlgorithm":"HMAC_SHA_256"}`)
+		default:
+			t.Errorf("unexpected target: %s", target)
+			w.WriteHeader(http.StatusBadRequest)
+			fmt.Fprint(w, `{"__type":"UnknownOperationException"}`)
+		}
+	}))
+	defer ts.Close()
+
+	cfg := defaults.Config()
+	cfg.Region = "us-east-1"
+	cfg.Credentials = testCredentials
+	cfg.EndpointResolver = aws.ResolveWithEndpointURL(ts.URL)
+	cfg.HTTPClient = ts.Client()
+	c := &kmsClient{
+		svc: kms.New(cfg),
+	}
+	sig, err := c.Sign(context.Background(), "alias/signing", "ED25519_SHA_512", "RAW", []byte("hello"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(sig) != "signature" {
+		t.Errorf("want %s, got %s", "signature", string(sig))
+	}
+	mac, err := c.GenerateMac(context.Background(), "alias/hmac", "HMAC_SHA_256", []byte("hello"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(mac) != "mac" {
+		t.Errorf("want %s, got %s", "mac", string(mac))
+	}
+}
+
+func TestLambdaKMS(t *testing.T) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	svc := &memoryKMS{
+		keys: map[string]interface{}{
+			"arn:aws:kms:us-east-1:123456789012:key/jwt": key,
+		},
+	}
+
+	ts := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		token := strings.TrimPrefix(req.Header.Get("Authorization"), "Bearer ")
+		parseJWT(t, token, func(input, sig []byte) bool {
+			r := new(big.Int).SetBytes(sig[:32])
+			s := new(big.Int).SetBytes(sig[32:])
+			return ecdsa.Verify(&key.PublicKey, digest(crypto.SHA256, input), r, s)
+		})
+		fmt.Fprint(w, "ok")
+	}))
+	defer ts.Close()
+
+	u, err := url.Parse(ts.URL)
+	if err != nil {
+		panic(err)
+	}
+	mock := &ssmMock{
+		output: &ssm.GetParametersByPathOutput{
+			Parameters: []ssm.Parameter{
+				{
+					Name:  aws.String("/" + u.Host + "/jwt/algorithm"),
+					Value: aws.String("ES256"),
+				},
+				{
+					Name:  aws.String("/" + u.Host + "/jwt/kms_key_id"),
+					Value: aws.String("arn:aws:kms:us-east-1:123456789012:key/jwt"),
+				},
+				{
+					Name:  aws.String("/" + u.Host + "/jwt/iss"),
+					Value: aws.String("issuer"),
+				},
+			},
+		},
+	}
+	l := &Lambda{
+		Client: ts.Client(),
+		Audit:  &auditMock{},
+		svcssm: mock,
+		svckms: svc,
+	}
+	for i := 0; i < 2; i++ {
+		r, err := NewRequest(httptest.NewRequest(http.MethodGet, ts.URL, nil))
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp, err := l.Handle(context.Background(), r)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if resp.StatusCode != http.StatusOK {
+			t.Errorf("want %d, got %d", http.StatusOK, resp.StatusCode)
+		}
+	}
+
+	// the token is cached, so KMS signs only once.
+	if svc.calls != 1 {
+		t.Errorf("want %d, got %d", 1, svc.calls)
+	}
+}
@@ -3,19 +3,28 @@ package proxy
 import (
 	"context"
 	"errors"
+	"io"
+	"io/ioutil"
+	"log"
 	"net/http"
 	"net/url"
-	"path"
+	"strconv"
 	"strings"
 	"sync"
+	"time"
 
+	"github.com/aws/aws-lambda-go/lambdacontext"
 	"github.com/aws/aws-sdk-go-v2/aws"
 	"github.com/aws/aws-sdk-go-v2/service/ssm"
 	"github.com/aws/aws-sdk-go-v2/service/ssm/ssmiface"
 	"golang.org/x/sync/singleflight"
 )
 
-var errParamNotFound = errors.New("proxy: parameters not found")
+// ErrParamNotFound is returned by Source if the host has no parameters.
+var ErrParamNotFound = errors.New("proxy: parameters not found")
+
+// defaultSSMTimeout is the default timeout for getting the parameters from the source.
+const defaultSSMTimeout = 5 * time.Second
 
 // Lambda is a lambda function.
 type Lambda struct {
@@ -23,10 +32,85 @@ type Lambda struct {
 	Prefix string
 	Client *http.Client
 
-	group  singleflight.Group
-	mu     sync.RWMutex
-	cache  map[string]*Parameter
-	svcssm ssmiface.SSMAPI
+	// CacheTTL is the duration for caching the parameters.
+	// The default is 5 minutes. Negative values mean that the cache never expires.
+	// The parameter cache/ttl overrides it for each host.
+	CacheTTL time.Duration
+
+	// CacheRefreshWindow is the duration before the expiry when the entries are refreshed in background.
+	// The default is 1/5 of the TTL.
+	CacheRefreshWindow time.Duration
+
+	// CacheMaxStale is the maximum duration for serving expired entries when refreshing fails.
+	// The default is 1 hour. Negative values disable it.
+	CacheMaxStale time.Duration
+
+	// CacheSize is the maximum number of hosts in the cache.
+	// The default is 1024.
+	CacheSize int
+
+	// GenerationParameter is the name of the parameter which counts the changes of the parameters.
+	// The container that receives ParameterChangeEvent updates it,
+	// and the other containers purge their cache when it changes.
+	// If it is empty, the containers don't share the changes.
+	GenerationParameter string
+
+	// GenerationCheckInterval is the interval for checking GenerationParameter.
+	// The default is 10 seconds.
+	GenerationCheckInterval time.Duration
+
+	// Source is the source of the parameters.
+	// If nil, the parameters are got from AWS SSM Parameter Store under Prefix.
+	Source Source
+
+	// SSMTimeout is the timeout for getting the parameters from the source.
+	// The default is 5 seconds.
+	SSMTimeout time.Duration
+
+	// NegativeCacheTTL is the duration for caching the hosts which have no parameters.
+	// The default is 1 minute. Negative values disable the negative cache.
+	NegativeCacheTTL time.Duration
+
+	// NegativeCacheSize is the maximum number of hosts in the negative cache.
+	// The default is 1024.
+	NegativeCacheSize int
+
+	// STSEndpoint is the endpoint of AWS STS which verifies the caller identity.
+	// If it is empty, the global and regional endpoints of AWS STS are accepted.
+	STSEndpoint string
+
+	// RequireIdentity rejects the requests without the caller identity.
+	RequireIdentity bool
+
+	// Audit receives the audit records of the requests.
+	// If nil, the records are written to stdout as JSON lines.
+	Audit AuditSink
+
+	group    singleflight.Group
+	mu       sync.RWMutex
+	cache    parameterCache
+	negative negativeCache
+	stats    CacheStats
+	svcssm   ssmiface.SSMAPI
+	svckms   kmsAPI
+
+	identityMu sync.Mutex
+	identities map[string]*verifiedIdentity
+
+	credentialsMu sync.Mutex
+	credentials   map[string]aws.CredentialsProvider
+
+	clientsMu sync.Mutex
+	clients   map[string]*hostClient
+
+	// signers are the last parameters of the hosts. they survive evicting and purging the cache,
+	// so the cached tokens and the rotated refresh tokens are taken over by the next parameters.
+	signersMu sync.Mutex
+	signers   map[string]*Parameter
+
+	generationMu      sync.Mutex
+	generation        int64
+	generationChecked time.Time
 }
 
 func (l *Lambda) ssm() ssmiface.SSMAPI {
@@ -38,6 +122,24 @@ func (l *Lambda) ssm() ssmiface.SSMAPI {
 	return l.svcssm
 }
 
+func (l *Lambda) source() Source {
+	if l.Source != nil {
+		return l.Source
+	}
+	return &SSMSource{
+		Config: l.Config,
+		Prefix: l.Prefix,
+		svcssm: l.ssm(),
+	}
+}
+
+func (l *Lambda) ssmTimeout() time.Duration {
+	if l.SSMTimeout > 0 {
+		return l.SSMTimeout
+	}
+	return defaultSSMTimeout
+}
+
 func (l *Lambda) client() *http.Client {
 	if l.Client != nil {
 		return l.Client
@@ -47,36 +149,177 @@ func (l *Lambda) client() *http.Client {
 
 // Handle hanles events of the AWS Lambda.
 func (l *Lambda) Handle(ctx context.Context, req *Request) (*Response, error) {
+	start := time.Now()
+	record := &AuditRecord{
+		Time: start,
+	}
+	if lc, ok := lambdacontext.FromContext(ctx); ok {
+		record.RequestID = lc.AwsRequestID
+	}
+
+	resp, err := l.handle(ctx, req, record)
+
+	record.LatencyMillis = float64(time.Since(start)) / float64(time.Millisecond)
+	if err != nil {
+		record.Error = err.Error()
+	}
+	if resp != nil {
+		record.Status = resp.StatusCode
+	}
+	if err := l.audit().Audit(ctx, record); err != nil {
+		log.Println("failed to write the audit log:", err)
+	}
+	return resp, err
+}
+
+func (l *Lambda) handle(ctx context.Context, req *Request, record *AuditRecord) (response *Response, err error) {
+	identity := &req.RequestContext.Identity
+	identityErr := l.verifyIdentity(ctx, identity)
+	record.Caller = newAuditCaller(&req.RequestContext)
+	if identityErr != nil {
+		// continue with the empty identity, unless the identity is required.
+		record.IdentityError = identityErr.Error()
+		if l.RequireIdentity {
+			return record.reject(http.StatusForbidden, "failed to verify the caller identity: "+identityErr.Error()), nil
+		}
+	}
+	if l.RequireIdentity && identity.ARN == "" {
+		return record.reject(http.StatusForbidden, "the caller identity is required"), nil
+	}
+
 	httpreq, err := req.Request()
 	if err != nil {
 		return nil, err
 	}
 	httpreq = httpreq.WithContext(ctx)
+	record.Host = httpreq.Header.Get("Host")
+	record.Method = httpreq.Method
+	record.Path = pathTemplate(httpreq.URL.Path)
 
 	param, err := l.getParam(ctx, httpreq.Header.Get("Host"))
 	if err != nil {
-		if err == errParamNotFound {
-			return &Response{
-				StatusCode: http.StatusProxyAuthRequired,
-				Headers: map[string]string{
-					"Content-Type": "text/plain; charset=utf-8",
-				},
-				Body: "any parameters for signing is not found in AWS System Manager Parameter Store\n",
-			}, nil
+		if err == ErrParamNotFound {
+			resp := record.reject(http.StatusProxyAuthRequired, "any parameters for signing is not found in AWS System Manager Parameter Store")
+			resp.Headers[headerUnsigned] = "true"
+			return resp, nil
 		}
 		return nil, err
 	}
-	if err := param.Sign(httpreq); err != nil {
+	// the errors may contain the secret values, e.g. the url with the queries.
+	defer func() {
+		if err != nil {
+			err = param.errorRedactor().Error(err)
+		}
+	}()
+
+	if identityErr != nil && param.ACL.requiresIdentity() {
+		return record.reject(http.StatusForbidden, "failed to verify the caller identity: "+identityErr.Error()), nil
+	}
+	if err := param.ACL.Allow(&req.RequestContext); err != nil {
+		return record.reject(http.StatusForbidden, err.Error()), nil
+	}
+
+	// evaluate the policy before signing, because getting tokens and signing have side effects.
+	if err := param.rewrite(httpreq); err != nil {
+		return nil, err
+	}
+	record.Parameters = param.Names
+	if err := param.Policy.Evaluate(httpreq.Method, httpreq.URL); err != nil {
+		return record.reject(http.StatusForbidden, err.Error()), nil
+	}
+	decode, err := signRequest(httpreq, param)
+	if err != nil {
 		return nil, err
 	}
 
-	resp, err := l.client().Do(httpreq)
+	client, err := l.upstreamClient(param)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := client.Do(httpreq)
 	if err != nil {
 		return nil, err
 	}
+	if resp.StatusCode == http.StatusUnauthorized && param.retryUnauthorized(resp) {
+		// the token may be revoked, or the server sends a new digest challenge.
+		// retry once with the new credentials.
+		io.Copy(ioutil.Discard, resp.Body)
+		resp.Body.Close()
+		httpreq, err = req.Request()
+		if err != nil {
+			return nil, err
+		}
+		httpreq = httpreq.WithContext(ctx)
+		if err := param.rewrite(httpreq); err != nil {
+			return nil, err
+		}
+		decode, err = signRequest(httpreq, param)
+		if err != nil {
+			return nil, err
+		}
+		resp, err = client.Do(httpreq)
+		if err != nil {
+			return nil, err
+		}
+	}
 	defer resp.Body.Close()
+	redact := param.redactor()
+	record.UpstreamStatus = resp.StatusCode
+	if decode {
+		if err := decodeContentEncoding(resp); err != nil {
+			return nil, err
+		}
+	}
+	if param.redactResponse() {
+		if err := redact.Response(resp); err != nil {
+			return nil, err
+		}
+	}
+
+	response, err = NewResponse(resp)
+	if err != nil {
+		return nil, err
+	}
+	// the header is only for the function. the upstream must not mark the host as unsigned.
+	removeUnsignedHeader(response)
+	response.AcceptBodyEncodings = supportedBodyEncodings
+	if acceptsBodyEncoding(req.AcceptBodyEncodings, BodyEncodingGzip) {
+		if err := response.Compress(); err != nil {
+			return nil, err
+		}
+	}
+	return response, nil
+}
+
+// signRequest prepares the request rewritten by Parameter.rewrite for the upstream, and signs it.
+// It reports whether the response should be decoded by decodeContentEncoding.
+func signRequest(req *http.Request, param *Parameter) (bool, error) {
+	// the headers must be fixed before signing, because some signatures cover them.
+	if param.redactResponse() {
+		// the body must be decodable for redacting it.
+		restrictAcceptEncoding(req)
+	}
+	decode := requestContentEncoding(req)
+	if err := param.authenticate(req); err != nil {
+		return false, err
+	}
+	return decode, nil
+}
+
+// reject records the reason, and returns the error response.
+func (record *AuditRecord) reject(code int, reason string) *Response {
+	record.Reason = reason
+	return newErrorResponse(code, reason)
+}
 
-	return NewResponse(resp)
+func newErrorResponse(code int, msg string) *Response {
+	return &Response{
+		StatusCode: code,
+		Headers: map[string]string{
+			"Content-Type": "text/plain; charset=utf-8",
+		},
+		Body: msg + "\n",
+	}
 }
 
 // Parameter is parameter for signing.
@@ -93,16 +336,65 @@ type Parameter struct {
 
 	// general queries
 	Queries url.Values
+
+	// the callers allowed to use the parameters
+	ACL *ACL
+
+	// the methods and the paths allowed to use the parameters
+	Policy *Policy
+
+	// get access tokens with OAuth 2.0
+	OAuth2 *OAuth2
+
+	// mint JSON Web Tokens
+	JWT *JWT
+
+	// get installation access tokens of GitHub App
+	GitHubApp *GitHubApp
+
+	// answer the challenge of HTTP Digest Access Authentication
+	Digest *Digest
+
+	// sign the request with AWS Signature Version 4
+	SigV4 *SigV4
+
+	// sign the request with HMAC
+	HMAC *HMAC
+
+	// sign the request with HTTP Message Signatures
+	HTTPSignature *HTTPSignature
+
+	// authenticate with the TLS client certificate
+	MTLS *MTLS
+
+	// CacheTTL overrides Lambda.CacheTTL. It is set by the parameter cache/ttl, e.g. "1m".
+	CacheTTL time.Duration
+
+	// RedactResponse redacts the secret values echoed in the response headers and body.
+	// It is enabled by default, and the parameter redact/response "false" disables it.
+	RedactResponse bool
+
+	// RedactValues are the additional values to be redacted. It is set by the parameter redact/values.
+	RedactValues []string
+
+	// Names are the names of the parameters, e.g. "headers/Authorization".
+	// They are recorded in the audit logs instead of the values.
+	Names []string
+
+	redact *redactor
 }
 
 // Sign adds authentication information to the request.
 func (p *Parameter) Sign(req *http.Request) error {
-	for k := range p.Headers {
-		req.Header.Set(k, p.Headers.Get(k))
-	}
-	if p.User != "" {
-		req.SetBasicAuth(p.User, p.Password)
+	if err := p.rewrite(req); err != nil {
+		return err
 	}
+	return p.authenticate(req)
+}
+
+// rewrite rewrites the path and the queries of the request.
+// It has no side effects, so the policy can evaluate the result before authenticate.
+func (p *Parameter) rewrite(req *http.Request) error {
 	if path := p.Path; path != "" {
 		if path[0] != '/' {
 			path = "/" + path
@@ -123,84 +415,185 @@ func (p *Parameter) Sign(req *http.Request) error {
 	return nil
 }
 
-func (l *Lambda) getParam(ctx context.Context, host string) (*Parameter, error) {
-	host = strings.ToLower(host)
-	result := l.group.DoChan(host, func() (interface{}, error) {
-		// search from the cache.
-		l.mu.RLock()
-		if l.cache != nil && l.cache[host] != nil {
-			l.mu.RUnlock()
-			return l.cache[host], nil
-		}
-		l.mu.RUnlock()
-
-		// get from AWS SSM Parameter Store.
-		parameter := &Parameter{}
-		base := path.Join("/", l.Prefix, host)
-
-		svc := l.ssm()
-		req := svc.GetParametersByPathRequest(&ssm.GetParametersByPathInput{
-			Path:           aws.String(base),
-			Recursive:      aws.Bool(true),
-			WithDecryption: aws.Bool(true),
-		})
-		req.SetContext(context.Background())
-		pager := req.Paginate()
-		cnt := 0
-		for pager.Next() {
-			resp := pager.CurrentPage()
-			for _, param := range resp.Parameters {
-				cnt++
-				name := strings.TrimPrefix(aws.StringValue(param.Name), base+"/")
-				name = strings.TrimSuffix(name, "/")
-				idx := strings.IndexByte(name, '/')
-				if idx < 0 {
-					continue
-				}
-				typ := name[:idx]
-				name = name[idx+1:]
-				switch typ {
-				case "headers":
-					if parameter.Headers == nil {
-						parameter.Headers = http.Header{}
-					}
-					parameter.Headers.Set(name, aws.StringValue(param.Value))
-				case "basic":
-					switch name {
-					case "username":
-						parameter.User = aws.StringValue(param.Value)
-					case "password":
-						parameter.Password = aws.StringValue(param.Value)
-					}
-				case "rewrite":
-					switch name {
-					case "path":
-						parameter.Path = aws.StringValue(param.Value)
-					}
-				case "queries":
-					if parameter.Queries == nil {
-						parameter.Queries = url.Values{}
-					}
-					parameter.Queries.Set(name, aws.StringValue(param.Value))
-				}
+// authenticate adds the headers, the tokens and the signatures to the request.
+// It may call the external services, e.g. the token endpoints and AWS KMS.
+func (p *Parameter) authenticate(req *http.Request) error {
+	for k := range p.Headers {
+		req.Header.Set(k, p.Headers.Get(k))
+	}
+	if p.User != "" {
+		req.SetBasicAuth(p.User, p.Password)
+	}
+
+	if p.OAuth2 != nil {
+		if err := p.OAuth2.Sign(req); err != nil {
+			return err
+		}
+	}
+	if p.JWT != nil {
+		if err := p.JWT.Sign(req); err != nil {
+			return err
+		}
+	}
+	if p.GitHubApp != nil {
+		if err := p.GitHubApp.Sign(req); err != nil {
+			return err
+		}
+	}
+	if p.Digest != nil {
+		if err := p.Digest.Sign(req); err != nil {
+			return err
+		}
+	}
+
+	// the signatures must be the last, because they sign the final request.
+	if p.SigV4 != nil {
+		if err := p.SigV4.Sign(req); err != nil {
+			return err
+		}
+	}
+	if p.HMAC != nil {
+		if err := p.HMAC.Sign(req); err != nil {
+			return err
+		}
+	}
+	if p.HTTPSignature != nil {
+		if err := p.HTTPSignature.Sign(req); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// newParameter returns a new Parameter with the default settings.
+func newParameter() *Parameter {
+	return &Parameter{
+		RedactResponse: true,
+	}
+}
+
+// set sets the parameter {typ}/{name}.
+func (p *Parameter) set(typ, name, value string) {
+	p.Names = append(p.Names, typ+"/"+name)
+	switch typ {
+	case "headers":
+		if p.Headers == nil {
+			p.Headers = http.Header{}
+		}
+		p.Headers.Set(name, value)
+	case "basic":
+		switch name {
+		case "username":
+			p.User = value
+		case "password":
+			p.Password = value
+		}
+	case "rewrite":
+		switch name {
+		case "path":
+			p.Path = value
+		}
+	case "queries":
+		if p.Queries == nil {
+			p.Queries = url.Values{}
+		}
+		p.Queries.Set(name, value)
+	case "acl":
+		if p.ACL == nil {
+			p.ACL = &ACL{}
+		}
+		p.ACL.set(name, value)
+	case "policy":
+		if p.Policy == nil {
+			p.Policy = &Policy{}
+		}
+		p.Policy.set(name, value)
+	case "oauth2":
+		if p.OAuth2 == nil {
+			p.OAuth2 = &OAuth2{}
+		}
+		p.OAuth2.set(name, value)
+	case "jwt":
+		if p.JWT == nil {
+			p.JWT = &JWT{}
+		}
+		p.JWT.set(name, value)
+	case "github":
+		if p.GitHubApp == nil {
+			p.GitHubApp = &GitHubApp{}
+		}
+		p.GitHubApp.set(name, value)
+	case "digest":
+		if p.Digest == nil {
+			p.Digest = &Digest{}
+		}
+		p.Digest.set(name, value)
+	case "sigv4":
+		if p.SigV4 == nil {
+			p.SigV4 = &SigV4{}
+		}
+		p.SigV4.set(name, value)
+	case "hmac":
+		if p.HMAC == nil {
+			p.HMAC = &HMAC{}
+		}
+		p.HMAC.set(name, value)
+	case "httpsig":
+		if p.HTTPSignature == nil {
+			p.HTTPSignature = &HTTPSignature{}
+		}
+		p.HTTPSignature.set(name, value)
+	case "mtls":
+		if p.MTLS == nil {
+			p.MTLS = &MTLS{}
+		}
+		p.MTLS.set(name, value)
+	case "cache":
+		switch name {
+		case "ttl":
+			if v, err := time.ParseDuration(value); err == nil {
+				p.CacheTTL = v
 			}
 		}
-		if cnt == 0 {
-			return nil, errParamNotFound
+	case "redact":
+		switch name {
+		case "response":
+			if v, err := strconv.ParseBool(value); err == nil {
+				p.RedactResponse = v
+			}
+		case "values":
+			p.RedactValues = splitList(value)
 		}
+	}
+}
 
-		// set to the cache.
-		l.mu.Lock()
-		defer l.mu.Unlock()
-		if l.cache == nil {
-			l.cache = make(map[string]*Parameter)
+func (l *Lambda) getParam(ctx context.Context, host string) (*Parameter, error) {
+	host = strings.ToLower(host)
+	l.checkGeneration(ctx)
+	now := time.Now()
+	entry, cached := l.getCache(host, now)
+	if cached && !entry.expired(now) {
+		if entry.shouldRefresh(now) {
+			// refresh in background, and use the current parameter until it expires.
+			l.group.DoChan(host, func() (interface{}, error) {
+				return l.fetchParam(host)
+			})
 		}
-		l.cache[host] = parameter
-		return parameter, nil
+		return entry.param, nil
+	}
+	if !cached && l.isUnknownHost(host) {
+		return nil, ErrParamNotFound
+	}
+
+	result := l.group.DoChan(host, func() (interface{}, error) {
+		return l.fetchParam(host)
 	})
 	select {
 	case r := <-result:
 		if r.Err != nil {
+			if cached && r.Err != ErrParamNotFound && l.useStale(entry, now) {
+				return entry.param, nil
+			}
 			return nil, r.Err
 		}
 		return r.Val.(*Parameter), nil
@@ -208,3 +601,58 @@ func (l *Lambda) getParam(ctx context.Context, host string) (*Parameter, error)
 		return nil, ctx.Err()
 	}
 }
+
+// initParam sets up the signers of the parameter.
+// The cached tokens are taken over from old, which is the previous parameter of the host.
+func (l *Lambda) initParam(host string, p, old *Parameter) {
+	if old == nil {
+		old = &Parameter{}
+	}
+	p.redact = newRedactor(p.secrets())
+	if p.OAuth2 != nil {
+		p.OAuth2.init(l.client(), old.OAuth2)
+	}
+	if p.JWT != nil {
+		p.JWT.init(l.client(), l.kms(), old.JWT)
+	}
+	if p.GitHubApp != nil {
+		p.GitHubApp.init(l.client(), l.kms(), old.GitHubApp)
+	}
+	if p.Digest != nil {
+		p.Digest.init(old.Digest)
+	}
+	if p.SigV4 != nil {
+		p.SigV4.credentials = l.assumeRoleCredentials(p.SigV4.RoleARN, p.SigV4.ExternalID)
+	}
+	if p.HMAC != nil {
+		p.HMAC.init(l.kms())
+	}
+	if p.HTTPSignature != nil {
+		p.HTTPSignature.init(l.kms())
+	}
+	if p.MTLS != nil {
+		p.MTLS.client, p.MTLS.err = l.mtlsClient(host, p.MTLS)
+	}
+}
+
+// fetchParam gets the parameter of the host from the source, and caches it.
+func (l *Lambda) fetchParam(host string) (*Parameter, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), l.ssmTimeout())
+	defer cancel()
+
+	parameter, err := l.source().GetParameter(ctx, host)
+	if err == ErrParamNotFound {
+		l.removeCache(host)
+		l.removeSigner(host)
+		l.addUnknownHost(host)
+		return nil, err
+	}
+	if err != nil {
+		return nil, err
+	}
+	l.initParam(host, parameter, l.swapSigner(host, parameter))
+
+	// set to the cache.
+	l.setCache(host, parameter)
+	return parameter, nil
+}
@@ -17,6 +17,10 @@ type ssmMock struct {
 	ssmiface.SSMAPI
 	input  *ssm.GetParametersByPathInput
 	output *ssm.GetParametersByPathOutput
+	calls  int
+
+	// errs[i] is returned by the (i+1)-th call.
+	errs []error
 }
 
 func TestLambdaHandle(t *testing.T) {
@@ -282,6 +286,11 @@ func TestLambdaHandle(t *testing.T) {
 
 func (mock *ssmMock) GetParametersByPathRequest(input *ssm.GetParametersByPathInput) ssm.GetParametersByPathRequest {
 	mock.input = input
+	mock.calls++
+	var err error
+	if mock.calls <= len(mock.errs) {
+		err = mock.errs[mock.calls-1]
+	}
 	return ssm.GetParametersByPathRequest{
 		Request: &aws.Request{
 			Data:        mock.output,
@@ -295,6 +304,7 @@ func (mock *ssmMock) GetParametersByPathRequest(input *ssm.GetParametersByPathIn
 					Data:        mock.output,
 					HTTPRequest: &http.Request{},
 					Operation:   &aws.Operation{},
+					Error:       err,
 				},
 				Input: &ssm.GetParametersByPathInput{},
 			}
@@ -0,0 +1,321 @@
+package proxy
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+const (
+	defaultIMDSEndpoint            = "http://169.254.169.254"
+	defaultPodInfoDir              = "/etc/podinfo"
+	defaultServiceAccountDir       = "/var/run/secrets/kubernetes.io/serviceaccount"
+	defaultMetadataTimeout         = time.Second
+	defaultMetadataRefreshInterval = 10 * time.Minute
+
+	// imdsTokenTTL is the lifetime of IMDSv2 session tokens in seconds.
+	imdsTokenTTL = "21600"
+)
+
+// Metadata collects the InstanceContext of the host running the proxy.
+type Metadata struct {
+	// Client is used for accessing the metadata services.
+	// If nil, http.DefaultClient is used.
+	Client *http.Client
+
+	// IMDSEndpoint is the endpoint of EC2 Instance Metadata Service.
+	// The default is http://169.254.169.254.
+	IMDSEndpoint string
+
+	// DisableIMDS disables EC2 Instance Metadata Service.
+	// It avoids waiting for the timeout on the hosts out of EC2.
+	DisableIMDS bool
+
+	// ECSEndpoint is the endpoint of ECS task metadata.
+	// The default is the value of ECS_CONTAINER_METADATA_URI_V4 or ECS_CONTAINER_METADATA_URI.
+	ECSEndpoint string
+
+	// PodInfoDir is the directory where Kubernetes Downward API puts the files "name" and "namespace".
+	// The default is /etc/podinfo.
+	// The environment values POD_NAME and POD_NAMESPACE take precedence over the files.
+	PodInfoDir string
+
+	// ServiceAccountDir is the directory of the Kubernetes service account.
+	// The default is /var/run/secrets/kubernetes.io/serviceaccount.
+	ServiceAccountDir string
+
+	// Tags are the static tags added to the InstanceContext.
+	Tags map[string]string
+
+	// Timeout is the timeout for each metadata service.
+	// The default is 1 second.
+	Timeout time.Duration
+
+	getenv   func(string) string
+	hostname func() (string, error)
+}
+
+func (m *Metadata) client() *http.Client {
+	if m.Client != nil {
+		return m.Client
+	}
+	return http.DefaultClient
+}
+
+func (m *Metadata) imdsEndpoint() string {
+	if m.IMDSEndpoint != "" {
+		return strings.TrimSuffix(m.IMDSEndpoint, "/")
+	}
+	return defaultIMDSEndpoint
+}
+
+func (m *Metadata) ecsEndpoint() string {
+	if m.ECSEndpoint != "" {
+		return strings.TrimSuffix(m.ECSEndpoint, "/")
+	}
+	if uri := m.getenvValue("ECS_CONTAINER_METADATA_URI_V4"); uri != "" {
+		return uri
+	}
+	return m.getenvValue("ECS_CONTAINER_METADATA_URI")
+}
+
+func (m *Metadata) podInfoDir() string {
+	if m.PodInfoDir != "" {
+		return m.PodInfoDir
+	}
+	return defaultPodInfoDir
+}
+
+func (m *Metadata) serviceAccountDir() string {
+	if m.ServiceAccountDir != "" {
+		return m.ServiceAccountDir
+	}
+	return defaultServiceAccountDir
+}
+
+func (m *Metadata) timeout() time.Duration {
+	if m.Timeout > 0 {
+		return m.Timeout
+	}
+	return defaultMetadataTimeout
+}
+
+func (m *Metadata) getenvValue(key string) string {
+	if m.getenv != nil {
+		return m.getenv(key)
+	}
+	return os.Getenv(key)
+}
+
+func (m *Metadata) getHostname() (string, error) {
+	if m.hostname != nil {
+		return m.hostname()
+	}
+	return os.Hostname()
+}
+
+// InstanceContext collects the InstanceContext.
+// The sources which are not available are ignored.
+func (m *Metadata) InstanceContext(ctx context.Context) InstanceContext {
+	var ic InstanceContext
+	if name, err := m.getHostname(); err == nil {
+		ic.Hostname = name
+	}
+	if !m.DisableIMDS {
+		if id, err := m.instanceID(ctx); err == nil {
+			ic.InstanceID = id
+		}
+	}
+	if endpoint := m.ecsEndpoint(); endpoint != "" {
+		if task, err := m.ecsTask(ctx, endpoint); err == nil {
+			ic.TaskARN = task.TaskARN
+			ic.Cluster = task.Cluster
+		}
+	}
+	ic.PodName, ic.PodNamespace = m.pod()
+	if len(m.Tags) > 0 {
+		ic.Tags = make(map[string]string, len(m.Tags))
+		for k, v := range m.Tags {
+			ic.Tags[k] = v
+		}
+	}
+	return ic
+}
+
+// instanceID gets the instance id using IMDSv2.
+func (m *Metadata) instanceID(ctx context.Context) (string, error) {
+	ctx, cancel := context.WithTimeout(ctx, m.timeout())
+	defer cancel()
+
+	req, err := http.NewRequest(http.MethodGet, m.imdsEndpoint()+"/latest/meta-data/instance-id", nil)
+	if err != nil {
+		return "", err
+	}
+	token, err := m.imdsToken(ctx)
+	if err == nil {
+		req.Header.Set("X-Aws-Ec2-Metadata-Token", token)
+	} else if err != errIMDSv2NotSupported {
+		return "", err
+	}
+	// fallback to IMDSv1 if IMDSv2 is not supported.
+	return m.get(ctx, req)
+}
+
+var errIMDSv2NotSupported = errors.New("proxy: IMDSv2 is not supported")
+
+func (m *Metadata) imdsToken(ctx context.Context) (string, error) {
+	req, err := http.NewRequest(http.MethodPut, m.imdsEndpoint()+"/latest/api/token", nil)
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("X-Aws-Ec2-Metadata-Token-Ttl-Seconds", imdsTokenTTL)
+	req = req.WithContext(ctx)
+	resp, err := m.client().Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusOK:
+	case http.StatusNotFound, http.StatusMethodNotAllowed:
+		io.Copy(ioutil.Discard, resp.Body)
+		return "", errIMDSv2NotSupported
+	default:
+		io.Copy(ioutil.Discard, resp.Body)
+		return "", errors.New("proxy: failed to get IMDSv2 token: " + resp.Status)
+	}
+	token, err := readString(resp.Body)
+	if err != nil {
+		return "", err
+	}
+	return token, nil
+}
+
+type ecsTask struct {
+	Cluster string `json:"Cluster"`
+	TaskARN string `json:"TaskARN"`
+}
+
+// ecsTask gets the task metadata of ECS.
+func (m *Metadata) ecsTask(ctx context.Context, endpoint string) (*ecsTask, error) {
+	ctx, cancel := context.WithTimeout(ctx, m.timeout())
+	defer cancel()
+
+	req, err := http.NewRequest(http.MethodGet, endpoint+"/task", nil)
+	if err != nil {
+		return nil, err
+	}
+	body, err := m.get(ctx, req)
+	if err != nil {
+		return nil, err
+	}
+	var task ecsTask
+	if err := json.Unmarshal([]byte(body), &task); err != nil {
+		return nil, err
+	}
+	return &task, nil
+}
+
+// pod returns the name and the namespace of the Kubernetes pod.
+func (m *Metadata) pod() (name, namespace string) {
+	name = m.getenvValue("POD_NAME")
+	if name == "" {
+		name = readFile(filepath.Join(m.podInfoDir(), "name"))
+	}
+	namespace = m.getenvValue("POD_NAMESPACE")
+	if namespace == "" {
+		namespace = readFile(filepath.Join(m.podInfoDir(), "namespace"))
+	}
+	if namespace == "" {
+		namespace = readFile(filepath.Join(m.serviceAccountDir(), "namespace"))
+	}
+	if name == "" && namespace != "" {
+		// the hostname of the pod is its name by default.
+		if hostname, err := m.getHostname(); err == nil {
+			name = hostname
+		}
+	}
+	return
+}
+
+func (m *Metadata) get(ctx context.Context, req *http.Request) (string, error) {
+	req = req.WithContext(ctx)
+	resp, err := m.client().Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		io.Copy(ioutil.Discard, resp.Body)
+		return "", errors.New("proxy: unexpected status: " + resp.Status)
+	}
+	return readString(resp.Body)
+}
+
+func readString(r io.Reader) (string, error) {
+	var builder strings.Builder
+	if _, err := io.Copy(&builder, r); err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(builder.String()), nil
+}
+
+func readFile(name string) string {
+	data, err := ioutil.ReadFile(name)
+	if err != nil {
+		return ""
+	}
+	return strings.TrimSpace(string(data))
+}
+
+func (p *Proxy) metadata() *Metadata {
+	if p.Metadata != nil {
+		return p.Metadata
+	}
+	return &Metadata{}
+}
+
+func (p *Proxy) metadataRefreshInterval() time.Duration {
+	if p.MetadataRefreshInterval > 0 {
+		return p.MetadataRefreshInterval
+	}
+	return defaultMetadataRefreshInterval
+}
+
+// getInstanceContext returns the InstanceContext.
+// The first call collects it synchronously, and the following calls refresh it in background.
+func (p *Proxy) getInstanceContext(ctx context.Context) InstanceContext {
+	p.instanceMu.Lock()
+	defer p.instanceMu.Unlock()
+
+	now := time.Now()
+	if p.instanceExpires.IsZero() {
+		p.instanceContext = p.metadata().InstanceContext(ctx)
+		p.instanceExpires = now.Add(p.metadataRefreshInterval())
+		return p.instanceContext
+	}
+	if now.After(p.instanceExpires) && !p.instanceRefreshing {
+		p.instanceRefreshing = true
+		go p.refreshInstanceContext()
+	}
+	return p.instanceContext
+}
+
+func (p *Proxy) refreshInstanceContext() {
+	ic := p.metadata().InstanceContext(context.Background())
+
+	p.instanceMu.Lock()
+	defer p.instanceMu.Unlock()
+	p.instanceContext = ic
+	p.instanceExpires = time.Now().Add(p.metadataRefreshInterval())
+	p.instanceRefreshing = false
+}
@@ -0,0 +1,168 @@
+package proxy
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func newIMDSServer(v1 bool) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		switch req.URL.Path {
+		case "/latest/api/token":
+			if v1 {
+				http.Error(w, "Not Found", http.StatusNotFound)
+				return
+			}
+			if req.Method != http.MethodPut {
+				http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
+				return
+			}
+			if req.Header.Get("X-Aws-Ec2-Metadata-Token-Ttl-Seconds") == "" {
+				http.Error(w, "Bad Request", http.StatusBadRequest)
+				return
+			}
+			fmt.Fprint(w, "very-secret-token")
+		case "/latest/meta-data/instance-id":
+			if !v1 && req.Header.Get("X-Aws-Ec2-Metadata-Token") != "very-secret-token" {
+				http.Error(w, "Unauthorized", http.StatusUnauthorized)
+				return
+			}
+			fmt.Fprint(w, "i-1234567890abcdef0\n")
+		default:
+			http.Error(w, "Not Found", http.StatusNotFound)
+		}
+	}))
+}
+
+func TestMetadataInstanceContext(t *testing.T) {
+	noenv := func(string) string { return "" }
+	hostname := func() (string, error) { return "test-host", nil }
+
+	t.Run("imdsv2", func(t *testing.T) {
+		ts := newIMDSServer(false)
+		defer ts.Close()
+		m := &Metadata{
+			IMDSEndpoint:      ts.URL,
+			PodInfoDir:        "testdata/podinfo-not-found",
+			ServiceAccountDir: "testdata/serviceaccount-not-found",
+			getenv:            noenv,
+			hostname:          hostname,
+		}
+		got := m.InstanceContext(context.Background())
+		want := InstanceContext{
+			InstanceID: "i-1234567890abcdef0",
+			Hostname:   "test-host",
+		}
+		if diff := cmp.Diff(got, want); diff != "" {
+			t.Errorf("InstanceContext differs: (-got +want)\n%s", diff)
+		}
+	})
+
+	t.Run("imdsv1", func(t *testing.T) {
+		ts := newIMDSServer(true)
+		defer ts.Close()
+		m := &Metadata{
+			IMDSEndpoint:      ts.URL,
+			PodInfoDir:        "testdata/podinfo-not-found",
+			ServiceAccountDir: "testdata/serviceaccount-not-found",
+			getenv:            noenv,
+			hostname:          hostname,
+		}
+		got := m.InstanceContext(context.Background())
+		if got.InstanceID != "i-1234567890abcdef0" {
+			t.Errorf("want %s, got %s", "i-1234567890abcdef0", got.InstanceID)
+		}
+	})
+
+	t.Run("ecs", func(t *testing.T) {
+		ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			if req.URL.Path != "/v4/task" {
+				http.Error(w, "Not Found", http.StatusNotFound)
+				return
+			}
+			w.Header().Set("Content-Type", "application/json")
+			fmt.Fprint(w, `{"Cluster":"default","TaskARN":"arn:aws:ecs:us-west-2:111122223333:task/default/158d1c8083dd49d6b527399fd6414f5c"}`)
+		}))
+		defer ts.Close()
+		m := &Metadata{
+			DisableIMDS:       true,
+			PodInfoDir:        "testdata/podinfo-not-found",
+			ServiceAccountDir: "testdata/serviceaccount-not-found",
+			getenv: func(key string) string {
+				if key == "ECS_CONTAINER_METADATA_URI_V4" {
+					return ts.URL + "/v4"
+				}
+				return ""
+			},
+			hostname: hostname,
+		}
+		got := m.InstanceContext(context.Background())
+		want := InstanceContext{
+			Hostname: "test-host",
+			TaskARN:  "arn:aws:ecs:us-west-2:111122223333:task/default/158d1c8083dd49d6b527399fd6414f5c",
+			Cluster:  "default",
+		}
+		if diff := cmp.Diff(got, want); diff != "" {
+			t.Errorf("InstanceContext differs: (-got +want)\n%s", diff)
+		}
+	})
+
+	t.Run("kubernetes-env", func(t *testing.T) {
+		m := &Metadata{
+			DisableIMDS:       true,
+			PodInfoDir:        "testdata/podinfo-not-found",
+			ServiceAccountDir: "testdata/serviceaccount-not-found",
+			getenv: func(key string) string {
+				switch key {
+				case "POD_NAME":
+					return "proxy-5d8f9c7b4-x2x9z"
+				case "POD_NAMESPACE":
+					return "tools"
+				}
+				return ""
+			},
+			hostname: hostname,
+		}
+		got := m.InstanceContext(context.Background())
+		if got.PodName != "proxy-5d8f9c7b4-x2x9z" {
+			t.Errorf("want %s, got %s", "proxy-5d8f9c7b4-x2x9z", got.PodName)
+		}
+		if got.PodNamespace != "tools" {
+			t.Errorf("want %s, got %s", "tools", got.PodNamespace)
+		}
+	})
+
+	t.Run("kubernetes-files", func(t *testing.T) {
+		dir, err := ioutil.TempDir("", "ssm-sign-proxy-")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer os.RemoveAll(dir)
+		if err := ioutil.WriteFile(filepath.Join(dir, "namespace"), []byte("tools\n"), 0644); err != nil {
+			t.Fatal(err)
+		}
+
+		m := &Metadata{
+			DisableIMDS:       true,
+			PodInfoDir:        "testdata/podinfo-not-found",
+			ServiceAccountDir: dir,
+			getenv:            noenv,
+			hostname:          func() (string, error) { return "proxy-5d8f9c7b4-x2x9z", nil },
+		}
+		got := m.InstanceContext(context.Background())
+		if got.PodName != "proxy-5d8f9c7b4-x2x9z" {
+			t.Errorf("want %s, got %s", "proxy-5d8f9c7b4-x2x9z", got.PodName)
+		}
+		if got.PodNamespace != "tools" {
+			t.Errorf("want %s, got %s", "tools", got.PodNamespace)
+		}
+	})
+}
@@ -0,0 +1,117 @@
+package proxy
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"net/http"
+)
+
+// MTLS is the parameter for authenticating with the TLS client certificate.
+type MTLS struct {
+	// Cert is the PEM encoded client certificate, and may contain the intermediate certificates.
+	Cert string
+
+	// Key is the PEM encoded private key of Cert.
+	Key string
+
+	// CA is the PEM encoded certificates of the CAs which verify the server.
+	// If it is empty, the system roots are used.
+	CA string
+
+	client *http.Client
+	err    error
+}
+
+// set sets the parameter mtls/{name}.
+func (m *MTLS) set(name, value string) {
+	switch name {
+	case "cert":
+		m.Cert = value
+	case "key":
+		m.Key = value
+	case "ca":
+		m.CA = value
+	}
+}
+
+func (m *MTLS) tlsConfig() (*tls.Config, error) {
+	if m.Cert == "" || m.Key == "" {
+		return nil, errors.New("proxy: mtls/cert and mtls/key are required")
+	}
+	cert, err := tls.X509KeyPair([]byte(m.Cert), []byte(m.Key))
+	if err != nil {
+		return nil, fmt.Errorf("proxy: invalid mtls/cert or mtls/key: %v", err)
+	}
+	config := &tls.Config{
+		Certificates: []tls.Certificate{cert},
+	}
+	if m.CA != "" {
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM([]byte(m.CA)) {
+			return nil, errors.New("proxy: invalid mtls/ca")
+		}
+		config.RootCAs = pool
+	}
+	return config, nil
+}
+
+// hostClient is the client dedicated to the host.
+type hostClient struct {
+	// key identifies the configuration of the client.
+	key    string
+	client *http.Client
+}
+
+// mtlsClient returns the client with the client certificate for the host.
+// The clients are cached until the parameter changes, to reuse the connections.
+func (l *Lambda) mtlsClient(host string, m *MTLS) (*http.Client, error) {
+	key := m.Cert + "\n" + m.Key + "\n" + m.CA
+
+	l.clientsMu.Lock()
+	defer l.clientsMu.Unlock()
+	if c, ok := l.clients[host]; ok {
+		if c.key == key {
+			return c.client, nil
+		}
+		c.client.CloseIdleConnections()
+		delete(l.clients, host)
+	}
+
+	config, err := m.tlsConfig()
+	if err != nil {
+		return nil, err
+	}
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.TLSClientConfig = config
+	base := l.client()
+	client := &http.Client{
+		Transport:     transport,
+		CheckRedirect: base.CheckRedirect,
+		Jar:           base.Jar,
+		Timeout:       base.Timeout,
+	}
+	if l.clients == nil {
+		l.clients = make(map[string]*hostClient)
+	}
+	l.clients[host] = &hostClient{
+		key:    key,
+		client: client,
+	}
+	return client, nil
+}
+
+// upstreamClient returns the client for sending the request to the upstream.
+func (l *Lambda) upstreamClient(param *Parameter) (*http.Client, error) {
+	if param.MTLS == nil {
+		return l.client(), nil
+	}
+	if param.MTLS.err != nil {
+		return nil, param.MTLS.err
+	}
+	if param.MTLS.client == nil {
+		return nil, errors.New("proxy: the client for mtls is not configured")
+	}
+	return param.MTLS.client, nil
+}
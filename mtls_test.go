@@ -0,0 +1,193 @@
+package proxy
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/ssm"
+)
+
+// newTestCertificate issues a certificate signed by parent.
+// If parent is nil, the certificate is a self-signed CA.
+func newTestCertificate(t *testing.T, name string, parent *x509.Certificate, parentKey *ecdsa.PrivateKey) (*x509.Certificate, *ecdsa.PrivateKey, string, string) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: name},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+	if parent == nil {
+		template.IsCA = true
+		template.BasicConstraintsValid = true
+		template.KeyUsage |= x509.KeyUsageCertSign
+		parent, parentKey = template, key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, parent, &key.PublicKey, parentKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	certPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	keyPEM := pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER})
+	return cert, key, string(certPEM), string(keyPEM)
+}
+
+func TestLambdaMTLS(t *testing.T) {
+	ca, caKey, _, _ := newTestCertificate(t, "test ca", nil, nil)
+	_, _, certPEM, keyPEM := newTestCertificate(t, "test client", ca, caKey)
+	_, _, otherCertPEM, otherKeyPEM := newTestCertificate(t, "other client", ca, caKey)
+
+	ts := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		fmt.Fprint(w, req.TLS.PeerCertificates[0].Subject.CommonName)
+	}))
+	pool := x509.NewCertPool()
+	pool.AddCert(ca)
+	ts.TLS = &tls.Config{
+		ClientAuth: tls.RequireAndVerifyClientCert,
+		ClientCAs:  pool,
+	}
+	// suppress the handshake errors of the requests without the client certificate.
+	ts.Config.ErrorLog = log.New(ioutil.Discard, "", 0)
+	ts.StartTLS()
+	defer ts.Close()
+	serverCA := string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: ts.Certificate().Raw}))
+
+	u, err := url.Parse(ts.URL)
+	if err != nil {
+		panic(err)
+	}
+	newMock := func(cert, key string) *ssmMock {
+		return &ssmMock{
+			output: &ssm.GetParametersByPathOutput{
+				Parameters: []ssm.Parameter{
+					{
+						Name:  aws.String("/" + u.Host + "/mtls/cert"),
+						Value: aws.String(cert),
+					},
+					{
+						Name:  aws.String("/" + u.Host + "/mtls/key"),
+						Value: aws.String(key),
+					},
+					{
+						Name:  aws.String("/" + u.Host + "/mtls/ca"),
+						Value: aws.String(serverCA),
+					},
+				},
+			},
+		}
+	}
+	handle := func(l *Lambda) (*Response, error) {
+		r, err := NewRequest(httptest.NewRequest(http.MethodGet, ts.URL, nil))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return l.Handle(context.Background(), r)
+	}
+
+	t.Run("client certificate", func(t *testing.T) {
+		l := &Lambda{
+			Audit:  &auditMock{},
+			svcssm: newMock(certPEM, keyPEM),
+		}
+		resp, err := handle(l)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if resp.StatusCode != http.StatusOK {
+			t.Errorf("want %d, got %d", http.StatusOK, resp.StatusCode)
+		}
+		if resp.Body != "test client" {
+			t.Errorf("want %s, got %s", "test client", resp.Body)
+		}
+	})
+
+	t.Run("no client certificate", func(t *testing.T) {
+		l := &Lambda{
+			Client: ts.Client(),
+			Audit:  &auditMock{},
+			svcssm: &ssmMock{
+				output: &ssm.GetParametersByPathOutput{
+					Parameters: []ssm.Parameter{
+						{
+							Name:  aws.String("/" + u.Host + "/headers/X-Api-Key"),
+							Value: aws.String("api-key"),
+						},
+					},
+				},
+			},
+		}
+		if _, err := handle(l); err == nil {
+			t.Error("want error, got nil")
+		}
+	})
+
+	t.Run("invalid key", func(t *testing.T) {
+		l := &Lambda{
+			Audit:  &auditMock{},
+			svcssm: newMock(certPEM, otherKeyPEM),
+		}
+		if _, err := handle(l); err == nil {
+			t.Error("want error, got nil")
+		}
+	})
+
+	t.Run("cache", func(t *testing.T) {
+		l := &Lambda{}
+		m := &MTLS{Cert: certPEM, Key: keyPEM, CA: serverCA}
+		c1, err := l.mtlsClient(u.Host, m)
+		if err != nil {
+			t.Fatal(err)
+		}
+		c2, err := l.mtlsClient(u.Host, &MTLS{Cert: certPEM, Key: keyPEM, CA: serverCA})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if c1 != c2 {
+			t.Error("the client is not reused")
+		}
+		c3, err := l.mtlsClient(u.Host, &MTLS{Cert: otherCertPEM, Key: otherKeyPEM, CA: serverCA})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if c1 == c3 {
+			t.Error("the client is reused for the different certificate")
+		}
+		c4, err := l.mtlsClient("example.com", m)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if c1 == c4 {
+			t.Error("the client is shared among the hosts")
+		}
+	})
+}
@@ -0,0 +1,256 @@
+package proxy
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+const (
+	// OAuth2AuthStyleHeader sends the client credentials by the Authorization header.
+	OAuth2AuthStyleHeader = "header"
+
+	// OAuth2AuthStyleParams sends the client credentials in the request body.
+	OAuth2AuthStyleParams = "params"
+)
+
+// OAuth2 is the parameter for getting access tokens with the OAuth 2.0 client credentials grant,
+// or the refresh token grant if RefreshToken is set.
+type OAuth2 struct {
+	TokenURL     string
+	ClientID     string
+	ClientSecret string
+	Scopes       []string
+	Audience     string
+
+	// RefreshToken is the initial refresh token.
+	// If the authorization server rotates it, the new one is written back to the store.
+	RefreshToken string
+
+	// AuthStyle is how the client credentials are sent, OAuth2AuthStyleHeader or OAuth2AuthStyleParams.
+	// The default is OAuth2AuthStyleHeader.
+	AuthStyle string
+
+	client  *http.Client
+	tokens  *tokenCache
+	refresh *refreshToken
+
+	// store is where the rotated refresh token is written back.
+	// version is the version of RefreshToken in the store.
+	store   refreshTokenStore
+	version int64
+}
+
+// set sets the parameter oauth2/{name}.
+func (o *OAuth2) set(name, value string) {
+	switch name {
+	case "token_url":
+		o.TokenURL = value
+	case "client_id":
+		o.ClientID = value
+	case "client_secret":
+		o.ClientSecret = value
+	case "scopes":
+		o.Scopes = strings.FieldsFunc(value, func(r rune) bool {
+			return r == ',' || r == ' ' || r == '\n'
+		})
+	case "audience":
+		o.Audience = value
+	case "refresh_token":
+		o.RefreshToken = value
+	case "auth_style":
+		o.AuthStyle = value
+	}
+}
+
+// sameConfig reports whether o and other get the same tokens.
+// RefreshToken is not compared, because it rotates.
+func (o *OAuth2) sameConfig(other *OAuth2) bool {
+	return o.TokenURL == other.TokenURL &&
+		o.ClientID == other.ClientID &&
+		o.ClientSecret == other.ClientSecret &&
+		strings.Join(o.Scopes, " ") == strings.Join(other.Scopes, " ") &&
+		o.Audience == other.Audience &&
+		o.AuthStyle == other.AuthStyle
+}
+
+// init sets up the token cache. It takes over the tokens from old if it has the same config.
+func (o *OAuth2) init(client *http.Client, old *OAuth2) {
+	o.client = client
+	if old != nil && old.tokens != nil && o.sameConfig(old) {
+		o.tokens = old.tokens
+		o.refresh = old.refresh
+		o.refresh.update(o.RefreshToken, o.version)
+		return
+	}
+	o.tokens = &tokenCache{}
+	o.refresh = &refreshToken{
+		value:   o.RefreshToken,
+		version: o.version,
+	}
+}
+
+// Sign sets the access token to the Authorization header.
+func (o *OAuth2) Sign(req *http.Request) error {
+	if o.tokens == nil {
+		return errors.New("proxy: the token cache for oauth2 is not configured")
+	}
+	token, err := o.tokens.get(req.Context(), o.fetch)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "Bearer "+token)
+	return nil
+}
+
+func (o *OAuth2) fetch(ctx context.Context) (*accessToken, error) {
+	if o.TokenURL == "" {
+		return nil, errors.New("proxy: oauth2/token_url is required")
+	}
+	if o.RefreshToken != "" {
+		return o.fetchByRefreshToken(ctx)
+	}
+
+	v := url.Values{
+		"grant_type": {"client_credentials"},
+	}
+	if len(o.Scopes) > 0 {
+		v.Set("scope", strings.Join(o.Scopes, " "))
+	}
+	if o.Audience != "" {
+		v.Set("audience", o.Audience)
+	}
+	token, err := o.requestToken(ctx, v)
+	if err != nil {
+		return nil, err
+	}
+	return token.accessToken(), nil
+}
+
+func (o *OAuth2) fetchByRefreshToken(ctx context.Context) (*accessToken, error) {
+	current, version := o.refresh.get()
+	token, err := o.requestToken(ctx, o.refreshTokenValues(current))
+	if oerr, ok := err.(*oauth2Error); ok && oerr.Code == "invalid_grant" && o.store != nil {
+		// another container may have rotated the refresh token. reload it and retry.
+		value, v, lerr := o.store.load(ctx)
+		if lerr != nil || value == current {
+			return nil, err
+		}
+		o.refresh.update(value, v)
+		current, version = value, v
+		token, err = o.requestToken(ctx, o.refreshTokenValues(current))
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if token.RefreshToken != "" && token.RefreshToken != current {
+		// the refresh token is rotated. the old one is no longer available.
+		newVersion := version
+		if o.store != nil {
+			newVersion, err = o.store.save(ctx, token.RefreshToken, version)
+			if err != nil {
+				// keep the new token in memory, and try to save it next time.
+				log.Println("failed to save the refresh token:", err)
+				newVersion = version
+			}
+		}
+		o.refresh.set(token.RefreshToken, newVersion)
+	}
+	return token.accessToken(), nil
+}
+
+func (o *OAuth2) refreshTokenValues(refreshToken string) url.Values {
+	v := url.Values{
+		"grant_type":    {"refresh_token"},
+		"refresh_token": {refreshToken},
+	}
+	if len(o.Scopes) > 0 {
+		v.Set("scope", strings.Join(o.Scopes, " "))
+	}
+	return v
+}
+
+// requestToken requests a token to the token endpoint.
+func (o *OAuth2) requestToken(ctx context.Context, v url.Values) (*tokenResponse, error) {
+	switch o.AuthStyle {
+	case "", OAuth2AuthStyleHeader:
+	case OAuth2AuthStyleParams:
+		if o.ClientID != "" {
+			v.Set("client_id", o.ClientID)
+		}
+		if o.ClientSecret != "" {
+			v.Set("client_secret", o.ClientSecret)
+		}
+	default:
+		return nil, fmt.Errorf("proxy: unknown oauth2/auth_style: %q", o.AuthStyle)
+	}
+
+	req, err := http.NewRequest(http.MethodPost, o.TokenURL, strings.NewReader(v.Encode()))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Accept", "application/json")
+	if (o.AuthStyle == "" || o.AuthStyle == OAuth2AuthStyleHeader) && o.ClientID != "" {
+		req.SetBasicAuth(url.QueryEscape(o.ClientID), url.QueryEscape(o.ClientSecret))
+	}
+	resp, err := o.client.Do(req.WithContext(ctx))
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	var token tokenResponse
+	if err := json.NewDecoder(io.LimitReader(resp.Body, 1<<20)).Decode(&token); err != nil {
+		io.Copy(ioutil.Discard, resp.Body)
+		return nil, fmt.Errorf("proxy: failed to get the oauth2 token: %s", resp.Status)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, &oauth2Error{
+			Status: resp.Status,
+			Code:   token.Error,
+		}
+	}
+	if token.AccessToken == "" {
+		return nil, errors.New("proxy: the oauth2 token response has no access_token")
+	}
+	return &token, nil
+}
+
+// oauth2Error is the error response of the token endpoint.
+type oauth2Error struct {
+	Status string
+	Code   string
+}
+
+func (err *oauth2Error) Error() string {
+	return fmt.Sprintf("proxy: failed to get the oauth2 token: %s: %s", err.Status, err.Code)
+}
+
+// tokenResponse is the response of the token endpoint.
+type tokenResponse struct {
+	AccessToken  string `json:"access_token"`
+	TokenType    string `json:"token_type"`
+	RefreshToken string `json:"refresh_token"`
+	ExpiresIn    int64  `json:"expires_in"`
+	Error        string `json:"error"`
+}
+
+func (t *tokenResponse) accessToken() *accessToken {
+	token := &accessToken{
+		Value: t.AccessToken,
+	}
+	if t.ExpiresIn > 0 {
+		token.Expires = timeNow().Add(time.Duration(t.ExpiresIn) * time.Second)
+	}
+	return token
+}
@@ -0,0 +1,405 @@
+package proxy
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/ssm"
+)
+
+// fakeTokenServer issues "token-1", "token-2", ... for the client credentials grant.
+type fakeTokenServer struct {
+	issued int32
+	form   url.Values
+	mu     sync.Mutex
+}
+
+func (s *fakeTokenServer) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	if err := req.ParseForm(); err != nil {
+		panic(err)
+	}
+	s.mu.Lock()
+	s.form = req.PostForm
+	s.mu.Unlock()
+
+	id, secret, ok := req.BasicAuth()
+	if !ok {
+		id, secret = req.PostForm.Get("client_id"), req.PostForm.Get("client_secret")
+	}
+	if id != "client-id" || secret != "client-secret" {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusUnauthorized)
+		fmt.Fprint(w, `{"error":"invalid_client"}`)
+		return
+	}
+	n := atomic.AddInt32(&s.issued, 1)
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"access_token": fmt.Sprintf("token-%d", n),
+		"token_type":   "bearer",
+		"expires_in":   3600,
+	})
+}
+
+func newOAuth2Mock(host, tokenURL string, params ...ssm.Parameter) *ssmMock {
+	return &ssmMock{
+		output: &ssm.GetParametersByPathOutput{
+			Parameters: append([]ssm.Parameter{
+				{
+					Name:  aws.String("/" + host + "/oauth2/token_url"),
+					Value: aws.String(tokenURL),
+				},
+				{
+					Name:  aws.String("/" + host + "/oauth2/client_id"),
+					Value: aws.String("client-id"),
+				},
+				{
+					Name:  aws.String("/" + host + "/oauth2/client_secret"),
+					Value: aws.String("client-secret"),
+				},
+			}, params...),
+		},
+	}
+}
+
+func TestLambdaOAuth2(t *testing.T) {
+	t.Run("client credentials", func(t *testing.T) {
+		tokenServer := &fakeTokenServer{}
+		auth := httptest.NewTLSServer(tokenServer)
+		defer auth.Close()
+		ts := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			if got := req.Header.Get("Authorization"); got != "Bearer token-1" {
+				t.Errorf("want %s, got %s", "Bearer token-1", got)
+			}
+			fmt.Fprint(w, "ok")
+		}))
+		defer ts.Close()
+		u, err := url.Parse(ts.URL)
+		if err != nil {
+			panic(err)
+		}
+
+		l := &Lambda{
+			Client: ts.Client(),
+			Audit:  &auditMock{},
+			svcssm: newOAuth2Mock(u.Host, auth.URL+"/token",
+				ssm.Parameter{
+					Name:  aws.String("/" + u.Host + "/oauth2/scopes"),
+					Value: aws.String("read,write"),
+				},
+				ssm.Parameter{
+					Name:  aws.String("/" + u.Host + "/oauth2/audience"),
+					Value: aws.String("https://api.example.com"),
+				},
+			),
+		}
+		for i := 0; i < 3; i++ {
+			r, err := NewRequest(httptest.NewRequest(http.MethodGet, ts.URL, nil))
+			if err != nil {
+				t.Fatal(err)
+			}
+			resp, err := l.Handle(context.Background(), r)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if resp.StatusCode != http.StatusOK {
+				t.Errorf("want %d, got %d", http.StatusOK, resp.StatusCode)
+			}
+		}
+		if tokenServer.issued != 1 {
+			t.Errorf("want %d, got %d", 1, tokenServer.issued)
+		}
+		if got := tokenServer.form.Get("grant_type"); got != "client_credentials" {
+			t.Errorf("want %s, got %s", "client_credentials", got)
+		}
+		if got := tokenServer.form.Get("scope"); got != "read write" {
+			t.Errorf("want %s, got %s", "read write", got)
+		}
+		if got := tokenServer.form.Get("audience"); got != "https://api.example.com" {
+			t.Errorf("want %s, got %s", "https://api.example.com", got)
+		}
+	})
+
+	t.Run("denied by policy", func(t *testing.T) {
+		tokenServer := &fakeTokenServer{}
+		auth := httptest.NewTLSServer(tokenServer)
+		defer auth.Close()
+		ts := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			t.Error("the denied request must not be sent")
+		}))
+		defer ts.Close()
+		u, err := url.Parse(ts.URL)
+		if err != nil {
+			panic(err)
+		}
+
+		l := &Lambda{
+			Client: ts.Client(),
+			Audit:  &auditMock{},
+			svcssm: newOAuth2Mock(u.Host, auth.URL+"/token",
+				ssm.Parameter{
+					Name:  aws.String("/" + u.Host + "/policy/deny"),
+					Value: aws.String("deny * /**"),
+				},
+			),
+		}
+		r, err := NewRequest(httptest.NewRequest(http.MethodGet, ts.URL, nil))
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp, err := l.Handle(context.Background(), r)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if resp.StatusCode != http.StatusForbidden {
+			t.Errorf("want %d, got %d", http.StatusForbidden, resp.StatusCode)
+		}
+		// the token is not fetched for the denied request.
+		if tokenServer.issued != 0 {
+			t.Errorf("want %d, got %d", 0, tokenServer.issued)
+		}
+	})
+
+	t.Run("always unauthorized", func(t *testing.T) {
+		tokenServer := &fakeTokenServer{}
+		auth := httptest.NewTLSServer(tokenServer)
+		defer auth.Close()
+		ts := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			// the endpoint rejects any tokens.
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		}))
+		defer ts.Close()
+		u, err := url.Parse(ts.URL)
+		if err != nil {
+			panic(err)
+		}
+
+		l := &Lambda{
+			Client: ts.Client(),
+			Audit:  &auditMock{},
+			svcssm: newOAuth2Mock(u.Host, auth.URL+"/token"),
+		}
+		for i := 0; i < 5; i++ {
+			r, err := NewRequest(httptest.NewRequest(http.MethodGet, ts.URL, nil))
+			if err != nil {
+				t.Fatal(err)
+			}
+			resp, err := l.Handle(context.Background(), r)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if resp.StatusCode != http.StatusUnauthorized {
+				t.Errorf("want %d, got %d", http.StatusUnauthorized, resp.StatusCode)
+			}
+		}
+		// the token is refreshed only once in the interval.
+		if tokenServer.issued != 2 {
+			t.Errorf("want %d, got %d", 2, tokenServer.issued)
+		}
+	})
+
+	t.Run("auth style params", func(t *testing.T) {
+		tokenServer := &fakeTokenServer{}
+		auth := httptest.NewTLSServer(tokenServer)
+		defer auth.Close()
+		ts := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			fmt.Fprint(w, "ok")
+		}))
+		defer ts.Close()
+		u, err := url.Parse(ts.URL)
+		if err != nil {
+			panic(err)
+		}
+
+		l := &Lambda{
+			Client: ts.Client(),
+			Audit:  &auditMock{},
+			svcssm: newOAuth2Mock(u.Host, auth.URL+"/token", ssm.Parameter{
+				Name:  aws.String("/" + u.Host + "/oauth2/auth_style"),
+				Value: aws.String("params"),
+			}),
+		}
+		r, err := NewRequest(httptest.NewRequest(http.MethodGet, ts.URL, nil))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := l.Handle(context.Background(), r); err != nil {
+			t.Fatal(err)
+		}
+		if got := tokenServer.form.Get("client_secret"); got != "client-secret" {
+			t.Errorf("want %s, got %s", "client-secret", got)
+		}
+	})
+
+	t.Run("refresh on 401", func(t *testing.T) {
+		tokenServer := &fakeTokenServer{}
+		auth := httptest.NewTLSServer(tokenServer)
+		defer auth.Close()
+		ts := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			// token-1 is revoked.
+			if req.Header.Get("Authorization") != "Bearer token-2" {
+				http.Error(w, "invalid token: "+req.Header.Get("Authorization"), http.StatusUnauthorized)
+				return
+			}
+			fmt.Fprint(w, "ok")
+		}))
+		defer ts.Close()
+		u, err := url.Parse(ts.URL)
+		if err != nil {
+			panic(err)
+		}
+
+		l := &Lambda{
+			Client: ts.Client(),
+			Audit:  &auditMock{},
+			svcssm: newOAuth2Mock(u.Host, auth.URL+"/token"),
+		}
+		r, err := NewRequest(httptest.NewRequest(http.MethodGet, ts.URL, nil))
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp, err := l.Handle(context.Background(), r)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if resp.StatusCode != http.StatusOK {
+			t.Errorf("want %d, got %d", http.StatusOK, resp.StatusCode)
+		}
+		if tokenServer.issued != 2 {
+			t.Errorf("want %d, got %d", 2, tokenServer.issued)
+		}
+	})
+
+	t.Run("keep the token on refreshing the parameter", func(t *testing.T) {
+		tokenServer := &fakeTokenServer{}
+		auth := httptest.NewTLSServer(tokenServer)
+		defer auth.Close()
+
+		l := &Lambda{
+			CacheTTL: time.Nanosecond,
+			Client:   auth.Client(),
+			svcssm:   newOAuth2Mock("example.com", auth.URL+"/token"),
+		}
+		for i := 0; i < 3; i++ {
+			param, err := l.getParam(context.Background(), "example.com")
+			if err != nil {
+				t.Fatal(err)
+			}
+			req := httptest.NewRequest(http.MethodGet, "https://example.com/", nil)
+			if err := param.Sign(req); err != nil {
+				t.Fatal(err)
+			}
+			time.Sleep(time.Millisecond)
+		}
+		if tokenServer.issued != 1 {
+			t.Errorf("want %d, got %d", 1, tokenServer.issued)
+		}
+	})
+}
+
+func TestTokenCache(t *testing.T) {
+	var c tokenCache
+	var calls int32
+	fetch := func(ctx context.Context) (*accessToken, error) {
+		atomic.AddInt32(&calls, 1)
+		time.Sleep(10 * time.Millisecond)
+		return &accessToken{
+			Value:   "token",
+			Expires: time.Now().Add(time.Hour),
+		}, nil
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			token, err := c.get(context.Background(), fetch)
+			if err != nil {
+				t.Error(err)
+			}
+			if token != "token" {
+				t.Errorf("want %s, got %s", "token", token)
+			}
+		}()
+	}
+	wg.Wait()
+	if calls != 1 {
+		t.Errorf("want %d, got %d", 1, calls)
+	}
+
+	c.invalidate()
+	if _, err := c.get(context.Background(), fetch); err != nil {
+		t.Fatal(err)
+	}
+	if calls != 2 {
+		t.Errorf("want %d, got %d", 2, calls)
+	}
+}
+
+func TestTokenCacheReject(t *testing.T) {
+	now := time.Now()
+	defer setTimeNow(now)()
+
+	var c tokenCache
+	var calls int
+	fetch := func(ctx context.Context) (*accessToken, error) {
+		calls++
+		return &accessToken{
+			Value:   fmt.Sprintf("token-%d", calls),
+			Expires: now.Add(time.Hour),
+		}, nil
+	}
+	newRequest := func(token string) *http.Request {
+		req := httptest.NewRequest(http.MethodGet, "https://example.com/", nil)
+		req.Header.Set("Authorization", "Bearer "+token)
+		return req
+	}
+	if _, err := c.get(context.Background(), fetch); err != nil {
+		t.Fatal(err)
+	}
+
+	// the token is not sent. another request has already refreshed it.
+	if !c.reject(newRequest("token-0")) {
+		t.Error("want to retry, but not")
+	}
+	if c.current() != "token-1" {
+		t.Errorf("want %s, got %s", "token-1", c.current())
+	}
+
+	// the token is rejected.
+	if !c.reject(newRequest("token-1")) {
+		t.Error("want to retry, but not")
+	}
+	if c.current() != "" {
+		t.Errorf("want no token, got %s", c.current())
+	}
+	if _, err := c.get(context.Background(), fetch); err != nil {
+		t.Fatal(err)
+	}
+
+	// the forced refreshes are rate limited.
+	if c.reject(newRequest("token-2")) {
+		t.Error("want not to retry, but do")
+	}
+	if c.current() != "token-2" {
+		t.Errorf("want %s, got %s", "token-2", c.current())
+	}
+
+	defer setTimeNow(now.Add(tokenRejectInterval))()
+	if !c.reject(newRequest("token-2")) {
+		t.Error("want to retry, but not")
+	}
+	if calls != 2 {
+		t.Errorf("want %d, got %d", 2, calls)
+	}
+}
@@ -0,0 +1,274 @@
+package proxy
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"html"
+	"net"
+	"net/http"
+	"net/url"
+	"path"
+	"strings"
+	"sync"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/aws/awserr"
+	"github.com/aws/aws-sdk-go-v2/service/ssm"
+	"github.com/aws/aws-sdk-go-v2/service/ssm/ssmiface"
+)
+
+// OAuthLogin gets a refresh token with the OAuth 2.0 authorization code grant and PKCE,
+// and stores it with the client settings under /{Prefix}/{Host}/oauth2/ in AWS SSM Parameter Store.
+type OAuthLogin struct {
+	Config aws.Config
+	Prefix string
+
+	// Host is the host of the API.
+	Host string
+
+	AuthURL      string
+	TokenURL     string
+	ClientID     string
+	ClientSecret string
+	Scopes       []string
+	AuthStyle    string
+
+	// AuthParams are the additional parameters of the authorization request, e.g. access_type=offline.
+	AuthParams url.Values
+
+	// RedirectAddress is the loopback address for receiving the redirect.
+	// The default is 127.0.0.1:0, which chooses a port automatically.
+	RedirectAddress string
+
+	// OpenURL opens the authorization URL in the browser.
+	OpenURL func(u string) error
+
+	// Client is used for requesting the token.
+	// If nil, http.DefaultClient is used.
+	Client *http.Client
+
+	mu     sync.Mutex
+	svcssm ssmiface.SSMAPI
+}
+
+func (o *OAuthLogin) ssm() ssmiface.SSMAPI {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	if o.svcssm == nil {
+		o.svcssm = ssm.New(o.Config)
+	}
+	return o.svcssm
+}
+
+func (o *OAuthLogin) client() *http.Client {
+	if o.Client != nil {
+		return o.Client
+	}
+	return http.DefaultClient
+}
+
+func (o *OAuthLogin) redirectAddress() string {
+	if o.RedirectAddress != "" {
+		return o.RedirectAddress
+	}
+	return "127.0.0.1:0"
+}
+
+// Run runs the authorization flow, and stores the refresh token.
+func (o *OAuthLogin) Run(ctx context.Context) error {
+	if o.Host == "" || o.AuthURL == "" || o.TokenURL == "" || o.ClientID == "" {
+		return errors.New("proxy: the host, the authorization url, the token url and the client id are required")
+	}
+	if o.OpenURL == nil {
+		return errors.New("proxy: OpenURL is required")
+	}
+
+	l, err := net.Listen("tcp", o.redirectAddress())
+	if err != nil {
+		return err
+	}
+	defer l.Close()
+	redirectURI := "http://" + l.Addr().String() + "/callback"
+
+	state, err := randomString()
+	if err != nil {
+		return err
+	}
+	verifier, err := randomString()
+	if err != nil {
+		return err
+	}
+	authURL, err := o.authCodeURL(redirectURI, state, verifier)
+	if err != nil {
+		return err
+	}
+
+	type result struct {
+		code string
+		err  error
+	}
+	ch := make(chan result, 1)
+	var once sync.Once
+	srv := &http.Server{
+		Handler: http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			if req.URL.Path != "/callback" {
+				http.NotFound(w, req)
+				return
+			}
+			q := req.URL.Query()
+			w.Header().Set("Content-Type", "text/html; charset=utf-8")
+			if q.Get("state") != state {
+				// it is not the redirect of this flow. keep waiting for the right one.
+				w.WriteHeader(http.StatusBadRequest)
+				fmt.Fprint(w, "<p>The state of the redirect doesn't match.</p>")
+				return
+			}
+			var r result
+			switch {
+			case q.Get("error") != "":
+				r.err = fmt.Errorf("proxy: the authorization is failed: %s: %s", q.Get("error"), q.Get("error_description"))
+			case q.Get("code") == "":
+				r.err = errors.New("proxy: the redirect has no code")
+			default:
+				r.code = q.Get("code")
+			}
+			if r.err != nil {
+				w.WriteHeader(http.StatusBadRequest)
+				fmt.Fprintf(w, "<p>%s</p>", html.EscapeString(r.err.Error()))
+			} else {
+				fmt.Fprint(w, "<p>The authorization is completed. You can close this window.</p>")
+			}
+			once.Do(func() { ch <- r })
+		}),
+	}
+	go srv.Serve(l)
+	defer srv.Close()
+
+	if err := o.OpenURL(authURL); err != nil {
+		return err
+	}
+
+	var r result
+	select {
+	case r = <-ch:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+	if r.err != nil {
+		return r.err
+	}
+
+	token, err := o.exchange(ctx, r.code, redirectURI, verifier)
+	if err != nil {
+		return err
+	}
+	if token.RefreshToken == "" {
+		return errors.New("proxy: the token response has no refresh_token. the provider may require offline access")
+	}
+	return o.store(ctx, token.RefreshToken)
+}
+
+// authCodeURL returns the URL of the authorization request.
+func (o *OAuthLogin) authCodeURL(redirectURI, state, verifier string) (string, error) {
+	u, err := url.Parse(o.AuthURL)
+	if err != nil {
+		return "", err
+	}
+	challenge := sha256.Sum256([]byte(verifier))
+	q := u.Query()
+	for k, v := range o.AuthParams {
+		q[k] = v
+	}
+	q.Set("response_type", "code")
+	q.Set("client_id", o.ClientID)
+	q.Set("redirect_uri", redirectURI)
+	q.Set("state", state)
+	q.Set("code_challenge", base64.RawURLEncoding.EncodeToString(challenge[:]))
+	q.Set("code_challenge_method", "S256")
+	if len(o.Scopes) > 0 {
+		q.Set("scope", strings.Join(o.Scopes, " "))
+	}
+	u.RawQuery = q.Encode()
+	return u.String(), nil
+}
+
+// exchange exchanges the authorization code for the tokens.
+func (o *OAuthLogin) exchange(ctx context.Context, code, redirectURI, verifier string) (*tokenResponse, error) {
+	oauth2 := &OAuth2{
+		TokenURL:     o.TokenURL,
+		ClientID:     o.ClientID,
+		ClientSecret: o.ClientSecret,
+		AuthStyle:    o.AuthStyle,
+		client:       o.client(),
+	}
+	return oauth2.requestToken(ctx, url.Values{
+		"grant_type":    {"authorization_code"},
+		"code":          {code},
+		"redirect_uri":  {redirectURI},
+		"code_verifier": {verifier},
+	})
+}
+
+// store stores the refresh token and the client settings as SecureStrings.
+// The settings which are not set are deleted, so the stale ones of the previous login don't remain.
+func (o *OAuthLogin) store(ctx context.Context, refreshToken string) error {
+	params := []struct {
+		name  string
+		value string
+	}{
+		{"token_url", o.TokenURL},
+		{"client_id", o.ClientID},
+		{"client_secret", o.ClientSecret},
+		{"scopes", strings.Join(o.Scopes, ",")},
+		{"auth_style", o.AuthStyle},
+		{"refresh_token", refreshToken},
+	}
+	base := path.Join("/", o.Prefix, o.Host, "oauth2")
+	for _, p := range params {
+		if p.value == "" {
+			if err := o.deleteParameter(ctx, base+"/"+p.name); err != nil {
+				return err
+			}
+			continue
+		}
+		req := o.ssm().PutParameterRequest(&ssm.PutParameterInput{
+			Name:      aws.String(base + "/" + p.name),
+			Value:     aws.String(p.value),
+			Type:      ssm.ParameterTypeSecureString,
+			Overwrite: aws.Bool(true),
+		})
+		req.SetContext(ctx)
+		if _, err := req.Send(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// deleteParameter deletes the parameter. It is not an error if the parameter doesn't exist.
+func (o *OAuthLogin) deleteParameter(ctx context.Context, name string) error {
+	req := o.ssm().DeleteParameterRequest(&ssm.DeleteParameterInput{
+		Name: aws.String(name),
+	})
+	req.SetContext(ctx)
+	if _, err := req.Send(); err != nil {
+		if aerr, ok := err.(awserr.Error); ok && aerr.Code() == ssm.ErrCodeParameterNotFound {
+			return nil
+		}
+		return err
+	}
+	return nil
+}
+
+// randomString returns a random string for the state and the code verifier.
+func randomString() (string, error) {
+	var b [32]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(b[:]), nil
+}
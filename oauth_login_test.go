@@ -0,0 +1,216 @@
+package proxy
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/aws/aws-sdk-go-v2/service/ssm"
+)
+
+// fakeAuthorizationServer implements the authorization code grant with PKCE.
+type fakeAuthorizationServer struct {
+	mu        sync.Mutex
+	challenge string
+	redirect  string
+	denied    bool
+}
+
+func (s *fakeAuthorizationServer) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	switch req.URL.Path {
+	case "/authorize":
+		q := req.URL.Query()
+		if q.Get("response_type") != "code" || q.Get("client_id") != "client" || q.Get("code_challenge_method") != "S256" {
+			http.Error(w, "invalid request", http.StatusBadRequest)
+			return
+		}
+		s.challenge = q.Get("code_challenge")
+		s.redirect = q.Get("redirect_uri")
+		v := url.Values{"state": {q.Get("state")}}
+		if s.denied {
+			v.Set("error", "access_denied")
+		} else {
+			v.Set("code", "authorization-code")
+		}
+		http.Redirect(w, req, s.redirect+"?"+v.Encode(), http.StatusFound)
+	case "/token":
+		if err := req.ParseForm(); err != nil {
+			panic(err)
+		}
+		form := req.PostForm
+		challenge := sha256.Sum256([]byte(form.Get("code_verifier")))
+		w.Header().Set("Content-Type", "application/json")
+		if user, pass, _ := req.BasicAuth(); user != "client" || pass != "secret" ||
+			form.Get("grant_type") != "authorization_code" ||
+			form.Get("code") != "authorization-code" ||
+			form.Get("redirect_uri") != s.redirect ||
+			base64.RawURLEncoding.EncodeToString(challenge[:]) != s.challenge {
+			w.WriteHeader(http.StatusBadRequest)
+			fmt.Fprint(w, `{"error":"invalid_grant"}`)
+			return
+		}
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"access_token":  "access-token",
+			"refresh_token": "refresh-token",
+			"token_type":    "Bearer",
+			"expires_in":    3600,
+		})
+	default:
+		http.NotFound(w, req)
+	}
+}
+
+func TestOAuthLogin(t *testing.T) {
+	newLogin := func(auth *httptest.Server, mock *parameterStoreMock) *OAuthLogin {
+		return &OAuthLogin{
+			Prefix:       "prefix",
+			Host:         "example.com",
+			AuthURL:      auth.URL + "/authorize",
+			TokenURL:     auth.URL + "/token",
+			ClientID:     "client",
+			ClientSecret: "secret",
+			Scopes:       []string{"read", "write"},
+			OpenURL: func(u string) error {
+				// emulate the browser, which follows the redirect to the loopback server.
+				resp, err := auth.Client().Get(u)
+				if err != nil {
+					return err
+				}
+				return resp.Body.Close()
+			},
+			Client: auth.Client(),
+			svcssm: mock,
+		}
+	}
+
+	t.Run("success", func(t *testing.T) {
+		auth := httptest.NewTLSServer(&fakeAuthorizationServer{})
+		defer auth.Close()
+		mock := newParameterStoreMock(nil)
+
+		if err := newLogin(auth, mock).Run(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+
+		want := map[string]string{
+			"/prefix/example.com/oauth2/token_url":     auth.URL + "/token",
+			"/prefix/example.com/oauth2/client_id":     "client",
+			"/prefix/example.com/oauth2/client_secret": "secret",
+			"/prefix/example.com/oauth2/scopes":        "read,write",
+			"/prefix/example.com/oauth2/refresh_token": "refresh-token",
+		}
+		if len(mock.params) != len(want) {
+			t.Errorf("want %d parameters, got %d", len(want), len(mock.params))
+		}
+		for name, value := range want {
+			p, ok := mock.params[name]
+			if !ok {
+				t.Errorf("%s is not stored", name)
+				continue
+			}
+			if *p.Value != value {
+				t.Errorf("%s: want %s, got %s", name, value, *p.Value)
+			}
+			if p.Type != ssm.ParameterTypeSecureString {
+				t.Errorf("%s: want %s, got %s", name, ssm.ParameterTypeSecureString, p.Type)
+			}
+		}
+	})
+
+	t.Run("stale settings", func(t *testing.T) {
+		auth := httptest.NewTLSServer(&fakeAuthorizationServer{})
+		defer auth.Close()
+		mock := newParameterStoreMock(map[string]string{
+			"/prefix/example.com/oauth2/auth_style": "params",
+			"/prefix/example.com/oauth2/scopes":     "admin",
+		})
+		login := newLogin(auth, mock)
+		login.Scopes = nil
+
+		if err := login.Run(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+		for _, name := range []string{"/prefix/example.com/oauth2/auth_style", "/prefix/example.com/oauth2/scopes"} {
+			if _, ok := mock.params[name]; ok {
+				t.Errorf("%s is not deleted", name)
+			}
+		}
+		if _, ok := mock.params["/prefix/example.com/oauth2/refresh_token"]; !ok {
+			t.Error("the refresh token is not stored")
+		}
+	})
+
+	t.Run("wrong state", func(t *testing.T) {
+		auth := httptest.NewTLSServer(&fakeAuthorizationServer{})
+		defer auth.Close()
+		mock := newParameterStoreMock(nil)
+		login := newLogin(auth, mock)
+		openURL := login.OpenURL
+		login.OpenURL = func(u string) error {
+			authURL, err := url.Parse(u)
+			if err != nil {
+				return err
+			}
+
+			// a stray redirect, e.g. from an old tab, doesn't abort the flow.
+			callback := authURL.Query().Get("redirect_uri") + "?" + url.Values{
+				"state": {"wrong-state"},
+				"code":  {"stolen-code"},
+			}.Encode()
+			resp, err := http.Get(callback)
+			if err != nil {
+				return err
+			}
+			resp.Body.Close()
+			if resp.StatusCode != http.StatusBadRequest {
+				t.Errorf("want %d, got %d", http.StatusBadRequest, resp.StatusCode)
+			}
+			return openURL(u)
+		}
+
+		if err := login.Run(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+		if p, ok := mock.params["/prefix/example.com/oauth2/refresh_token"]; !ok || *p.Value != "refresh-token" {
+			t.Error("the refresh token is not stored")
+		}
+	})
+
+	t.Run("denied", func(t *testing.T) {
+		auth := httptest.NewTLSServer(&fakeAuthorizationServer{denied: true})
+		defer auth.Close()
+		mock := newParameterStoreMock(nil)
+
+		err := newLogin(auth, mock).Run(context.Background())
+		if err == nil || !strings.Contains(err.Error(), "access_denied") {
+			t.Errorf("want access_denied error, got %v", err)
+		}
+		if len(mock.params) != 0 {
+			t.Errorf("want no parameters, got %d", len(mock.params))
+		}
+	})
+
+	t.Run("canceled", func(t *testing.T) {
+		auth := httptest.NewTLSServer(&fakeAuthorizationServer{})
+		defer auth.Close()
+		mock := newParameterStoreMock(nil)
+		login := newLogin(auth, mock)
+		login.OpenURL = func(u string) error { return nil }
+
+		ctx, cancel := context.WithCancel(context.Background())
+		cancel()
+		if err := login.Run(ctx); err != context.Canceled {
+			t.Errorf("want %v, got %v", context.Canceled, err)
+		}
+	})
+}
@@ -0,0 +1,97 @@
+package proxy
+
+import (
+	"net/http"
+	"strings"
+	"time"
+)
+
+// headerUnsigned is the header which the function adds to the response
+// when the host has no parameters for signing.
+const headerUnsigned = "X-Ssm-Sign-Proxy-Unsigned"
+
+// defaultPassThroughTTL is the default duration for remembering unsigned hosts.
+const defaultPassThroughTTL = 5 * time.Minute
+
+func (p *Proxy) transport() http.RoundTripper {
+	if p.Transport != nil {
+		return p.Transport
+	}
+	return http.DefaultTransport
+}
+
+func (p *Proxy) passThroughTTL() time.Duration {
+	if p.PassThroughTTL > 0 {
+		return p.PassThroughTTL
+	}
+	return defaultPassThroughTTL
+}
+
+// isUnsigned reports whether the host is known to have no parameters.
+func (p *Proxy) isUnsigned(host string) bool {
+	p.unsignedMu.Lock()
+	defer p.unsignedMu.Unlock()
+	expires, ok := p.unsigned[host]
+	if !ok {
+		return false
+	}
+	if time.Now().After(expires) {
+		delete(p.unsigned, host)
+		return false
+	}
+	return true
+}
+
+// setUnsigned remembers that the host has no parameters.
+func (p *Proxy) setUnsigned(host string) {
+	p.unsignedMu.Lock()
+	defer p.unsignedMu.Unlock()
+	if p.unsigned == nil {
+		p.unsigned = make(map[string]time.Time)
+	}
+	now := time.Now()
+	for h, expires := range p.unsigned {
+		// remove expired entries to avoid the memory leak.
+		if now.After(expires) {
+			delete(p.unsigned, h)
+		}
+	}
+	p.unsigned[host] = now.Add(p.passThroughTTL())
+}
+
+// isUnsignedResponse reports whether the function returned the response because the host has no parameters.
+func isUnsignedResponse(resp *Response) bool {
+	if resp.StatusCode != http.StatusProxyAuthRequired {
+		return false
+	}
+	return resp.header().Get(headerUnsigned) != ""
+}
+
+// removeUnsignedHeader removes the internal header from the response.
+func removeUnsignedHeader(resp *Response) {
+	http.Header(resp.MultiValueHeaders).Del(headerUnsigned)
+	delete(resp.Headers, headerUnsigned)
+}
+
+// passThrough forwards the request directly to the origin without signing.
+func (p *Proxy) passThrough(req *http.Request, request *Request) (*Response, error) {
+	httpreq, err := request.Request()
+	if err != nil {
+		return nil, err
+	}
+	if req.URL.Scheme != "" {
+		httpreq.URL.Scheme = req.URL.Scheme
+	}
+	httpreq = httpreq.WithContext(req.Context())
+
+	resp, err := p.transport().RoundTrip(httpreq)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	return NewResponse(resp)
+}
+
+func requestHost(request *Request) string {
+	return strings.ToLower(request.header().Get("Host"))
+}
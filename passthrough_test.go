@@ -0,0 +1,123 @@
+package proxy
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/lambda"
+	"github.com/aws/aws-sdk-go-v2/service/ssm"
+)
+
+func TestProxyPassThrough(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.Header.Get("Authorization") != "" {
+			t.Error("the request must not be signed")
+		}
+		w.Header().Set("Content-Type", "text/plain")
+		fmt.Fprintf(w, "hello %s", req.URL.Path)
+	}))
+	defer ts.Close()
+
+	var invoked int
+	l := &lambdaMock{
+		invoke: func(input *lambda.InvokeInput) *lambda.InvokeOutput {
+			invoked++
+			return &lambda.InvokeOutput{
+				Payload: []byte(`{"statusCode":407,"headers":{"Content-Type":"text/plain; charset=utf-8","X-Ssm-Sign-Proxy-Unsigned":"true"},"body":"not found"}`),
+			}
+		},
+	}
+
+	t.Run("disabled", func(t *testing.T) {
+		invoked = 0
+		p := &Proxy{
+			FunctionName: "proxy-test",
+			Metadata:     testMetadata,
+			scvlambda:    l,
+		}
+		httpreq := httptest.NewRequest(http.MethodGet, ts.URL+"/foo", nil)
+		rec := httptest.NewRecorder()
+		p.ServeHTTP(rec, httpreq)
+		if rec.Code != http.StatusProxyAuthRequired {
+			t.Errorf("want %d, got %d", http.StatusProxyAuthRequired, rec.Code)
+		}
+		if rec.HeaderMap.Get(headerUnsigned) != "" {
+			t.Errorf("the internal header is leaked")
+		}
+	})
+
+	t.Run("enabled", func(t *testing.T) {
+		invoked = 0
+		p := &Proxy{
+			FunctionName: "proxy-test",
+			Metadata:     testMetadata,
+			PassThrough:  true,
+			scvlambda:    l,
+		}
+		for _, path := range []string{"/foo", "/bar"} {
+			httpreq := httptest.NewRequest(http.MethodPost, ts.URL+path, strings.NewReader("body"))
+			rec := httptest.NewRecorder()
+			p.ServeHTTP(rec, httpreq)
+			if rec.Code != http.StatusOK {
+				t.Errorf("want %d, got %d", http.StatusOK, rec.Code)
+			}
+			if rec.Body.String() != "hello "+path {
+				t.Errorf("want %s, got %s", "hello "+path, rec.Body.String())
+			}
+		}
+
+		// the second request skips the function.
+		if invoked != 1 {
+			t.Errorf("want %d, got %d", 1, invoked)
+		}
+	})
+}
+
+func TestLambdaUpstreamUnsignedHeader(t *testing.T) {
+	// the upstream pretends that the host has no parameters.
+	ts := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Set(headerUnsigned, "true")
+		http.Error(w, "Proxy Authentication Required", http.StatusProxyAuthRequired)
+	}))
+	defer ts.Close()
+
+	u, err := url.Parse(ts.URL)
+	if err != nil {
+		panic(err)
+	}
+	mock := &ssmMock{
+		output: &ssm.GetParametersByPathOutput{
+			Parameters: []ssm.Parameter{
+				{
+					Name:  aws.String("/" + u.Host + "/headers/X-Api-Key"),
+					Value: aws.String("very-secret"),
+				},
+			},
+		},
+	}
+	l := &Lambda{
+		Client: ts.Client(),
+		Audit:  &auditMock{},
+		svcssm: mock,
+	}
+	r, err := NewRequest(httptest.NewRequest(http.MethodGet, ts.URL, nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err := l.Handle(context.Background(), r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != http.StatusProxyAuthRequired {
+		t.Errorf("want %d, got %d", http.StatusProxyAuthRequired, resp.StatusCode)
+	}
+	if isUnsignedResponse(resp) {
+		t.Error("the upstream must not mark the host as unsigned")
+	}
+}
@@ -0,0 +1,126 @@
+package proxy
+
+import (
+	"errors"
+	"fmt"
+	"net/url"
+	"path"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// Policy is the list of rules which allow or deny requests by the method and the path.
+// The rules are evaluated in the order of their names, and the first matching rule wins.
+// If no rule matches, the request is denied.
+type Policy struct {
+	Rules []*PolicyRule
+}
+
+// PolicyRule is a rule of Policy.
+// It is parsed from the parameter value "<allow|deny> <methods> <pattern>",
+// e.g. "allow GET,HEAD /repos/*/issues".
+// The methods are comma separated, and "*" matches any methods.
+// The pattern is a glob pattern, or a regular expression if it starts with "~".
+type PolicyRule struct {
+	Name    string
+	Allow   bool
+	Methods []string
+	Pattern string
+
+	re  *regexp.Regexp
+	err error
+}
+
+// set adds the rule from the parameter policy/{name}.
+func (p *Policy) set(name, value string) {
+	rule := parsePolicyRule(name, value)
+	idx := sort.Search(len(p.Rules), func(i int) bool {
+		return p.Rules[i].Name >= name
+	})
+	p.Rules = append(p.Rules, nil)
+	copy(p.Rules[idx+1:], p.Rules[idx:])
+	p.Rules[idx] = rule
+}
+
+func parsePolicyRule(name, value string) *PolicyRule {
+	rule := &PolicyRule{Name: name}
+	fields := strings.Fields(value)
+	if len(fields) != 3 {
+		rule.err = errors.New("<allow|deny> <methods> <pattern> is expected")
+		return rule
+	}
+
+	switch strings.ToLower(fields[0]) {
+	case "allow":
+		rule.Allow = true
+	case "deny":
+		rule.Allow = false
+	default:
+		rule.err = fmt.Errorf("unknown effect %q", fields[0])
+		return rule
+	}
+
+	if fields[1] != "*" {
+		for _, m := range strings.Split(fields[1], ",") {
+			if m = strings.TrimSpace(m); m != "" {
+				rule.Methods = append(rule.Methods, strings.ToUpper(m))
+			}
+		}
+	}
+
+	rule.Pattern = fields[2]
+	if strings.HasPrefix(rule.Pattern, "~") {
+		re, err := regexp.Compile(rule.Pattern[1:])
+		if err != nil {
+			rule.err = err
+			return rule
+		}
+		rule.re = re
+	} else {
+		rule.re = compileGlob(rule.Pattern)
+	}
+	return rule
+}
+
+func (rule *PolicyRule) match(method, path string) bool {
+	if len(rule.Methods) > 0 && !contains(rule.Methods, method) {
+		return false
+	}
+	return rule.re.MatchString(path)
+}
+
+// Evaluate returns an error that names the matched rule if the request is denied.
+func (p *Policy) Evaluate(method string, u *url.URL) error {
+	if p == nil {
+		return nil
+	}
+	path := cleanPath(u.Path)
+	for _, rule := range p.Rules {
+		if rule.err != nil {
+			// fail closed.
+			return fmt.Errorf("invalid policy rule %q: %v", rule.Name, rule.err)
+		}
+		if !rule.match(method, path) {
+			continue
+		}
+		if rule.Allow {
+			return nil
+		}
+		// don't include the path in the message, because the rewritten path may be a secret.
+		return fmt.Errorf("the request is denied by policy rule %q", rule.Name)
+	}
+	return errors.New("the request is denied because no policy rule matched")
+}
+
+// cleanPath resolves the dot segments, because the upstream may resolve them.
+func cleanPath(p string) string {
+	if p == "" {
+		return "/"
+	}
+	cleaned := path.Clean(p)
+	if strings.HasSuffix(p, "/") && cleaned != "/" {
+		cleaned += "/"
+	}
+	return cleaned
+}
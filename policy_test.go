@@ -0,0 +1,114 @@
+package proxy
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/ssm"
+)
+
+func TestPolicyEvaluate(t *testing.T) {
+	p := &Policy{}
+	p.set("20-issues", "allow GET,HEAD /repos/*/*/issues")
+	p.set("10-admin", "deny * /repos/*/*/hooks**")
+	p.set("30-regexp", `allow GET ~^/users/[a-z]+$`)
+
+	tests := []struct {
+		method string
+		path   string
+		allow  bool
+		rule   string
+	}{
+		{http.MethodGet, "/repos/foo/bar/issues", true, ""},
+		{http.MethodHead, "/repos/foo/bar/issues", true, ""},
+		{http.MethodPost, "/repos/foo/bar/issues", false, "no policy rule matched"},
+		{http.MethodGet, "/repos/foo/bar/hooks/1", false, `"10-admin"`},
+		{http.MethodGet, "/repos/foo/bar/issues/../hooks", false, `"10-admin"`},
+		{http.MethodGet, "/users/octocat", true, ""},
+		{http.MethodGet, "/users/octocat/repos", false, "no policy rule matched"},
+	}
+	for _, tt := range tests {
+		err := p.Evaluate(tt.method, &url.URL{Path: tt.path})
+		if (err == nil) != tt.allow {
+			t.Errorf("%s %s: want %t, got %v", tt.method, tt.path, tt.allow, err)
+			continue
+		}
+		if err != nil && !strings.Contains(err.Error(), tt.rule) {
+			t.Errorf("%s %s: want %s in the message, got %v", tt.method, tt.path, tt.rule, err)
+		}
+	}
+
+	if err := (*Policy)(nil).Evaluate(http.MethodGet, &url.URL{Path: "/"}); err != nil {
+		t.Errorf("nil policy should allow everything, got %v", err)
+	}
+
+	invalid := &Policy{}
+	invalid.set("invalid", "allow GET")
+	if err := invalid.Evaluate(http.MethodGet, &url.URL{Path: "/"}); err == nil {
+		t.Error("invalid rules should deny everything")
+	}
+}
+
+func TestLambdaPolicy(t *testing.T) {
+	ts := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		fmt.Fprint(w, "ok")
+	}))
+	defer ts.Close()
+
+	u, err := url.Parse(ts.URL)
+	if err != nil {
+		panic(err)
+	}
+	mock := &ssmMock{
+		output: &ssm.GetParametersByPathOutput{
+			Parameters: []ssm.Parameter{
+				{
+					Name:  aws.String("/development/" + u.Host + "/rewrite/path"),
+					Value: aws.String("/services/secret"),
+				},
+				{
+					Name:  aws.String("/development/" + u.Host + "/policy/services"),
+					Value: aws.String("allow POST /services/*"),
+				},
+			},
+		},
+	}
+	l := &Lambda{
+		Prefix: "development",
+		Client: ts.Client(),
+		svcssm: mock,
+	}
+
+	// the policy is evaluated against the rewritten path.
+	req := httptest.NewRequest(http.MethodPost, ts.URL+"/dummy", strings.NewReader("{}"))
+	r, err := NewRequest(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err := l.Handle(context.Background(), r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("want %d, got %d", http.StatusOK, resp.StatusCode)
+	}
+
+	req = httptest.NewRequest(http.MethodGet, ts.URL+"/dummy", nil)
+	r, err = NewRequest(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err = l.Handle(context.Background(), r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != http.StatusForbidden {
+		t.Errorf("want %d, got %d", http.StatusForbidden, resp.StatusCode)
+	}
+}
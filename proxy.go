@@ -1,14 +1,11 @@
 package proxy
 
 import (
-	"context"
 	"encoding/json"
-	"io"
 	"io/ioutil"
 	"log"
 	"net"
 	"net/http"
-	"os"
 	"strings"
 	"sync"
 	"time"
@@ -17,6 +14,7 @@ import (
 	"github.com/aws/aws-sdk-go-v2/aws/awserr"
 	"github.com/aws/aws-sdk-go-v2/service/lambda"
 	"github.com/aws/aws-sdk-go-v2/service/lambda/lambdaiface"
+	"github.com/aws/aws-sdk-go-v2/service/sts/stsiface"
 )
 
 // Hop-by-hop headers. These are removed when sent to the backend.
@@ -42,11 +40,57 @@ type Proxy struct {
 	FunctionName string
 	ErrorHandler func(http.ResponseWriter, *http.Request, error)
 
+	// Qualifier is the alias or the version of the function.
+	// If it is empty, $LATEST is invoked.
+	Qualifier string
+
+	// Canary routes a part of the invocations to another qualifier.
+	Canary *Canary
+
+	// PassThrough makes the proxy forward the requests directly to the origin
+	// if the host has no parameters for signing.
+	PassThrough bool
+
+	// PassThroughTTL is the duration for remembering the hosts without parameters.
+	// The default is 5 minutes.
+	PassThroughTTL time.Duration
+
+	// Transport is used for forwarding the requests directly to the origin.
+	// If nil, http.DefaultTransport is used.
+	Transport http.RoundTripper
+
+	// Metadata collects the InstanceContext sent to the function.
+	// If nil, the default settings are used.
+	Metadata *Metadata
+
+	// MetadataRefreshInterval is the interval for refreshing the InstanceContext.
+	// The default is 10 minutes.
+	MetadataRefreshInterval time.Duration
+
 	mu        sync.Mutex
 	scvlambda lambdaiface.LambdaAPI
+	svcsts    stsiface.STSAPI
+
+	identityMu      sync.Mutex
+	identityURL     string
+	identityExpires time.Time
+
+	metricsMu  sync.Mutex
+	metrics    map[string]*InvocationMetrics
+	rolledBack bool
+	rand       func() float64
+
+	// gzipVersions are the versions which understand BodyEncodingGzip, keyed by the qualifier.
+	encodingMu   sync.RWMutex
+	gzipVersions map[string]gzipVersion
+
+	unsignedMu sync.Mutex
+	unsigned   map[string]time.Time
 
-	once            sync.Once
-	instanceContext InstanceContext
+	instanceMu         sync.Mutex
+	instanceContext    InstanceContext
+	instanceExpires    time.Time
+	instanceRefreshing bool
 }
 
 func (p *Proxy) lambda() lambdaiface.LambdaAPI {
@@ -70,36 +114,6 @@ func defaultErrorHandler(w http.ResponseWriter, _ *http.Request, err error) {
 	log.Println(err)
 }
 
-func (p *Proxy) initInstanceContext() {
-	p.once.Do(func() {
-		if name, err := os.Hostname(); err == nil {
-			p.instanceContext.Hostname = name
-		}
-
-		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
-		defer cancel()
-		req, err := http.NewRequest(http.MethodGet, "http://169.254.169.254/latest/meta-data/instance-id", nil)
-		if err != nil {
-			return
-		}
-		req = req.WithContext(ctx)
-		resp, err := http.DefaultClient.Do(req)
-		if err != nil {
-			return
-		}
-		defer resp.Body.Close()
-
-		if resp.StatusCode != http.StatusOK {
-			return
-		}
-		var builder strings.Builder
-		if _, err := io.Copy(&builder, resp.Body); err != nil {
-			return
-		}
-		p.instanceContext.InstanceID = strings.TrimSpace(builder.String())
-	})
-}
-
 func (p *Proxy) ServeHTTP(w http.ResponseWriter, req *http.Request) {
 	header := cloneHeader(req.Header)
 	removeConnectionHeaders(header)
@@ -185,8 +199,39 @@ func (p *Proxy) roundTrip(req *http.Request) (*Response, error) {
 	if err != nil {
 		return nil, err
 	}
+	identityURL, err := p.callerIdentityURL(req.Context())
+	if err != nil {
+		// the identity is optional for most hosts. send the request without it,
+		// and the function decides whether the host requires it.
+		log.Println("failed to presign sts:GetCallerIdentity:", err)
+		identityURL = ""
+	}
 	request.RequestContext = RequestContext{
-		Instance: p.instanceContext,
+		Instance: p.getInstanceContext(req.Context()),
+		Identity: IdentityContext{
+			GetCallerIdentityURL: identityURL,
+		},
+	}
+	host := requestHost(request)
+	if p.PassThrough && p.isUnsigned(host) {
+		// skip the round trip to the function.
+		return p.passThrough(req, request)
+	}
+
+	// compress the body only if the function is known to understand it,
+	// because old versions of the function can't decode it.
+	qualifier := p.selectQualifier()
+	invoked := qualifier
+	request.AcceptBodyEncodings = supportedBodyEncodings
+	if version, ok := p.gzipVersion(qualifier); ok {
+		if err := request.Compress(); err != nil {
+			return nil, err
+		}
+		if request.BodyEncoding != "" {
+			// the alias may be moved back to an old version.
+			// invoke the version which is known to understand gzip.
+			invoked = version
+		}
 	}
 	payload, err := json.Marshal(request)
 	if err != nil {
@@ -194,27 +239,86 @@ func (p *Proxy) roundTrip(req *http.Request) (*Response, error) {
 	}
 
 	// invoke the lambda function
-	r := p.lambda().InvokeRequest(&lambda.InvokeInput{
+	input := &lambda.InvokeInput{
 		FunctionName: aws.String(p.FunctionName),
 		Payload:      payload,
-	})
+	}
+	if invoked != latestQualifier {
+		input.Qualifier = aws.String(invoked)
+	}
+	r := p.lambda().InvokeRequest(input)
 	r.SetContext(req.Context())
 	response, err := r.Send()
 	if err != nil {
+		if req.Context().Err() == nil {
+			// the failures caused by the client don't mean the function is broken.
+			p.recordInvocation(qualifier, true)
+		}
 		return nil, err
 	}
 	if response.FunctionError != nil {
+		p.recordInvocation(qualifier, true)
 		return nil, parseError(response.Payload)
 	}
+	p.recordInvocation(qualifier, false)
 
 	// build the response
 	var resp Response
 	if err := json.Unmarshal(response.Payload, &resp); err != nil {
 		return nil, err
 	}
+	if invoked == qualifier {
+		accepts := acceptsBodyEncoding(resp.AcceptBodyEncodings, BodyEncodingGzip)
+		p.setGzipVersion(qualifier, aws.StringValue(response.ExecutedVersion), accepts)
+	}
+	if isUnsignedResponse(&resp) && p.PassThrough {
+		p.setUnsigned(host)
+		return p.passThrough(req, request)
+	}
+	removeUnsignedHeader(&resp)
 	return &resp, nil
 }
 
+// gzipVersionTTL is the duration for trusting the version learned from the invocation through the qualifier.
+// The compressed requests are sent to that version, so the proxy notices the alias moved back
+// to an old version within the duration even if all requests are compressed.
+const gzipVersionTTL = time.Minute
+
+// gzipVersion is the version executed by the last invocation through the qualifier.
+type gzipVersion struct {
+	version string
+	expires time.Time
+}
+
+// gzipVersion returns the version which the qualifier executed, and which understands BodyEncodingGzip.
+func (p *Proxy) gzipVersion(qualifier string) (string, bool) {
+	p.encodingMu.RLock()
+	defer p.encodingMu.RUnlock()
+	v, ok := p.gzipVersions[qualifier]
+	if !ok || !timeNow().Before(v.expires) {
+		return "", false
+	}
+	return v.version, true
+}
+
+// setGzipVersion records the version executed by the invocation through the qualifier.
+// $LATEST is never recorded, because it is mutable and can't be pinned.
+func (p *Proxy) setGzipVersion(qualifier, version string, accepts bool) {
+	p.encodingMu.Lock()
+	defer p.encodingMu.Unlock()
+	if !accepts || version == "" || version == latestQualifier {
+		delete(p.gzipVersions, qualifier)
+		return
+	}
+	if p.gzipVersions == nil {
+		p.gzipVersions = make(map[string]gzipVersion)
+	}
+	p.gzipVersions[qualifier] = gzipVersion{
+		version: version,
+		expires: timeNow().Add(gzipVersionTTL),
+	}
+}
+
 // removeConnectionHeaders removes hop-by-hop headers listed in the "Connection" header of h.
 // See RFC 7230, section 6.1
 func removeConnectionHeaders(h http.Header) {
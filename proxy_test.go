@@ -15,15 +15,26 @@ import (
 var _ http.Handler = &Proxy{}
 var _ http.RoundTripper = &Proxy{}
 
+// testMetadata doesn't access any metadata services.
+var testMetadata = &Metadata{
+	DisableIMDS:       true,
+	PodInfoDir:        "testdata/podinfo-not-found",
+	ServiceAccountDir: "testdata/serviceaccount-not-found",
+	getenv:            func(string) string { return "" },
+	hostname:          func() (string, error) { return "test-host", nil },
+}
+
 type lambdaMock struct {
 	lambdaiface.LambdaAPI
-	input *lambda.InvokeInput
+	input  *lambda.InvokeInput
+	invoke func(input *lambda.InvokeInput) *lambda.InvokeOutput
 }
 
 func TestProxyServeHTTP(t *testing.T) {
 	l := &lambdaMock{}
 	p := &Proxy{
 		FunctionName: "proxy-test",
+		Metadata:     testMetadata,
 		scvlambda:    l,
 	}
 	httpreq := httptest.NewRequest(http.MethodGet, "https://example.com/foo%20bar", nil)
@@ -48,6 +59,12 @@ func TestProxyServeHTTP(t *testing.T) {
 			"Host":            []string{"example.com"},
 			"X-Forwarded-For": []string{"192.0.2.1"},
 		},
+		RequestContext: RequestContext{
+			Instance: InstanceContext{
+				Hostname: "test-host",
+			},
+		},
+		AcceptBodyEncodings: []string{"gzip"},
 	}
 	if diff := cmp.Diff(req, want); diff != "" {
 		t.Errorf("Request differs: (-got +want)\n%s", diff)
@@ -68,6 +85,9 @@ func (l *lambdaMock) InvokeRequest(input *lambda.InvokeInput) lambda.InvokeReque
 	out := &lambda.InvokeOutput{
 		Payload: []byte(`{"statusCode":200,"headers":{"Content-Type":"application/json"},"body":"{\"key\":\"value\"}"}`),
 	}
+	if l.invoke != nil {
+		out = l.invoke(input)
+	}
 	return lambda.InvokeRequest{
 		Request: &aws.Request{
 			Data:        out,
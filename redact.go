@@ -0,0 +1,251 @@
+package proxy
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/base64"
+	"errors"
+	"io"
+	"io/ioutil"
+	"mime"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// redactedMarker replaces the secret values.
+const redactedMarker = "[REDACTED]"
+
+// minRedactLength is the minimum length of the secret values to be redacted.
+// Shorter values are too common to replace them safely.
+const minRedactLength = 4
+
+// redactor replaces the secret values with redactedMarker.
+// A nil redactor doesn't change anything.
+type redactor struct {
+	replacer *strings.Replacer
+}
+
+func newRedactor(secrets []string) *redactor {
+	seen := make(map[string]bool, len(secrets))
+	values := make([]string, 0, len(secrets))
+	for _, s := range secrets {
+		// the upstream may echo the escaped values.
+		for _, v := range []string{s, url.QueryEscape(s), url.PathEscape(s)} {
+			if len(v) < minRedactLength || seen[v] {
+				continue
+			}
+			seen[v] = true
+			values = append(values, v)
+		}
+	}
+	if len(values) == 0 {
+		return nil
+	}
+
+	// replace longer values first, because a value may contain another.
+	sort.Slice(values, func(i, j int) bool {
+		return len(values[i]) > len(values[j])
+	})
+	oldnew := make([]string, 0, 2*len(values))
+	for _, v := range values {
+		oldnew = append(oldnew, v, redactedMarker)
+	}
+	return &redactor{
+		replacer: strings.NewReplacer(oldnew...),
+	}
+}
+
+// String redacts s.
+func (r *redactor) String(s string) string {
+	if r == nil {
+		return s
+	}
+	return r.replacer.Replace(s)
+}
+
+// Error redacts the message of err.
+func (r *redactor) Error(err error) error {
+	if r == nil || err == nil {
+		return err
+	}
+	msg := err.Error()
+	if redacted := r.String(msg); redacted != msg {
+		return errors.New(redacted)
+	}
+	return err
+}
+
+// Header redacts the values of h.
+func (r *redactor) Header(h http.Header) {
+	if r == nil {
+		return
+	}
+	for _, vv := range h {
+		for i, v := range vv {
+			vv[i] = r.String(v)
+		}
+	}
+}
+
+// Response redacts the headers and the body of resp.
+// The body must not be encoded by Content-Encoding except gzip.
+// The bodies which are not text, e.g. binary downloads, are not changed.
+func (r *redactor) Response(resp *http.Response) error {
+	if r == nil {
+		return nil
+	}
+	r.Header(resp.Header)
+	if !isTextContentType(resp.Header.Get("Content-Type")) {
+		return nil
+	}
+
+	var body []byte
+	var err error
+	gzipped := false
+	switch ce := resp.Header.Get("Content-Encoding"); {
+	case !hasContentEncoding(resp.Header):
+		body, err = ioutil.ReadAll(resp.Body)
+	case strings.EqualFold(ce, "gzip"):
+		gzipped = true
+		body, err = readGzip(resp.Body)
+	default:
+		return errors.New("proxy: can't redact the body encoded by " + ce)
+	}
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+
+	body = []byte(r.String(string(body)))
+	if gzipped {
+		var buf bytes.Buffer
+		w := gzip.NewWriter(&buf)
+		if _, err := w.Write(body); err != nil {
+			return err
+		}
+		if err := w.Close(); err != nil {
+			return err
+		}
+		body = buf.Bytes()
+	}
+	resp.Body = ioutil.NopCloser(bytes.NewReader(body))
+	resp.ContentLength = int64(len(body))
+	if resp.Header.Get("Content-Length") != "" {
+		resp.Header.Set("Content-Length", strconv.Itoa(len(body)))
+	}
+	return nil
+}
+
+// isTextContentType reports whether the media type is text or JSON.
+func isTextContentType(contentType string) bool {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return false
+	}
+	switch {
+	case strings.HasPrefix(mediaType, "text/"):
+		return true
+	case mediaType == "application/json", strings.HasSuffix(mediaType, "+json"):
+		return true
+	case mediaType == "application/xml", strings.HasSuffix(mediaType, "+xml"):
+		return true
+	case mediaType == "application/javascript", mediaType == "application/x-www-form-urlencoded":
+		return true
+	}
+	return false
+}
+
+// isSecretHeader reports whether the header carries credentials, e.g. Authorization, X-Api-Key and Private-Token.
+// The other headers such as Accept and User-Agent are not redacted,
+// because the upstream may return the same values in the response.
+func isSecretHeader(name string) bool {
+	name = strings.ToLower(name)
+	switch name {
+	case "authorization", "proxy-authorization", "cookie":
+		return true
+	}
+	for _, suffix := range []string{"key", "token", "secret", "password"} {
+		if strings.HasSuffix(name, suffix) {
+			return true
+		}
+	}
+	return false
+}
+
+func readGzip(r io.Reader) ([]byte, error) {
+	gr, err := gzip.NewReader(r)
+	if err != nil {
+		if err == io.EOF {
+			// empty body
+			return []byte{}, nil
+		}
+		return nil, err
+	}
+	defer gr.Close()
+	return ioutil.ReadAll(gr)
+}
+
+// secrets returns the values to be redacted.
+func (p *Parameter) secrets() []string {
+	ret := append([]string(nil), p.RedactValues...)
+	for name, vv := range p.Headers {
+		if isSecretHeader(name) {
+			ret = append(ret, vv...)
+		}
+	}
+	if p.Password != "" {
+		ret = append(ret, p.Password, base64.StdEncoding.EncodeToString([]byte(p.User+":"+p.Password)))
+	}
+	for _, vv := range p.Queries {
+		ret = append(ret, vv...)
+	}
+	if p.OAuth2 != nil {
+		ret = append(ret, p.OAuth2.ClientSecret, p.OAuth2.RefreshToken)
+	}
+	if p.JWT != nil {
+		ret = append(ret, p.JWT.Key)
+	}
+	if p.GitHubApp != nil {
+		ret = append(ret, p.GitHubApp.PrivateKey)
+	}
+	if p.Digest != nil {
+		ret = append(ret, p.Digest.Password)
+	}
+	if p.HMAC != nil {
+		ret = append(ret, p.HMAC.Secret)
+	}
+	if p.HTTPSignature != nil {
+		ret = append(ret, p.HTTPSignature.Key)
+	}
+	if p.MTLS != nil {
+		ret = append(ret, p.MTLS.Key)
+	}
+	return ret
+}
+
+// redactor returns the redactor for the secret values and the current tokens.
+func (p *Parameter) redactor() *redactor {
+	tokens := p.tokens()
+	if len(tokens) == 0 {
+		return p.redact
+	}
+	return newRedactor(append(p.secrets(), tokens...))
+}
+
+// errorRedactor returns the redactor for the errors.
+// The errors may contain the url of the upstream, and the rewritten path may be a secret,
+// e.g. the incoming webhook URLs of Slack.
+// The path is not redacted from the responses, because the upstream may echo it.
+func (p *Parameter) errorRedactor() *redactor {
+	if p.Path == "" {
+		return p.redactor()
+	}
+	return newRedactor(append(append(p.secrets(), p.tokens()...), p.Path))
+}
+
+func (p *Parameter) redactResponse() bool {
+	return p.RedactResponse && p.redact != nil
+}
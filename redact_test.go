@@ -0,0 +1,315 @@
+package proxy
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/ssm"
+)
+
+func TestRedactor(t *testing.T) {
+	r := newRedactor([]string{"secret", "very-secret", "a b/c", "abc"})
+	tests := []struct {
+		input string
+		want  string
+	}{
+		{"token very-secret", "token [REDACTED]"},
+		{"secret", "[REDACTED]"},
+		{"q=a+b%2Fc", "q=[REDACTED]"},
+		{"/a%20b%2Fc", "/[REDACTED]"},
+		{"abc", "abc"}, // too short
+	}
+	for _, tt := range tests {
+		if got := r.String(tt.input); got != tt.want {
+			t.Errorf("%s: want %s, got %s", tt.input, tt.want, got)
+		}
+	}
+
+	err := r.Error(errors.New("Get https://example.com/?access_token=very-secret: EOF"))
+	if want := "Get https://example.com/?access_token=[REDACTED]: EOF"; err.Error() != want {
+		t.Errorf("want %s, got %s", want, err.Error())
+	}
+
+	var nilRedactor *redactor
+	if got := nilRedactor.String("secret"); got != "secret" {
+		t.Errorf("want %s, got %s", "secret", got)
+	}
+	if newRedactor(nil) != nil {
+		t.Error("want nil, got non-nil")
+	}
+}
+
+type errorTransport struct{}
+
+func (errorTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	return nil, errors.New("connection refused")
+}
+
+func TestLambdaRedact(t *testing.T) {
+	ts := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		// echo the request.
+		w.Header().Set("Location", req.URL.String())
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprintf(w, "invalid request: %s %s", req.URL.RawQuery, req.Header.Get("Authorization"))
+	}))
+	defer ts.Close()
+
+	u, err := url.Parse(ts.URL)
+	if err != nil {
+		panic(err)
+	}
+	newMock := func(redactResponse string) *ssmMock {
+		params := []ssm.Parameter{
+			{
+				Name:  aws.String("/development/" + u.Host + "/headers/Authorization"),
+				Value: aws.String("token very-secret"),
+			},
+			{
+				Name:  aws.String("/development/" + u.Host + "/queries/access_token"),
+				Value: aws.String("secret/token"),
+			},
+		}
+		if redactResponse != "" {
+			params = append(params, ssm.Parameter{
+				Name:  aws.String("/development/" + u.Host + "/redact/response"),
+				Value: aws.String(redactResponse),
+			})
+		}
+		return &ssmMock{
+			output: &ssm.GetParametersByPathOutput{
+				Parameters: params,
+			},
+		}
+	}
+	newRequest := func() *Request {
+		req := httptest.NewRequest(http.MethodGet, ts.URL+"/", nil)
+		req.Header.Set("Accept-Encoding", "br")
+		r, err := NewRequest(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return r
+	}
+
+	t.Run("response", func(t *testing.T) {
+		l := &Lambda{
+			Prefix: "development",
+			Client: ts.Client(),
+			Audit:  &auditMock{},
+			svcssm: newMock(""),
+		}
+		resp, err := l.Handle(context.Background(), newRequest())
+		if err != nil {
+			t.Fatal(err)
+		}
+		want := "invalid request: access_token=[REDACTED] [REDACTED]"
+		if resp.Body != want {
+			t.Errorf("want %s, got %s", want, resp.Body)
+		}
+		if strings.Contains(resp.Headers["Location"], "secret") {
+			t.Errorf("the location header contains the secret: %s", resp.Headers["Location"])
+		}
+	})
+
+	t.Run("disabled", func(t *testing.T) {
+		l := &Lambda{
+			Prefix: "development",
+			Client: ts.Client(),
+			Audit:  &auditMock{},
+			svcssm: newMock("false"),
+		}
+		resp, err := l.Handle(context.Background(), newRequest())
+		if err != nil {
+			t.Fatal(err)
+		}
+		want := "invalid request: access_token=secret%2Ftoken token very-secret"
+		if resp.Body != want {
+			t.Errorf("want %s, got %s", want, resp.Body)
+		}
+	})
+
+	t.Run("error", func(t *testing.T) {
+		audit := &auditMock{}
+		l := &Lambda{
+			Prefix: "development",
+			Client: &http.Client{
+				Transport: errorTransport{},
+			},
+			Audit:  audit,
+			svcssm: newMock(""),
+		}
+		_, err := l.Handle(context.Background(), newRequest())
+		if err == nil {
+			t.Fatal("want error, got nil")
+		}
+		if strings.Contains(err.Error(), "secret") {
+			t.Errorf("the error contains the secret: %v", err)
+		}
+		if strings.Contains(audit.records[0].Error, "secret") {
+			t.Errorf("the audit log contains the secret: %s", audit.records[0].Error)
+		}
+	})
+}
+
+func TestIsSecretHeader(t *testing.T) {
+	tests := []struct {
+		name string
+		want bool
+	}{
+		{"Authorization", true},
+		{"X-Api-Key", true},
+		{"Private-Token", true},
+		{"X-Client-Secret", true},
+		{"Accept", false},
+		{"User-Agent", false},
+		{"X-GitHub-Api-Version", false},
+	}
+	for _, tt := range tests {
+		if got := isSecretHeader(tt.name); got != tt.want {
+			t.Errorf("%s: want %t, got %t", tt.name, tt.want, got)
+		}
+	}
+}
+
+func TestLambdaRedactNonSecret(t *testing.T) {
+	binary := "\x00\x01 token very-secret \x02"
+	ts := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.URL.Path == "/api/v3/download" {
+			w.Header().Set("Content-Type", "application/octet-stream")
+			fmt.Fprint(w, binary)
+			return
+		}
+		w.Header().Set("Content-Type", req.Header.Get("Accept"))
+		fmt.Fprintf(w, `{"version":%q,"path":%q,"internal":"internal-id"}`, req.Header.Get("X-GitHub-Api-Version"), req.URL.Path)
+	}))
+	defer ts.Close()
+
+	u, err := url.Parse(ts.URL)
+	if err != nil {
+		panic(err)
+	}
+	mock := &ssmMock{
+		output: &ssm.GetParametersByPathOutput{
+			Parameters: []ssm.Parameter{
+				{
+					Name:  aws.String("/" + u.Host + "/headers/Accept"),
+					Value: aws.String("application/json"),
+				},
+				{
+					Name:  aws.String("/" + u.Host + "/headers/X-GitHub-Api-Version"),
+					Value: aws.String("2022-11-28"),
+				},
+				{
+					Name:  aws.String("/" + u.Host + "/headers/Authorization"),
+					Value: aws.String("token very-secret"),
+				},
+				{
+					Name:  aws.String("/" + u.Host + "/rewrite/path"),
+					Value: aws.String("/api/v3/users"),
+				},
+				{
+					Name:  aws.String("/" + u.Host + "/redact/values"),
+					Value: aws.String("internal-id"),
+				},
+			},
+		},
+	}
+	l := &Lambda{
+		Client: ts.Client(),
+		Audit:  &auditMock{},
+		svcssm: mock,
+	}
+
+	r, err := NewRequest(httptest.NewRequest(http.MethodGet, ts.URL+"/", nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err := l.Handle(context.Background(), r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.Headers["Content-Type"] != "application/json" {
+		t.Errorf("want %s, got %s", "application/json", resp.Headers["Content-Type"])
+	}
+	want := `{"version":"2022-11-28","path":"/api/v3/users","internal":"[REDACTED]"}`
+	if resp.Body != want {
+		t.Errorf("want %s, got %s", want, resp.Body)
+	}
+
+	// binary downloads are not changed.
+	mock.output.Parameters[3].Value = aws.String("/api/v3/download")
+	l = &Lambda{
+		Client: ts.Client(),
+		Audit:  &auditMock{},
+		svcssm: mock,
+	}
+	resp, err = l.Handle(context.Background(), r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	httpresp, err := resp.Response()
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, err := ioutil.ReadAll(httpresp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(body) != binary {
+		t.Errorf("want %q, got %q", binary, string(body))
+	}
+}
+
+func TestLambdaRedactPath(t *testing.T) {
+	// the upstream is down.
+	ts := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {}))
+	ts.Close()
+
+	u, err := url.Parse(ts.URL)
+	if err != nil {
+		panic(err)
+	}
+	webhook := "/services/T00000000/B00000000/XXXXXXXXXXXXXXXXXXXXXXXX"
+	mock := &ssmMock{
+		output: &ssm.GetParametersByPathOutput{
+			Parameters: []ssm.Parameter{
+				{
+					Name:  aws.String("/" + u.Host + "/rewrite/path"),
+					Value: aws.String(webhook),
+				},
+			},
+		},
+	}
+	audit := &auditMock{}
+	l := &Lambda{
+		Client: ts.Client(),
+		Audit:  audit,
+		svcssm: mock,
+	}
+
+	r, err := NewRequest(httptest.NewRequest(http.MethodPost, ts.URL+"/", strings.NewReader(`{"text":"hello"}`)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = l.Handle(context.Background(), r)
+	if err == nil {
+		t.Fatal("want error, got nil")
+	}
+	if strings.Contains(err.Error(), webhook) {
+		t.Errorf("the error contains the secret: %v", err)
+	}
+	if !strings.Contains(err.Error(), redactedMarker) {
+		t.Errorf("want the redacted url, got %v", err)
+	}
+	if strings.Contains(audit.records[0].Error, webhook) {
+		t.Errorf("the audit log contains the secret: %s", audit.records[0].Error)
+	}
+}
@@ -0,0 +1,148 @@
+package proxy
+
+import (
+	"context"
+	"errors"
+	"sync"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/ssm"
+	"github.com/aws/aws-sdk-go-v2/service/ssm/ssmiface"
+)
+
+var errVersionConflict = errors.New("proxy: the parameter is updated by others")
+
+// refreshToken is the current refresh token, which rotates on every use.
+type refreshToken struct {
+	mu      sync.Mutex
+	value   string
+	version int64
+}
+
+func (t *refreshToken) get() (string, int64) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.value, t.version
+}
+
+func (t *refreshToken) set(value string, version int64) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.value = value
+	t.version = version
+}
+
+// update sets the token if it is newer than the current one.
+func (t *refreshToken) update(value string, version int64) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if version > t.version {
+		t.value = value
+		t.version = version
+	}
+}
+
+// refreshTokenStore is where the rotated refresh tokens are written back.
+type refreshTokenStore interface {
+	// load returns the current refresh token and its version.
+	load(ctx context.Context) (string, int64, error)
+
+	// save saves the refresh token, and returns the new version.
+	// It returns errVersionConflict if the token is updated by others after the version.
+	save(ctx context.Context, value string, version int64) (int64, error)
+}
+
+// ssmRefreshTokenStore stores the refresh token in AWS SSM Parameter Store.
+type ssmRefreshTokenStore struct {
+	svc  ssmiface.SSMAPI
+	name string
+
+	// kmsKeyID is the KMS key which encrypts the parameter. nil means that it is not described yet.
+	mu       sync.Mutex
+	kmsKeyID *string
+}
+
+func (s *ssmRefreshTokenStore) load(ctx context.Context) (string, int64, error) {
+	req := s.svc.GetParameterRequest(&ssm.GetParameterInput{
+		Name:           aws.String(s.name),
+		WithDecryption: aws.Bool(true),
+	})
+	req.SetContext(ctx)
+	resp, err := req.Send()
+	if err != nil {
+		return "", 0, err
+	}
+	return aws.StringValue(resp.Parameter.Value), aws.Int64Value(resp.Parameter.Version), nil
+}
+
+// save saves the refresh token with an optimistic version check.
+// AWS SSM Parameter Store has no conditional writes, so there is a small window
+// between the check and the write.
+func (s *ssmRefreshTokenStore) save(ctx context.Context, value string, version int64) (int64, error) {
+	_, current, err := s.load(ctx)
+	if err != nil {
+		return 0, err
+	}
+	if current != version {
+		return 0, errVersionConflict
+	}
+
+	// keep the KMS key, otherwise the token is re-encrypted by the default key aws/ssm.
+	keyID, err := s.keyID(ctx)
+	if err != nil {
+		return 0, err
+	}
+	input := &ssm.PutParameterInput{
+		Name:      aws.String(s.name),
+		Value:     aws.String(value),
+		Type:      ssm.ParameterTypeSecureString,
+		Overwrite: aws.Bool(true),
+	}
+	if keyID != "" {
+		input.KeyId = aws.String(keyID)
+	}
+	req := s.svc.PutParameterRequest(input)
+	req.SetContext(ctx)
+	resp, err := req.Send()
+	if err != nil {
+		return 0, err
+	}
+	return aws.Int64Value(resp.Version), nil
+}
+
+// keyID returns the KMS key which encrypts the parameter.
+// It is described once, and cached.
+func (s *ssmRefreshTokenStore) keyID(ctx context.Context) (string, error) {
+	s.mu.Lock()
+	cached := s.kmsKeyID
+	s.mu.Unlock()
+	if cached != nil {
+		return *cached, nil
+	}
+
+	req := s.svc.DescribeParametersRequest(&ssm.DescribeParametersInput{
+		ParameterFilters: []ssm.ParameterStringFilter{
+			{
+				Key:    aws.String("Name"),
+				Option: aws.String("Equals"),
+				Values: []string{s.name},
+			},
+		},
+	})
+	req.SetContext(ctx)
+	resp, err := req.Send()
+	if err != nil {
+		return "", err
+	}
+	var keyID string
+	for _, p := range resp.Parameters {
+		if aws.StringValue(p.Name) == s.name {
+			keyID = aws.StringValue(p.KeyId)
+		}
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.kmsKeyID = &keyID
+	return keyID, nil
+}
@@ -0,0 +1,399 @@
+package proxy
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/aws/awserr"
+	"github.com/aws/aws-sdk-go-v2/service/ssm"
+	"github.com/aws/aws-sdk-go-v2/service/ssm/ssmiface"
+)
+
+// parameterStoreMock is an in-memory AWS SSM Parameter Store.
+type parameterStoreMock struct {
+	ssmiface.SSMAPI
+	mu     sync.Mutex
+	params map[string]*ssm.Parameter
+	keyIDs map[string]string
+	puts   int
+}
+
+func newParameterStoreMock(params map[string]string) *parameterStoreMock {
+	mock := &parameterStoreMock{
+		params: map[string]*ssm.Parameter{},
+		keyIDs: map[string]string{},
+	}
+	for name, value := range params {
+		mock.params[name] = &ssm.Parameter{
+			Name:    aws.String(name),
+			Value:   aws.String(value),
+			Version: aws.Int64(1),
+		}
+	}
+	return mock
+}
+
+func (mock *parameterStoreMock) value(name string) (string, int64) {
+	mock.mu.Lock()
+	defer mock.mu.Unlock()
+	p, ok := mock.params[name]
+	if !ok {
+		return "", 0
+	}
+	return aws.StringValue(p.Value), aws.Int64Value(p.Version)
+}
+
+func (mock *parameterStoreMock) put(name, value string) {
+	mock.mu.Lock()
+	defer mock.mu.Unlock()
+	p := mock.params[name]
+	p.Value = aws.String(value)
+	p.Version = aws.Int64(aws.Int64Value(p.Version) + 1)
+}
+
+func (mock *parameterStoreMock) GetParametersByPathRequest(input *ssm.GetParametersByPathInput) ssm.GetParametersByPathRequest {
+	newRequest := func() *aws.Request {
+		mock.mu.Lock()
+		defer mock.mu.Unlock()
+		var names []string
+		for name := range mock.params {
+			if strings.HasPrefix(name, aws.StringValue(input.Path)+"/") {
+				names = append(names, name)
+			}
+		}
+		sort.Strings(names)
+		output := &ssm.GetParametersByPathOutput{}
+		for _, name := range names {
+			p := *mock.params[name]
+			output.Parameters = append(output.Parameters, p)
+		}
+		return &aws.Request{
+			Data:        output,
+			HTTPRequest: &http.Request{},
+			Operation:   &aws.Operation{},
+		}
+	}
+	return ssm.GetParametersByPathRequest{
+		Request: newRequest(),
+		Input:   input,
+		Copy: func(*ssm.GetParametersByPathInput) ssm.GetParametersByPathRequest {
+			return ssm.GetParametersByPathRequest{
+				Request: newRequest(),
+				Input:   &ssm.GetParametersByPathInput{},
+			}
+		},
+	}
+}
+
+func (mock *parameterStoreMock) GetParameterRequest(input *ssm.GetParameterInput) ssm.GetParameterRequest {
+	mock.mu.Lock()
+	defer mock.mu.Unlock()
+	req := &aws.Request{
+		HTTPRequest: &http.Request{},
+		Operation:   &aws.Operation{},
+	}
+	if p, ok := mock.params[aws.StringValue(input.Name)]; ok {
+		copied := *p
+		req.Data = &ssm.GetParameterOutput{
+			Parameter: &copied,
+		}
+	} else {
+		req.Error = awserr.New(ssm.ErrCodeParameterNotFound, "not found", nil)
+	}
+	return ssm.GetParameterRequest{
+		Request: req,
+		Input:   input,
+	}
+}
+
+func (mock *parameterStoreMock) PutParameterRequest(input *ssm.PutParameterInput) ssm.PutParameterRequest {
+	mock.mu.Lock()
+	defer mock.mu.Unlock()
+	mock.puts++
+	name := aws.StringValue(input.Name)
+	p, ok := mock.params[name]
+	if !ok {
+		p = &ssm.Parameter{
+			Name: input.Name,
+		}
+		mock.params[name] = p
+	}
+	p.Value = input.Value
+	p.Type = input.Type
+	p.Version = aws.Int64(aws.Int64Value(p.Version) + 1)
+	if input.Type == ssm.ParameterTypeSecureString {
+		// AWS SSM Parameter Store uses the default key if KeyId is omitted.
+		keyID := aws.StringValue(input.KeyId)
+		if keyID == "" {
+			keyID = "alias/aws/ssm"
+		}
+		mock.keyIDs[name] = keyID
+	}
+	return ssm.PutParameterRequest{
+		Request: &aws.Request{
+			Data: &ssm.PutParameterOutput{
+				Version: p.Version,
+			},
+			HTTPRequest: &http.Request{},
+			Operation:   &aws.Operation{},
+		},
+		Input: input,
+	}
+}
+
+func (mock *parameterStoreMock) DeleteParameterRequest(input *ssm.DeleteParameterInput) ssm.DeleteParameterRequest {
+	mock.mu.Lock()
+	defer mock.mu.Unlock()
+	req := &aws.Request{
+		Data:        &ssm.DeleteParameterOutput{},
+		HTTPRequest: &http.Request{},
+		Operation:   &aws.Operation{},
+	}
+	name := aws.StringValue(input.Name)
+	if _, ok := mock.params[name]; ok {
+		delete(mock.params, name)
+		delete(mock.keyIDs, name)
+	} else {
+		req.Error = awserr.New(ssm.ErrCodeParameterNotFound, "not found", nil)
+	}
+	return ssm.DeleteParameterRequest{
+		Request: req,
+		Input:   input,
+	}
+}
+
+func (mock *parameterStoreMock) DescribeParametersRequest(input *ssm.DescribeParametersInput) ssm.DescribeParametersRequest {
+	mock.mu.Lock()
+	defer mock.mu.Unlock()
+	output := &ssm.DescribeParametersOutput{}
+	for _, f := range input.ParameterFilters {
+		if aws.StringValue(f.Key) != "Name" || aws.StringValue(f.Option) != "Equals" {
+			continue
+		}
+		for _, name := range f.Values {
+			if _, ok := mock.params[name]; !ok {
+				continue
+			}
+			m := ssm.ParameterMetadata{
+				Name: aws.String(name),
+			}
+			if keyID, ok := mock.keyIDs[name]; ok {
+				m.KeyId = aws.String(keyID)
+			}
+			output.Parameters = append(output.Parameters, m)
+		}
+	}
+	return ssm.DescribeParametersRequest{
+		Request: &aws.Request{
+			Data:        output,
+			HTTPRequest: &http.Request{},
+			Operation:   &aws.Operation{},
+		},
+		Input: input,
+	}
+}
+
+// fakeRefreshTokenServer rotates the refresh token on every use.
+type fakeRefreshTokenServer struct {
+	mu      sync.Mutex
+	current string
+	issued  int
+}
+
+func (s *fakeRefreshTokenServer) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	if err := req.ParseForm(); err != nil {
+		panic(err)
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	w.Header().Set("Content-Type", "application/json")
+	if req.PostForm.Get("grant_type") != "refresh_token" || req.PostForm.Get("refresh_token") != s.current {
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprint(w, `{"error":"invalid_grant"}`)
+		return
+	}
+	s.issued++
+	s.current = fmt.Sprintf("refresh-%d", s.issued+1)
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"access_token":  fmt.Sprintf("access-%d", s.issued),
+		"token_type":    "Bearer",
+		"expires_in":    3600,
+		"refresh_token": s.current,
+	})
+}
+
+func TestLambdaOAuth2RefreshToken(t *testing.T) {
+	const name = "/example.com/oauth2/refresh_token"
+	newLambda := func(auth *httptest.Server, store *parameterStoreMock) *Lambda {
+		return &Lambda{
+			Client: auth.Client(),
+			svcssm: store,
+		}
+	}
+	newStore := func(tokenURL, refreshToken string) *parameterStoreMock {
+		return newParameterStoreMock(map[string]string{
+			"/example.com/oauth2/token_url":     tokenURL,
+			"/example.com/oauth2/client_id":     "client-id",
+			"/example.com/oauth2/client_secret": "client-secret",
+			name:                                refreshToken,
+		})
+	}
+	sign := func(t *testing.T, l *Lambda) string {
+		param, err := l.getParam(context.Background(), "example.com")
+		if err != nil {
+			t.Fatal(err)
+		}
+		req := httptest.NewRequest(http.MethodGet, "https://example.com/", nil)
+		if err := param.Sign(req); err != nil {
+			t.Fatal(err)
+		}
+		return req.Header.Get("Authorization")
+	}
+
+	t.Run("write back", func(t *testing.T) {
+		server := &fakeRefreshTokenServer{current: "refresh-1"}
+		auth := httptest.NewTLSServer(server)
+		defer auth.Close()
+		store := newStore(auth.URL, "refresh-1")
+		l := newLambda(auth, store)
+
+		if got := sign(t, l); got != "Bearer access-1" {
+			t.Errorf("want %s, got %s", "Bearer access-1", got)
+		}
+		value, version := store.value(name)
+		if value != "refresh-2" || version != 2 {
+			t.Errorf("want (%s, %d), got (%s, %d)", "refresh-2", 2, value, version)
+		}
+
+		// the next refresh uses the rotated token.
+		l.peekCache("example.com").OAuth2.tokens.invalidate()
+		if got := sign(t, l); got != "Bearer access-2" {
+			t.Errorf("want %s, got %s", "Bearer access-2", got)
+		}
+		if value, _ := store.value(name); value != "refresh-3" {
+			t.Errorf("want %s, got %s", "refresh-3", value)
+		}
+	})
+
+	t.Run("rotated by another container", func(t *testing.T) {
+		server := &fakeRefreshTokenServer{current: "refresh-1"}
+		auth := httptest.NewTLSServer(server)
+		defer auth.Close()
+		store := newStore(auth.URL, "refresh-1")
+		l := newLambda(auth, store)
+		if _, err := l.getParam(context.Background(), "example.com"); err != nil {
+			t.Fatal(err)
+		}
+
+		// another container uses refresh-1, and writes back refresh-2.
+		server.current = "refresh-2"
+		server.issued = 1
+		store.put(name, "refresh-2")
+
+		if got := sign(t, l); got != "Bearer access-2" {
+			t.Errorf("want %s, got %s", "Bearer access-2", got)
+		}
+		value, version := store.value(name)
+		if value != "refresh-3" || version != 3 {
+			t.Errorf("want (%s, %d), got (%s, %d)", "refresh-3", 3, value, version)
+		}
+	})
+
+	t.Run("parameter change events", func(t *testing.T) {
+		const generation = "/ssm-sign-proxy/generation"
+		server := &fakeRefreshTokenServer{current: "refresh-1"}
+		auth := httptest.NewTLSServer(server)
+		defer auth.Close()
+		store := newStore(auth.URL, "refresh-1")
+		l := newLambda(auth, store)
+		l.GenerationParameter = generation
+		l.GenerationCheckInterval = 1
+		event := func(operation, name string) {
+			err := l.HandleParameterChange(context.Background(), &ParameterChangeEvent{
+				ID: "9547ef2d-3b7e-4057-b6cb-5fdf09ee7c8f",
+				Detail: ParameterChangeDetail{
+					Operation: operation,
+					Name:      name,
+					Type:      "SecureString",
+				},
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		if got := sign(t, l); got != "Bearer access-1" {
+			t.Errorf("want %s, got %s", "Bearer access-1", got)
+		}
+
+		// writing back the rotated token doesn't purge the cache of all containers.
+		event("Update", name)
+		if _, version := store.value(generation); version != 0 {
+			t.Errorf("want %d, got %d", 0, version)
+		}
+
+		// the token cache survives evicting and purging the cache.
+		event("Update", "/example.com/oauth2/client_id")
+		if _, version := store.value(generation); version != 1 {
+			t.Errorf("want %d, got %d", 1, version)
+		}
+		if got := sign(t, l); got != "Bearer access-1" {
+			t.Errorf("want %s, got %s", "Bearer access-1", got)
+		}
+		store.put(generation, "updated by another container")
+		if got := sign(t, l); got != "Bearer access-1" {
+			t.Errorf("want %s, got %s", "Bearer access-1", got)
+		}
+		if server.issued != 1 {
+			t.Errorf("want %d, got %d", 1, server.issued)
+		}
+		value, version := store.value(name)
+		if value != "refresh-2" || version != 2 {
+			t.Errorf("want (%s, %d), got (%s, %d)", "refresh-2", 2, value, version)
+		}
+	})
+
+	t.Run("customer managed key", func(t *testing.T) {
+		store := newParameterStoreMock(map[string]string{
+			name: "refresh-1",
+		})
+		store.keyIDs[name] = "alias/custom"
+		s := &ssmRefreshTokenStore{
+			svc:  store,
+			name: name,
+		}
+		for version := int64(1); version <= 2; version++ {
+			if _, err := s.save(context.Background(), fmt.Sprintf("refresh-%d", version+1), version); err != nil {
+				t.Fatal(err)
+			}
+			if got := store.keyIDs[name]; got != "alias/custom" {
+				t.Errorf("want %s, got %s", "alias/custom", got)
+			}
+		}
+	})
+
+	t.Run("version conflict", func(t *testing.T) {
+		store := newParameterStoreMock(map[string]string{
+			name: "refresh-1",
+		})
+		s := &ssmRefreshTokenStore{
+			svc:  store,
+			name: name,
+		}
+		store.put(name, "refresh-x")
+		if _, err := s.save(context.Background(), "refresh-2", 1); err != errVersionConflict {
+			t.Errorf("want errVersionConflict, got %v", err)
+		}
+		if value, _ := store.value(name); value != "refresh-x" {
+			t.Errorf("want %s, got %s", "refresh-x", value)
+		}
+	})
+}
@@ -1,6 +1,7 @@
 package proxy
 
 import (
+	"bytes"
 	"encoding/base64"
 	"io"
 	"io/ioutil"
@@ -22,17 +23,35 @@ type Request struct {
 	RequestContext                  RequestContext      `json:"requestContext"`
 	IsBase64Encoded                 bool                `json:"isBase64Encoded"`
 	Body                            string              `json:"body"`
+
+	// BodyEncoding is the encoding of the body, e.g. BodyEncodingGzip. Empty means no encoding.
+	BodyEncoding string `json:"bodyEncoding,omitempty"`
+
+	// AcceptBodyEncodings is the list of body encodings that the proxy understands.
+	AcceptBodyEncodings []string `json:"acceptBodyEncodings,omitempty"`
 }
 
 // RequestContext contains the information to identify the instance invoking the lambda
 type RequestContext struct {
 	Instance InstanceContext `json:"instance"`
+	Identity IdentityContext `json:"identity"`
 }
 
 // InstanceContext contains the information to identify the ARN invoking the lambda
 type InstanceContext struct {
 	InstanceID string `json:"instance_id"`
 	Hostname   string `json:"hostname"`
+
+	// ECS task
+	TaskARN string `json:"task_arn,omitempty"`
+	Cluster string `json:"cluster,omitempty"`
+
+	// Kubernetes pod
+	PodName      string `json:"pod_name,omitempty"`
+	PodNamespace string `json:"pod_namespace,omitempty"`
+
+	// Tags are the static tags configured in the proxy.
+	Tags map[string]string `json:"tags,omitempty"`
 }
 
 // Response configures the response to be returned by the ALB Lambda target group for the request
@@ -43,6 +62,12 @@ type Response struct {
 	MultiValueHeaders map[string][]string `json:"multiValueHeaders"`
 	Body              string              `json:"body"`
 	IsBase64Encoded   bool                `json:"isBase64Encoded"`
+
+	// BodyEncoding is the encoding of the body, e.g. BodyEncodingGzip. Empty means no encoding.
+	BodyEncoding string `json:"bodyEncoding,omitempty"`
+
+	// AcceptBodyEncodings is the list of body encodings that the function understands.
+	AcceptBodyEncodings []string `json:"acceptBodyEncodings,omitempty"`
 }
 
 // NewRequest converts the request to AWS Lambda event.
@@ -92,7 +117,13 @@ func NewRequest(req *http.Request) (*Request, error) {
 func (req *Request) Request() (*http.Request, error) {
 	// build the body
 	var body io.Reader = strings.NewReader(req.Body)
-	if req.IsBase64Encoded {
+	if req.BodyEncoding != "" {
+		b, err := decodeBody(req.Body, req.IsBase64Encoded, req.BodyEncoding)
+		if err != nil {
+			return nil, err
+		}
+		body = bytes.NewReader(b)
+	} else if req.IsBase64Encoded {
 		body = base64.NewDecoder(base64.StdEncoding, body)
 	}
 
@@ -108,20 +139,7 @@ func (req *Request) Request() (*http.Request, error) {
 	}
 
 	// build the headers
-	var h http.Header
-	if len(req.MultiValueHeaders) > 0 {
-		h = make(http.Header, len(req.MultiValueHeaders))
-		for k, vv := range req.MultiValueHeaders {
-			for _, v := range vv {
-				h.Add(k, v)
-			}
-		}
-	} else {
-		h = make(http.Header, len(req.Headers))
-		for k, v := range req.Headers {
-			h.Set(k, v)
-		}
-	}
+	h := req.header()
 
 	// build the target url
 	host := h.Get("Host")
@@ -144,6 +162,24 @@ func (req *Request) Request() (*http.Request, error) {
 	return httpreq, nil
 }
 
+func (req *Request) header() http.Header {
+	var h http.Header
+	if len(req.MultiValueHeaders) > 0 {
+		h = make(http.Header, len(req.MultiValueHeaders))
+		for k, vv := range req.MultiValueHeaders {
+			for _, v := range vv {
+				h.Add(k, v)
+			}
+		}
+	} else {
+		h = make(http.Header, len(req.Headers))
+		for k, v := range req.Headers {
+			h.Set(k, v)
+		}
+	}
+	return h
+}
+
 // NewResponse returns new Response.
 func NewResponse(resp *http.Response) (*Response, error) {
 	body, isBase64, err := readAll(resp.Body)
@@ -183,45 +219,33 @@ func (resp *Response) WriteTo(w http.ResponseWriter) error {
 	}
 
 	// parse the body
-	var body []byte
-	if resp.IsBase64Encoded {
-		var err error
-		body, err = base64.StdEncoding.DecodeString(resp.Body)
-		if err != nil {
-			return err
-		}
-	} else {
-		body = []byte(resp.Body)
+	body, err := decodeBody(resp.Body, resp.IsBase64Encoded, resp.BodyEncoding)
+	if err != nil {
+		return err
 	}
 
 	// parse status code
 	header.Set("Content-Length", strconv.Itoa(len(body)))
 	w.WriteHeader(resp.StatusCode)
 
-	_, err := w.Write(body)
+	_, err = w.Write(body)
 	return err
 }
 
 // Response returns http.Response.
 func (resp *Response) Response() (*http.Response, error) {
-	var header http.Header
-	if len(resp.MultiValueHeaders) > 0 {
-		header = make(http.Header, len(resp.MultiValueHeaders))
-		for k, vv := range resp.MultiValueHeaders {
-			for _, v := range vv {
-				header.Add(k, v)
-			}
-		}
-	} else {
-		header = make(http.Header, len(resp.Headers))
-		for k, v := range resp.Headers {
-			header.Set(k, v)
-		}
-	}
+	header := resp.header()
 
 	var body io.Reader = strings.NewReader(resp.Body)
 	length := int64(len(resp.Body))
-	if resp.IsBase64Encoded {
+	if resp.BodyEncoding != "" {
+		b, err := decodeBody(resp.Body, resp.IsBase64Encoded, resp.BodyEncoding)
+		if err != nil {
+			return nil, err
+		}
+		body = bytes.NewReader(b)
+		length = int64(len(b))
+	} else if resp.IsBase64Encoded {
 		body = base64.NewDecoder(base64.StdEncoding, body)
 		length = int64(base64.StdEncoding.DecodedLen(len(resp.Body)))
 	}
@@ -238,6 +262,24 @@ func (resp *Response) Response() (*http.Response, error) {
 	}, nil
 }
 
+func (resp *Response) header() http.Header {
+	var header http.Header
+	if len(resp.MultiValueHeaders) > 0 {
+		header = make(http.Header, len(resp.MultiValueHeaders))
+		for k, vv := range resp.MultiValueHeaders {
+			for _, v := range vv {
+				header.Add(k, v)
+			}
+		}
+	} else {
+		header = make(http.Header, len(resp.Headers))
+		for k, v := range resp.Headers {
+			header.Set(k, v)
+		}
+	}
+	return header
+}
+
 func cloneHeader(h http.Header) http.Header {
 	h2 := make(http.Header, len(h))
 	for k, vv := range h {
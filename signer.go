@@ -0,0 +1,126 @@
+package proxy
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// signer signs messages.
+// The signatures are in the format of HTTP Message Signatures and JWS,
+// e.g. ECDSA signatures are the concatenation of r and s.
+type signer interface {
+	Sign(ctx context.Context, message []byte) ([]byte, error)
+}
+
+// signerFunc is an adapter to use functions as signers.
+type signerFunc func(ctx context.Context, message []byte) ([]byte, error)
+
+func (f signerFunc) Sign(ctx context.Context, message []byte) ([]byte, error) {
+	return f(ctx, message)
+}
+
+// newKeySigner returns the signer of the algorithm.
+// The names of the algorithms are from the HTTP Signature Algorithms registry.
+// The key is a base64 encoded secret for hmac-sha256, and a PEM encoded private key for the others.
+func newKeySigner(alg, key string) (signer, error) {
+	if key == "" {
+		return nil, errors.New("proxy: the key is empty")
+	}
+	if alg == "hmac-sha256" {
+		secret, err := base64.StdEncoding.DecodeString(strings.TrimSpace(key))
+		if err != nil {
+			return nil, fmt.Errorf("proxy: the key of hmac-sha256 must be base64 encoded: %v", err)
+		}
+		return signerFunc(func(ctx context.Context, message []byte) ([]byte, error) {
+			mac := hmac.New(crypto.SHA256.New, secret)
+			mac.Write(message)
+			return mac.Sum(nil), nil
+		}), nil
+	}
+
+	priv, err := parsePrivateKey(key)
+	if err != nil {
+		return nil, err
+	}
+	switch alg {
+	case "ed25519":
+		if k, ok := priv.(ed25519.PrivateKey); ok {
+			return signerFunc(func(ctx context.Context, message []byte) ([]byte, error) {
+				return ed25519.Sign(k, message), nil
+			}), nil
+		}
+	case "ecdsa-p256-sha256":
+		if k, ok := priv.(*ecdsa.PrivateKey); ok && k.Curve == elliptic.P256() {
+			return ecdsaSigner(k, crypto.SHA256), nil
+		}
+	case "ecdsa-p384-sha384":
+		if k, ok := priv.(*ecdsa.PrivateKey); ok && k.Curve == elliptic.P384() {
+			return ecdsaSigner(k, crypto.SHA384), nil
+		}
+	case "rsa-pss-sha512":
+		if k, ok := priv.(*rsa.PrivateKey); ok {
+			return signerFunc(func(ctx context.Context, message []byte) ([]byte, error) {
+				opts := &rsa.PSSOptions{SaltLength: rsa.PSSSaltLengthEqualsHash}
+				return rsa.SignPSS(rand.Reader, k, crypto.SHA512, digest(crypto.SHA512, message), opts)
+			}), nil
+		}
+	case "rsa-v1_5-sha256":
+		if k, ok := priv.(*rsa.PrivateKey); ok {
+			return signerFunc(func(ctx context.Context, message []byte) ([]byte, error) {
+				return rsa.SignPKCS1v15(rand.Reader, k, crypto.SHA256, digest(crypto.SHA256, message))
+			}), nil
+		}
+	default:
+		return nil, fmt.Errorf("proxy: unknown algorithm %q", alg)
+	}
+	return nil, fmt.Errorf("proxy: the key doesn't match the algorithm %q", alg)
+}
+
+func ecdsaSigner(k *ecdsa.PrivateKey, hash crypto.Hash) signer {
+	size := (k.Curve.Params().BitSize + 7) / 8
+	return signerFunc(func(ctx context.Context, message []byte) ([]byte, error) {
+		r, s, err := ecdsa.Sign(rand.Reader, k, digest(hash, message))
+		if err != nil {
+			return nil, err
+		}
+		sig := make([]byte, 2*size)
+		r.FillBytes(sig[:size])
+		s.FillBytes(sig[size:])
+		return sig, nil
+	})
+}
+
+func digest(hash crypto.Hash, message []byte) []byte {
+	h := hash.New()
+	h.Write(message)
+	return h.Sum(nil)
+}
+
+// parsePrivateKey parses the PEM encoded private key in PKCS #8, PKCS #1 or SEC 1.
+func parsePrivateKey(key string) (interface{}, error) {
+	block, _ := pem.Decode([]byte(key))
+	if block == nil {
+		return nil, errors.New("proxy: the private key is not PEM encoded")
+	}
+	switch block.Type {
+	case "PRIVATE KEY":
+		return x509.ParsePKCS8PrivateKey(block.Bytes)
+	case "RSA PRIVATE KEY":
+		return x509.ParsePKCS1PrivateKey(block.Bytes)
+	case "EC PRIVATE KEY":
+		return x509.ParseECPrivateKey(block.Bytes)
+	}
+	return nil, fmt.Errorf("proxy: unknown type of the private key %q", block.Type)
+}
@@ -0,0 +1,125 @@
+package proxy
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"math/big"
+	"testing"
+)
+
+func marshalPKCS8(t *testing.T, key interface{}) string {
+	t.Helper()
+	der, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der}))
+}
+
+func TestKeySigner(t *testing.T) {
+	message := []byte("hello world")
+	p256, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p384, err := ecdsa.GenerateKey(elliptic.P384(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ecDER, err := x509.MarshalECPrivateKey(p256)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	verifyECDSA := func(pub *ecdsa.PublicKey, hash crypto.Hash) func([]byte) bool {
+		return func(sig []byte) bool {
+			size := (pub.Curve.Params().BitSize + 7) / 8
+			if len(sig) != 2*size {
+				return false
+			}
+			r := new(big.Int).SetBytes(sig[:size])
+			s := new(big.Int).SetBytes(sig[size:])
+			return ecdsa.Verify(pub, digest(hash, message), r, s)
+		}
+	}
+	cases := []struct {
+		alg    string
+		key    string
+		verify func([]byte) bool
+	}{
+		{
+			alg:    "ecdsa-p256-sha256",
+			key:    marshalPKCS8(t, p256),
+			verify: verifyECDSA(&p256.PublicKey, crypto.SHA256),
+		},
+		{
+			alg:    "ecdsa-p256-sha256",
+			key:    string(pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: ecDER})),
+			verify: verifyECDSA(&p256.PublicKey, crypto.SHA256),
+		},
+		{
+			alg:    "ecdsa-p384-sha384",
+			key:    marshalPKCS8(t, p384),
+			verify: verifyECDSA(&p384.PublicKey, crypto.SHA384),
+		},
+		{
+			alg: "rsa-pss-sha512",
+			key: marshalPKCS8(t, rsaKey),
+			verify: func(sig []byte) bool {
+				return rsa.VerifyPSS(&rsaKey.PublicKey, crypto.SHA512, digest(crypto.SHA512, message), sig, nil) == nil
+			},
+		},
+		{
+			alg: "rsa-v1_5-sha256",
+			key: string(pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(rsaKey)})),
+			verify: func(sig []byte) bool {
+				return rsa.VerifyPKCS1v15(&rsaKey.PublicKey, crypto.SHA256, digest(crypto.SHA256, message), sig) == nil
+			},
+		},
+	}
+	for _, tc := range cases {
+		t.Run(tc.alg, func(t *testing.T) {
+			s, err := newKeySigner(tc.alg, tc.key)
+			if err != nil {
+				t.Fatal(err)
+			}
+			sig, err := s.Sign(context.Background(), message)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !tc.verify(sig) {
+				t.Error("invalid signature")
+			}
+		})
+	}
+
+	t.Run("errors", func(t *testing.T) {
+		errors := []struct {
+			name string
+			alg  string
+			key  string
+		}{
+			{"unknown algorithm", "rsa-v1_5-sha1", marshalPKCS8(t, rsaKey)},
+			{"mismatched key", "ed25519", marshalPKCS8(t, rsaKey)},
+			{"mismatched curve", "ecdsa-p256-sha256", marshalPKCS8(t, p384)},
+			{"not pem", "ecdsa-p256-sha256", "secret"},
+			{"not base64", "hmac-sha256", "!!"},
+			{"empty", "hmac-sha256", ""},
+		}
+		for _, tc := range errors {
+			if _, err := newKeySigner(tc.alg, tc.key); err == nil {
+				t.Errorf("%s: want error, got nil", tc.name)
+			}
+		}
+	})
+}
@@ -0,0 +1,110 @@
+package proxy
+
+import (
+	"bytes"
+	"errors"
+	"net/http"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/aws/signer/v4"
+	"github.com/aws/aws-sdk-go-v2/aws/stscreds"
+	"github.com/aws/aws-sdk-go-v2/service/sts"
+)
+
+// timeNow returns the current time. It is replaced in tests.
+var timeNow = time.Now
+
+// hopByHopHeaders are removed by the proxies and the transports, so they must not be signed.
+var hopByHopHeaders = []string{
+	"Connection",
+	"Proxy-Connection",
+	"Keep-Alive",
+	"Te",
+	"Trailer",
+	"Transfer-Encoding",
+	"Upgrade",
+}
+
+// SigV4 is the parameter for signing requests with AWS Signature Version 4.
+type SigV4 struct {
+	// Service is the signing name of the service, e.g. "execute-api" and "es".
+	Service string
+
+	// Region is the signing region, e.g. "us-east-1".
+	Region string
+
+	// RoleARN is the role assumed for signing. If it is empty, the credentials of the function are used.
+	RoleARN string
+
+	// ExternalID is the external id for assuming RoleARN.
+	ExternalID string
+
+	credentials aws.CredentialsProvider
+}
+
+// set sets the parameter sigv4/{name}.
+func (s *SigV4) set(name, value string) {
+	switch name {
+	case "service":
+		s.Service = value
+	case "region":
+		s.Region = value
+	case "role_arn":
+		s.RoleARN = value
+	case "external_id":
+		s.ExternalID = value
+	}
+}
+
+// Sign signs the request.
+func (s *SigV4) Sign(req *http.Request) error {
+	if s.Service == "" || s.Region == "" {
+		return errors.New("proxy: sigv4/service and sigv4/region are required")
+	}
+	if s.credentials == nil {
+		return errors.New("proxy: the credentials for sigv4 are not configured")
+	}
+
+	// the Host header is sent from req.Host.
+	if host := req.Header.Get("Host"); host != "" {
+		req.Host = host
+		req.Header.Del("Host")
+	}
+	for _, h := range hopByHopHeaders {
+		req.Header.Del(h)
+	}
+
+	body, err := bufferBody(req)
+	if err != nil {
+		return err
+	}
+
+	signer := v4.NewSigner(s.credentials)
+	_, err = signer.Sign(req, bytes.NewReader(body), s.Service, s.Region, timeNow())
+	return err
+}
+
+// assumeRoleCredentials returns the credentials of the role.
+// The credentials are shared among the hosts, and are cached until they expire.
+func (l *Lambda) assumeRoleCredentials(roleARN, externalID string) aws.CredentialsProvider {
+	if roleARN == "" {
+		return l.Config.Credentials
+	}
+
+	l.credentialsMu.Lock()
+	defer l.credentialsMu.Unlock()
+	key := roleARN + "\n" + externalID
+	if p, ok := l.credentials[key]; ok {
+		return p
+	}
+	p := stscreds.NewAssumeRoleProvider(sts.New(l.Config), roleARN)
+	if externalID != "" {
+		p.ExternalID = aws.String(externalID)
+	}
+	if l.credentials == nil {
+		l.credentials = make(map[string]aws.CredentialsProvider)
+	}
+	l.credentials[key] = p
+	return p
+}
@@ -0,0 +1,153 @@
+package proxy
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/aws/signer/v4"
+	"github.com/aws/aws-sdk-go-v2/service/ssm"
+)
+
+func setTimeNow(t time.Time) func() {
+	orig := timeNow
+	timeNow = func() time.Time { return t }
+	return func() { timeNow = orig }
+}
+
+var testCredentials = aws.NewStaticCredentialsProvider("AKIDEXAMPLE", "wJalrXUtnFEMI/K7MDENG+bPxRfiCYEXAMPLEKEY", "")
+
+func TestSigV4(t *testing.T) {
+	// get-vanilla in the AWS Signature Version 4 test suite.
+	defer setTimeNow(time.Date(2015, 8, 30, 12, 36, 0, 0, time.UTC))()
+	s := &SigV4{
+		Service:     "service",
+		Region:      "us-east-1",
+		credentials: testCredentials,
+	}
+	req, err := http.NewRequest(http.MethodGet, "https://example.amazonaws.com/", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Host", "example.amazonaws.com")
+	if err := s.Sign(req); err != nil {
+		t.Fatal(err)
+	}
+	want := "AWS4-HMAC-SHA256 Credential=AKIDEXAMPLE/20150830/us-east-1/service/aws4_request, " +
+		"SignedHeaders=host;x-amz-date, " +
+		"Signature=5fa00fa31553b73ebf1942676e86291e8372ff2a2260956d9b8aae1d763fbf31"
+	if got := req.Header.Get("Authorization"); got != want {
+		t.Errorf("want %s, got %s", want, got)
+	}
+}
+
+func TestLambdaSigV4(t *testing.T) {
+	signTime := time.Date(2015, 8, 30, 12, 36, 0, 0, time.UTC)
+	defer setTimeNow(signTime)()
+
+	ts := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.URL.Path != "/prod/items" || req.URL.Query().Get("api_key") != "very-secret" {
+			t.Errorf("the request is not rewritten: %s", req.URL)
+		}
+
+		// sign the received request again, and compare the signatures.
+		auth := req.Header.Get("Authorization")
+		idx := strings.Index(auth, "SignedHeaders=")
+		if idx < 0 {
+			t.Errorf("the request is not signed: %s", auth)
+			http.Error(w, "NG", http.StatusForbidden)
+			return
+		}
+		signed := strings.Split(strings.SplitN(auth[idx+len("SignedHeaders="):], ",", 2)[0], ";")
+		r, err := http.NewRequest(req.Method, "https://"+req.Host+req.URL.RequestURI(), req.Body)
+		if err != nil {
+			panic(err)
+		}
+		for _, h := range signed {
+			if h != "host" && h != "x-amz-date" {
+				r.Header[http.CanonicalHeaderKey(h)] = req.Header[http.CanonicalHeaderKey(h)]
+			}
+		}
+		if _, err := v4.NewSigner(testCredentials).Sign(r, strings.NewReader(""), "execute-api", "ap-northeast-1", signTime); err != nil {
+			panic(err)
+		}
+		if r.Header.Get("Authorization") != auth {
+			t.Errorf("want %s, got %s", r.Header.Get("Authorization"), auth)
+		}
+		fmt.Fprint(w, "ok")
+	}))
+	defer ts.Close()
+
+	u, err := url.Parse(ts.URL)
+	if err != nil {
+		panic(err)
+	}
+	mock := &ssmMock{
+		output: &ssm.GetParametersByPathOutput{
+			Parameters: []ssm.Parameter{
+				{
+					Name:  aws.String("/" + u.Host + "/rewrite/path"),
+					Value: aws.String("/prod/items"),
+				},
+				{
+					Name:  aws.String("/" + u.Host + "/queries/api_key"),
+					Value: aws.String("very-secret"),
+				},
+				{
+					Name:  aws.String("/" + u.Host + "/sigv4/service"),
+					Value: aws.String("execute-api"),
+				},
+				{
+					Name:  aws.String("/" + u.Host + "/sigv4/region"),
+					Value: aws.String("ap-northeast-1"),
+				},
+			},
+		},
+	}
+	l := &Lambda{
+		Config: aws.Config{
+			Credentials: testCredentials,
+		},
+		Client: ts.Client(),
+		Audit:  &auditMock{},
+		svcssm: mock,
+	}
+	req := httptest.NewRequest(http.MethodGet, ts.URL+"/items", nil)
+	req.Header.Set("Connection", "keep-alive")
+	r, err := NewRequest(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err := l.Handle(context.Background(), r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("want %d, got %d", http.StatusOK, resp.StatusCode)
+	}
+}
+
+func TestAssumeRoleCredentials(t *testing.T) {
+	l := &Lambda{
+		Config: aws.Config{
+			Credentials: testCredentials,
+		},
+	}
+	if l.assumeRoleCredentials("", "") != testCredentials {
+		t.Error("want the credentials of the function")
+	}
+	p1 := l.assumeRoleCredentials("arn:aws:iam::123456789012:role/foo", "bar")
+	p2 := l.assumeRoleCredentials("arn:aws:iam::123456789012:role/foo", "bar")
+	if p1 != p2 {
+		t.Error("want the cached credentials")
+	}
+	if p3 := l.assumeRoleCredentials("arn:aws:iam::123456789012:role/foo", "baz"); p1 == p3 {
+		t.Error("want the credentials for another external id")
+	}
+}
@@ -0,0 +1,223 @@
+package proxy
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"math/rand"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/aws/awserr"
+	"github.com/aws/aws-sdk-go-v2/service/secretsmanager"
+	"github.com/aws/aws-sdk-go-v2/service/secretsmanager/secretsmanageriface"
+	"github.com/aws/aws-sdk-go-v2/service/ssm"
+	"github.com/aws/aws-sdk-go-v2/service/ssm/ssmiface"
+)
+
+const (
+	// maxThrottleRetries is the maximum number of retries for throttled requests.
+	maxThrottleRetries = 3
+
+	// throttleBaseDelay is the base delay of the exponential backoff.
+	throttleBaseDelay = 100 * time.Millisecond
+)
+
+// Source resolves a host to the Parameter.
+type Source interface {
+	// GetParameter returns the parameter of the host.
+	// It returns ErrParamNotFound if the host has no parameters.
+	GetParameter(ctx context.Context, host string) (*Parameter, error)
+}
+
+// SSMSource gets the parameters from AWS SSM Parameter Store.
+// The parameters of the host are /{Prefix}/{host}/{type}/{name}.
+type SSMSource struct {
+	Config aws.Config
+	Prefix string
+
+	mu     sync.Mutex
+	svcssm ssmiface.SSMAPI
+}
+
+func (s *SSMSource) ssm() ssmiface.SSMAPI {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.svcssm == nil {
+		s.svcssm = ssm.New(s.Config)
+	}
+	return s.svcssm
+}
+
+// GetParameter implements Source.
+func (s *SSMSource) GetParameter(ctx context.Context, host string) (*Parameter, error) {
+	base := path.Join("/", s.Prefix, host)
+	var params []ssm.Parameter
+	err := retryThrottled(ctx, func() error {
+		var err error
+		params, err = s.getParametersByPath(ctx, base)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	if len(params) == 0 {
+		return nil, ErrParamNotFound
+	}
+
+	parameter := newParameter()
+	for _, param := range params {
+		name := strings.TrimPrefix(aws.StringValue(param.Name), base+"/")
+		name = strings.TrimSuffix(name, "/")
+		idx := strings.IndexByte(name, '/')
+		if idx < 0 {
+			continue
+		}
+		typ, name := name[:idx], name[idx+1:]
+		parameter.set(typ, name, aws.StringValue(param.Value))
+		if typ == "oauth2" && name == "refresh_token" {
+			// write back the rotated refresh token.
+			parameter.OAuth2.store = &ssmRefreshTokenStore{
+				svc:  s.ssm(),
+				name: aws.StringValue(param.Name),
+			}
+			parameter.OAuth2.version = aws.Int64Value(param.Version)
+		}
+	}
+	return parameter, nil
+}
+
+func (s *SSMSource) getParametersByPath(ctx context.Context, base string) ([]ssm.Parameter, error) {
+	req := s.ssm().GetParametersByPathRequest(&ssm.GetParametersByPathInput{
+		Path:           aws.String(base),
+		Recursive:      aws.Bool(true),
+		WithDecryption: aws.Bool(true),
+	})
+	req.SetContext(ctx)
+	pager := req.Paginate()
+	var params []ssm.Parameter
+	for pager.Next() {
+		params = append(params, pager.CurrentPage().Parameters...)
+	}
+	if err := pager.Err(); err != nil {
+		return nil, err
+	}
+	return params, nil
+}
+
+// SecretsManagerSource gets the parameters from AWS Secrets Manager.
+// The secret of the host is {Prefix}/{host}, and it is a JSON object of the types and the names, e.g.
+//
+//	{"headers": {"Authorization": "token xxxx"}, "basic": {"username": "foo", "password": "bar"}}
+//
+// The secret must not contain oauth2/refresh_token, because the rotated refresh tokens are not written back to the secret.
+type SecretsManagerSource struct {
+	Config aws.Config
+	Prefix string
+
+	mu                sync.Mutex
+	svcsecretsmanager secretsmanageriface.SecretsManagerAPI
+}
+
+func (s *SecretsManagerSource) secretsmanager() secretsmanageriface.SecretsManagerAPI {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.svcsecretsmanager == nil {
+		s.svcsecretsmanager = secretsmanager.New(s.Config)
+	}
+	return s.svcsecretsmanager
+}
+
+// GetParameter implements Source.
+func (s *SecretsManagerSource) GetParameter(ctx context.Context, host string) (*Parameter, error) {
+	id := strings.TrimPrefix(path.Join(s.Prefix, host), "/")
+	var resp *secretsmanager.GetSecretValueOutput
+	err := retryThrottled(ctx, func() error {
+		req := s.secretsmanager().GetSecretValueRequest(&secretsmanager.GetSecretValueInput{
+			SecretId: aws.String(id),
+		})
+		req.SetContext(ctx)
+		var err error
+		resp, err = req.Send()
+		return err
+	})
+	if err != nil {
+		if aerr, ok := err.(awserr.Error); ok && aerr.Code() == secretsmanager.ErrCodeResourceNotFoundException {
+			return nil, ErrParamNotFound
+		}
+		return nil, err
+	}
+
+	var secret map[string]map[string]string
+	if err := json.Unmarshal([]byte(aws.StringValue(resp.SecretString)), &secret); err != nil {
+		return nil, err
+	}
+	if len(secret) == 0 {
+		return nil, ErrParamNotFound
+	}
+	if _, ok := secret["oauth2"]["refresh_token"]; ok {
+		// the old refresh token is revoked on rotation, and the secret would keep the revoked one.
+		return nil, fmt.Errorf("proxy: oauth2/refresh_token is not supported by AWS Secrets Manager, use AWS SSM Parameter Store for the secret %s", id)
+	}
+
+	// sort the names to make the result stable.
+	var names []string
+	for typ, values := range secret {
+		for name := range values {
+			names = append(names, typ+"/"+name)
+		}
+	}
+	sort.Strings(names)
+	parameter := newParameter()
+	for _, name := range names {
+		idx := strings.IndexByte(name, '/')
+		typ, name := name[:idx], name[idx+1:]
+		parameter.set(typ, name, secret[typ][name])
+	}
+	return parameter, nil
+}
+
+// ChainSource is the list of sources.
+// The first source which has the parameters of the host is used.
+type ChainSource []Source
+
+// GetParameter implements Source.
+func (c ChainSource) GetParameter(ctx context.Context, host string) (*Parameter, error) {
+	for _, s := range c {
+		param, err := s.GetParameter(ctx, host)
+		if err == ErrParamNotFound {
+			continue
+		}
+		return param, err
+	}
+	return nil, ErrParamNotFound
+}
+
+// retryThrottled calls f, and retries with exponential backoff if the request is throttled.
+func retryThrottled(ctx context.Context, f func() error) error {
+	for i := 0; ; i++ {
+		err := f()
+		if err == nil || !isThrottlingError(err) || i >= maxThrottleRetries {
+			return err
+		}
+		delay := time.Duration(rand.Int63n(int64(throttleBaseDelay << uint(i))))
+		timer := time.NewTimer(delay)
+		select {
+		case <-timer.C:
+		case <-ctx.Done():
+			timer.Stop()
+			return err
+		}
+	}
+}
+
+func isThrottlingError(err error) bool {
+	if aerr, ok := err.(awserr.Error); ok {
+		return aerr.Code() == "ThrottlingException"
+	}
+	return false
+}
@@ -0,0 +1,127 @@
+package proxy
+
+import (
+	"context"
+	"net/http"
+	"net/url"
+	"testing"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/aws/awserr"
+	"github.com/aws/aws-sdk-go-v2/service/secretsmanager"
+	"github.com/aws/aws-sdk-go-v2/service/secretsmanager/secretsmanageriface"
+	"github.com/aws/aws-sdk-go-v2/service/ssm"
+	"github.com/google/go-cmp/cmp"
+	"github.com/google/go-cmp/cmp/cmpopts"
+)
+
+type secretsManagerMock struct {
+	secretsmanageriface.SecretsManagerAPI
+	secrets map[string]string
+}
+
+func (mock *secretsManagerMock) GetSecretValueRequest(input *secretsmanager.GetSecretValueInput) secretsmanager.GetSecretValueRequest {
+	req := &aws.Request{
+		HTTPRequest: &http.Request{},
+		Operation:   &aws.Operation{},
+	}
+	if secret, ok := mock.secrets[aws.StringValue(input.SecretId)]; ok {
+		req.Data = &secretsmanager.GetSecretValueOutput{
+			Name:         input.SecretId,
+			SecretString: aws.String(secret),
+		}
+	} else {
+		req.Error = awserr.New(secretsmanager.ErrCodeResourceNotFoundException, "not found", nil)
+	}
+	return secretsmanager.GetSecretValueRequest{
+		Request: req,
+		Input:   input,
+	}
+}
+
+func TestSecretsManagerSource(t *testing.T) {
+	s := &SecretsManagerSource{
+		Prefix: "development",
+		svcsecretsmanager: &secretsManagerMock{
+			secrets: map[string]string{
+				"development/api.example.com": `{
+					"headers": {"Authorization": "token very-secret"},
+					"basic": {"username": "foo", "password": "bar"},
+					"rewrite": {"path": "/foo/bar"},
+					"queries": {"access_token": "very-secret"}
+				}`,
+				"development/oauth.example.com": `{
+					"oauth2": {"token_url": "https://oauth.example.com/token", "client_id": "foo", "refresh_token": "very-secret"}
+				}`,
+			},
+		},
+	}
+
+	param, err := s.GetParameter(context.Background(), "api.example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := &Parameter{
+		Headers: http.Header{
+			"Authorization": []string{"token very-secret"},
+		},
+		User:     "foo",
+		Password: "bar",
+		Path:     "/foo/bar",
+		Queries: url.Values{
+			"access_token": []string{"very-secret"},
+		},
+		RedactResponse: true,
+		Names: []string{
+			"basic/password",
+			"basic/username",
+			"headers/Authorization",
+			"queries/access_token",
+			"rewrite/path",
+		},
+	}
+	if diff := cmp.Diff(param, want, cmpopts.IgnoreUnexported(Parameter{})); diff != "" {
+		t.Errorf("Parameter differs: (-got +want)\n%s", diff)
+	}
+
+	if _, err := s.GetParameter(context.Background(), "unknown.example.com"); err != ErrParamNotFound {
+		t.Errorf("want ErrParamNotFound, got %v", err)
+	}
+
+	// the rotated refresh token can't be written back.
+	if _, err := s.GetParameter(context.Background(), "oauth.example.com"); err == nil || err == ErrParamNotFound {
+		t.Errorf("want error, got %v", err)
+	}
+}
+
+func TestChainSource(t *testing.T) {
+	ssmSource := &SSMSource{
+		Prefix: "development",
+		svcssm: &ssmMock{
+			output: &ssm.GetParametersByPathOutput{},
+		},
+	}
+	secretsManagerSource := &SecretsManagerSource{
+		Prefix: "development",
+		svcsecretsmanager: &secretsManagerMock{
+			secrets: map[string]string{
+				"development/api.example.com": `{"headers": {"Authorization": "token very-secret"}}`,
+			},
+		},
+	}
+	l := &Lambda{
+		Source: ChainSource{ssmSource, secretsManagerSource},
+	}
+
+	param, err := l.getParam(context.Background(), "api.example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := param.Headers.Get("Authorization"); got != "token very-secret" {
+		t.Errorf("want %s, got %s", "token very-secret", got)
+	}
+
+	if _, err := l.getParam(context.Background(), "unknown.example.com"); err != ErrParamNotFound {
+		t.Errorf("want ErrParamNotFound, got %v", err)
+	}
+}
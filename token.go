@@ -0,0 +1,188 @@
+package proxy
+
+import (
+	"context"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/sync/singleflight"
+)
+
+const (
+	// tokenExpiryDelta is the duration before the expiry when the tokens are refreshed.
+	tokenExpiryDelta = time.Minute
+
+	// tokenTimeout is the timeout for fetching tokens.
+	tokenTimeout = 10 * time.Second
+
+	// tokenRejectInterval is the minimum interval between the refreshes forced by 401 responses.
+	// It prevents the endpoints which always return 401 from burning the quota of the token endpoints.
+	tokenRejectInterval = time.Minute
+)
+
+// accessToken is the token issued by the authorization servers.
+type accessToken struct {
+	Value string
+
+	// Expires is the expiry of the token. Zero means that it never expires.
+	Expires time.Time
+}
+
+func (t *accessToken) valid(now time.Time) bool {
+	if t == nil || t.Value == "" {
+		return false
+	}
+	if t.Expires.IsZero() {
+		return true
+	}
+	return now.Add(tokenExpiryDelta).Before(t.Expires)
+}
+
+// tokenCache caches the token until shortly before it expires.
+// The concurrent refreshes are de-duplicated.
+type tokenCache struct {
+	group singleflight.Group
+	mu    sync.Mutex
+	token *accessToken
+
+	// rejected is the time when the token was removed by reject.
+	rejected time.Time
+}
+
+// get returns the cached token, or fetches a new token.
+func (c *tokenCache) get(ctx context.Context, fetch func(ctx context.Context) (*accessToken, error)) (string, error) {
+	c.mu.Lock()
+	token := c.token
+	c.mu.Unlock()
+	if token.valid(timeNow()) {
+		return token.Value, nil
+	}
+
+	result := c.group.DoChan("token", func() (interface{}, error) {
+		// the fetch must not be canceled by the request which started it,
+		// because the other requests are waiting for it.
+		ctx, cancel := context.WithTimeout(context.Background(), tokenTimeout)
+		defer cancel()
+		token, err := fetch(ctx)
+		if err != nil {
+			return nil, err
+		}
+		c.mu.Lock()
+		defer c.mu.Unlock()
+		c.token = token
+		return token, nil
+	})
+	select {
+	case r := <-result:
+		if r.Err != nil {
+			return "", r.Err
+		}
+		return r.Val.(*accessToken).Value, nil
+	case <-ctx.Done():
+		return "", ctx.Err()
+	}
+}
+
+// current returns the cached token.
+func (c *tokenCache) current() string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.token == nil {
+		return ""
+	}
+	return c.token.Value
+}
+
+// invalidate removes the cached token.
+func (c *tokenCache) invalidate() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.token = nil
+}
+
+// reject removes the cached token if req sent it and the upstream rejected it.
+// It reports whether the request should be retried with another token.
+func (c *tokenCache) reject(req *http.Request) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if req == nil || c.token == nil {
+		return false
+	}
+	if !sentToken(req, c.token.Value) {
+		// another request has already refreshed the token. retry with it.
+		return true
+	}
+	now := timeNow()
+	if !c.rejected.IsZero() && now.Sub(c.rejected) < tokenRejectInterval {
+		return false
+	}
+	c.token = nil
+	c.rejected = now
+	return true
+}
+
+// sentToken reports whether the headers or the queries of req contain the token.
+func sentToken(req *http.Request, token string) bool {
+	for _, vv := range req.Header {
+		for _, v := range vv {
+			if strings.Contains(v, token) {
+				return true
+			}
+		}
+	}
+	return strings.Contains(req.URL.RawQuery, token)
+}
+
+// tokens returns the current tokens to be redacted.
+func (p *Parameter) tokens() []string {
+	var ret []string
+	if p.OAuth2 != nil && p.OAuth2.tokens != nil {
+		if token := p.OAuth2.tokens.current(); token != "" {
+			ret = append(ret, token)
+		}
+	}
+	if p.OAuth2 != nil && p.OAuth2.refresh != nil {
+		if token, _ := p.OAuth2.refresh.get(); token != "" {
+			ret = append(ret, token)
+		}
+	}
+	if p.JWT != nil && p.JWT.tokens != nil {
+		if token := p.JWT.tokens.current(); token != "" {
+			ret = append(ret, token)
+		}
+	}
+	if p.GitHubApp != nil && p.GitHubApp.tokens != nil {
+		if token := p.GitHubApp.tokens.current(); token != "" {
+			ret = append(ret, token)
+		}
+	}
+	return ret
+}
+
+// rejectTokens removes the cached tokens which req sent and the upstream rejected.
+// It reports whether the request should be retried with new tokens.
+func (p *Parameter) rejectTokens(req *http.Request) bool {
+	retry := false
+	if p.OAuth2 != nil && p.OAuth2.tokens != nil && p.OAuth2.tokens.reject(req) {
+		retry = true
+	}
+	if p.JWT != nil && p.JWT.tokens != nil && p.JWT.tokens.reject(req) {
+		retry = true
+	}
+	if p.GitHubApp != nil && p.GitHubApp.tokens != nil && p.GitHubApp.tokens.reject(req) {
+		retry = true
+	}
+	return retry
+}
+
+// retryUnauthorized updates the credentials after the 401 response.
+// It reports whether the request should be retried.
+func (p *Parameter) retryUnauthorized(resp *http.Response) bool {
+	retry := p.rejectTokens(resp.Request)
+	if p.Digest != nil && p.Digest.update(resp.Header) {
+		retry = true
+	}
+	return retry
+}